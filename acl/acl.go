@@ -0,0 +1,358 @@
+package acl
+
+import (
+	"context"
+	"fmt"
+	"github.com/COSAE-FR/riproxy/domains"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type Action int
+
+const (
+	Allow Action = iota
+	Deny
+	Log
+)
+
+var actionNames = map[Action]string{
+	Allow: "allow",
+	Deny:  "deny",
+	Log:   "log",
+}
+
+func ParseAction(action string) (Action, error) {
+	switch strings.ToLower(action) {
+	case "allow", "pass":
+		return Allow, nil
+	case "deny", "block":
+		return Deny, nil
+	case "log":
+		return Log, nil
+	}
+	return Allow, fmt.Errorf("unknown rule action: %s", action)
+}
+
+func (a Action) String() string {
+	return actionNames[a]
+}
+
+// Port ranges are shared with the port qualifiers of domain list entries
+type PortRange = domains.PortRange
+
+type PortRanges = domains.PortRanges
+
+// ParsePortRange parses a single port ("443") or an inclusive range ("8000-8100")
+func ParsePortRange(portRange string) (PortRange, error) {
+	return domains.ParsePortRange(portRange)
+}
+
+func ParsePortRanges(list []string) (PortRanges, error) {
+	return domains.ParsePortRanges(list)
+}
+
+// Resolver resolves the destination hosts, *net.Resolver implements it
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// Request holds the properties of a proxy request the rules are matched against
+type Request struct {
+	Source       net.IP
+	Host         string
+	Port         uint16
+	Method       string
+	Scheme       string
+	Path         string   // URL path, empty for CONNECT requests
+	Resolver     Resolver // net.DefaultResolver if nil
+	User         string   // authenticated user, empty without proxy authentication
+	Groups       map[string]bool
+	resolved     bool
+	destinations []net.IP
+	pinned       net.IP
+}
+
+// NewRequest splits hostPort and uses defaultPort if no port is present
+func NewRequest(source net.IP, hostPort string, defaultPort uint16, method string, scheme string) *Request {
+	req := &Request{
+		Source: source,
+		Host:   hostPort,
+		Port:   defaultPort,
+		Method: method,
+		Scheme: strings.ToLower(scheme),
+	}
+	host, portString, err := net.SplitHostPort(hostPort)
+	if err == nil {
+		req.Host = host
+		port, err := strconv.ParseUint(portString, 10, 16)
+		if err != nil { // Unparsable ports never match a port range
+			port = 0
+		}
+		req.Port = uint16(port)
+	} else if strings.HasPrefix(hostPort, "[") && strings.HasSuffix(hostPort, "]") {
+		req.Host = hostPort[1 : len(hostPort)-1] // IPv6 address without port
+	}
+	return req
+}
+
+// IsIP returns true if the destination host is a raw IP address
+func (r *Request) IsIP() bool {
+	return net.ParseIP(r.Host) != nil
+}
+
+// inGroups returns true if one of the groups of the request is in groups
+func (r *Request) inGroups(groups map[string]bool) bool {
+	for group := range r.Groups {
+		if groups[group] {
+			return true
+		}
+	}
+	return false
+}
+
+// Destinations resolves the destination host once and returns every address of the answer.
+// The rules are matched against these addresses and the proxy dials the pinned one,
+// a second resolution could return a different answer.
+func (r *Request) Destinations() []net.IP {
+	if !r.resolved {
+		r.resolved = true
+		var resolver Resolver = net.DefaultResolver
+		if r.Resolver != nil {
+			resolver = r.Resolver
+		}
+		if ip := net.ParseIP(r.Host); ip != nil {
+			r.destinations = []net.IP{ip}
+		} else if addresses, err := resolver.LookupIPAddr(context.Background(), r.Host); err == nil {
+			for _, address := range addresses {
+				r.destinations = append(r.destinations, address.IP)
+			}
+		}
+	}
+	return r.destinations
+}
+
+// Pinned returns the address the proxy must dial, nil if the destination host cannot be resolved.
+// It is the address matched by the allow rule of the decision, the first address of the answer otherwise:
+// every address then passed the deny rules.
+func (r *Request) Pinned() net.IP {
+	if r.pinned != nil {
+		return r.pinned
+	}
+	if destinations := r.Destinations(); len(destinations) > 0 {
+		return destinations[0]
+	}
+	return nil
+}
+
+// Private, loopback, link-local and unspecified networks
+var privateNetworks = func() []net.IPNet {
+	var networks []net.IPNet
+	for _, cidr := range []string{
+		"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "169.254.0.0/16", "0.0.0.0/8",
+		"fc00::/7", "::1/128", "fe80::/10", "::/128",
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, *network)
+	}
+	return networks
+}()
+
+// IsPrivate returns true if ip is in a private (RFC 1918 or unique local), loopback, link-local or unspecified network
+func IsPrivate(ip net.IP) bool {
+	return containsIP(privateNetworks, ip)
+}
+
+type Rule struct {
+	Name              string
+	Action            Action
+	Message           string
+	Status            int    // HTTP status of deny responses, 403 if not set
+	Category          string // category label of the rule
+	Sources           []net.IPNet
+	Domains           []domains.DomainTree
+	NotDomains        []domains.DomainTree
+	Destinations      []net.IPNet
+	NotDestinations   []net.IPNet
+	Ports             PortRanges
+	NotPorts          PortRanges
+	Methods           map[string]bool
+	NotMethods        map[string]bool
+	Schemes           map[string]bool
+	Paths             []string // URL path prefixes, never matched by CONNECT requests
+	RawIP             bool
+	PrivateResolution bool // host names, not raw IP addresses, resolving to at least one private address
+	Users             map[string]bool
+	Groups            map[string]bool
+	NotGroups         map[string]bool
+}
+
+func containsIP(networks []net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasPrefix(path string, prefixes []string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func lookupDomains(trees []domains.DomainTree, host string, port uint16) *domains.Entry {
+	for _, tree := range trees {
+		if tree == nil {
+			continue
+		}
+		if entry := tree.LookupPort(host, port); entry != nil {
+			return entry
+		}
+	}
+	return nil
+}
+
+// Match returns true if every condition set on the rule matches the request
+func (r *Rule) Match(req *Request) bool {
+	match, _ := r.MatchEntry(req)
+	return match
+}
+
+// MatchEntry matches the rule and returns the domain list entry that matched, if any
+func (r *Rule) MatchEntry(req *Request) (bool, *domains.Entry) {
+	match, entry, _ := r.match(req)
+	return match, entry
+}
+
+// match matches the rule and returns the domain list entry and the destination addresses that matched, if any
+func (r *Rule) match(req *Request) (bool, *domains.Entry, []net.IP) {
+	if len(r.Schemes) > 0 && !r.Schemes[req.Scheme] {
+		return false, nil, nil
+	}
+	if len(r.Methods) > 0 && !r.Methods[req.Method] {
+		return false, nil, nil
+	}
+	if len(r.NotMethods) > 0 && r.NotMethods[req.Method] {
+		return false, nil, nil
+	}
+	if len(r.Ports) > 0 && !r.Ports.Contains(req.Port) {
+		return false, nil, nil
+	}
+	if len(r.NotPorts) > 0 && r.NotPorts.Contains(req.Port) {
+		return false, nil, nil
+	}
+	if len(r.Paths) > 0 && !hasPrefix(req.Path, r.Paths) {
+		return false, nil, nil
+	}
+	if len(r.Sources) > 0 && (req.Source == nil || !containsIP(r.Sources, req.Source)) {
+		return false, nil, nil
+	}
+	if r.RawIP && !req.IsIP() {
+		return false, nil, nil
+	}
+	if len(r.Users) > 0 && !r.Users[req.User] {
+		return false, nil, nil
+	}
+	if len(r.Groups) > 0 && !req.inGroups(r.Groups) {
+		return false, nil, nil
+	}
+	if len(r.NotGroups) > 0 && req.inGroups(r.NotGroups) {
+		return false, nil, nil
+	}
+	var entry *domains.Entry
+	if len(r.Domains) > 0 {
+		if entry = lookupDomains(r.Domains, req.Host, req.Port); entry == nil {
+			return false, nil, nil
+		}
+	}
+	if len(r.NotDomains) > 0 && lookupDomains(r.NotDomains, req.Host, req.Port) != nil {
+		return false, nil, nil
+	}
+	addresses, ok := r.matchAddresses(req)
+	if !ok {
+		return false, nil, nil
+	}
+	return true, entry, addresses
+}
+
+// matchAddresses matches the address conditions of the rule and returns the destination addresses satisfying all of
+// them, nil if the rule has no address condition
+func (r *Rule) matchAddresses(req *Request) ([]net.IP, bool) {
+	if len(r.Destinations) == 0 && len(r.NotDestinations) == 0 && !r.PrivateResolution {
+		return nil, true
+	}
+	if r.PrivateResolution && req.IsIP() {
+		return nil, false
+	}
+	destinations := req.Destinations()
+	if len(destinations) == 0 {
+		// An unresolved host is not excluded by NotDestinations
+		return nil, len(r.Destinations) == 0 && !r.PrivateResolution
+	}
+	// One address satisfying every condition is enough to match
+	var addresses []net.IP
+	for _, ip := range destinations {
+		if len(r.Destinations) > 0 && !containsIP(r.Destinations, ip) {
+			continue
+		}
+		if len(r.NotDestinations) > 0 && containsIP(r.NotDestinations, ip) {
+			continue
+		}
+		if r.PrivateResolution && !IsPrivate(ip) {
+			continue
+		}
+		addresses = append(addresses, ip)
+	}
+	return addresses, len(addresses) > 0
+}
+
+type Match struct {
+	Rule  *Rule
+	Entry *domains.Entry // matched domain list entry, nil if the rule has no domain condition
+}
+
+type Decision struct {
+	Match          // first matching allow or deny rule, Rule is nil if none matched
+	Logged []Match // log rules matched before the decision
+}
+
+func (d Decision) Allowed() bool {
+	return d.Rule == nil || d.Rule.Action != Deny
+}
+
+type List []*Rule
+
+// Evaluate walks the list in order: the first matching allow or deny rule wins,
+// matching log rules are collected and evaluation continues.
+// Requests matching no rule are allowed.
+// A request allowed by a rule with address conditions is pinned to an address satisfying them.
+func (l List) Evaluate(req *Request) Decision {
+	decision := Decision{}
+	req.pinned = nil
+	for _, rule := range l {
+		match, entry, addresses := rule.match(req)
+		if !match {
+			continue
+		}
+		if rule.Action == Log {
+			decision.Logged = append(decision.Logged, Match{Rule: rule, Entry: entry})
+			continue
+		}
+		decision.Match = Match{Rule: rule, Entry: entry}
+		// The rules evaluated after an allow rule do not check the other addresses of the answer
+		if rule.Action == Allow && len(addresses) > 0 {
+			req.pinned = addresses[0]
+		}
+		return decision
+	}
+	return decision
+}
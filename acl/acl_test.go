@@ -0,0 +1,240 @@
+package acl
+
+import (
+	"github.com/COSAE-FR/riproxy/domains"
+	"net"
+	"testing"
+)
+
+func TestParsePortRange(t *testing.T) {
+	portRange, err := ParsePortRange("8000-8100")
+	if err != nil {
+		t.Fatalf("Cannot parse port range: %s", err)
+	}
+	if !portRange.Contains(8000) || !portRange.Contains(8100) || portRange.Contains(8101) {
+		t.Fatalf("Wrong port range bounds %+v", portRange)
+	}
+	if _, err := ParsePortRange("8100-8000"); err == nil {
+		t.Fatalf("Reversed port range accepted")
+	}
+	if _, err := ParsePortRange("http"); err == nil {
+		t.Fatalf("Named port accepted")
+	}
+}
+
+func TestEvaluateFirstMatchWins(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("192.0.2.0/24")
+	rules := List{
+		{Name: "log", Action: Log, Domains: []domains.DomainTree{domains.NewFromList([]string{"*.example.com"})}},
+		{Name: "lan", Action: Allow, Sources: []net.IPNet{*lan}},
+		{Name: "deny", Action: Deny, Domains: []domains.DomainTree{domains.NewFromList([]string{"*.example.com"})}},
+	}
+	decision := rules.Evaluate(NewRequest(net.ParseIP("192.0.2.10"), "www.example.com:443", 443, "CONNECT", "https"))
+	if !decision.Allowed() || decision.Rule == nil || decision.Rule.Name != "lan" {
+		t.Fatalf("LAN client should be allowed by the lan rule: %+v", decision.Rule)
+	}
+	if len(decision.Logged) != 1 {
+		t.Fatalf("Log rule should have been matched")
+	}
+	decision = rules.Evaluate(NewRequest(net.ParseIP("198.51.100.1"), "www.example.com", 80, "GET", "http"))
+	if decision.Allowed() || decision.Rule.Name != "deny" {
+		t.Fatalf("Other clients should be denied")
+	}
+	decision = rules.Evaluate(NewRequest(net.ParseIP("198.51.100.1"), "www.example.org", 80, "GET", "http"))
+	if !decision.Allowed() || decision.Rule != nil {
+		t.Fatalf("Unmatched requests should be allowed")
+	}
+}
+
+func TestNegatedConditions(t *testing.T) {
+	rule := &Rule{
+		Action:     Deny,
+		Schemes:    map[string]bool{"https": true},
+		NotPorts:   PortRanges{{Low: 443, High: 443}},
+		NotMethods: map[string]bool{"CONNECT": true},
+	}
+	if rule.Match(NewRequest(nil, "example.com:8443", 443, "CONNECT", "https")) {
+		t.Fatalf("Allowed method should not match")
+	}
+	rule.NotMethods = nil
+	if !rule.Match(NewRequest(nil, "example.com:8443", 443, "CONNECT", "https")) {
+		t.Fatalf("Port 8443 should match")
+	}
+	if rule.Match(NewRequest(nil, "example.com", 443, "CONNECT", "https")) {
+		t.Fatalf("Port 443 should not match")
+	}
+	if rule.Match(NewRequest(nil, "example.com:8443", 80, "GET", "http")) {
+		t.Fatalf("HTTP scheme should not match")
+	}
+}
+
+func TestDestinations(t *testing.T) {
+	_, blocked, _ := net.ParseCIDR("192.0.2.0/24")
+	_, allowed, _ := net.ParseCIDR("192.0.2.128/25")
+	rule := &Rule{
+		Action:          Deny,
+		Destinations:    []net.IPNet{*blocked},
+		NotDestinations: []net.IPNet{*allowed},
+	}
+	if !rule.Match(NewRequest(nil, "192.0.2.10:8080", 80, "GET", "http")) {
+		t.Fatalf("Blocked network should match")
+	}
+	if rule.Match(NewRequest(nil, "192.0.2.200", 443, "CONNECT", "https")) {
+		t.Fatalf("Allowed network should not match")
+	}
+	if rule.Match(NewRequest(nil, "198.51.100.1", 80, "GET", "http")) {
+		t.Fatalf("Other network should not match")
+	}
+}
+
+func TestIPv6Destinations(t *testing.T) {
+	_, blocked, _ := net.ParseCIDR("2001:db8::/32")
+	rule := &Rule{Action: Deny, Destinations: []net.IPNet{*blocked}}
+	for hostPort, port := range map[string]uint16{
+		"[2001:db8::1]:8080": 8080,
+		"[2001:db8::1]":      80,
+		"2001:db8::1":        80,
+	} {
+		req := NewRequest(nil, hostPort, 80, "GET", "http")
+		if req.Host != "2001:db8::1" || req.Port != port || !req.IsIP() {
+			t.Errorf("Wrong request for %s: %s %d", hostPort, req.Host, req.Port)
+		}
+		if !rule.Match(req) {
+			t.Errorf("Blocked network should match %s", hostPort)
+		}
+	}
+	if rule.Match(NewRequest(nil, "[2001:db9::1]:443", 443, "CONNECT", "https")) {
+		t.Fatalf("Other network should not match")
+	}
+}
+
+// resolvedRequest returns a request for a host name resolved to addresses
+func resolvedRequest(host string, addresses ...string) *Request {
+	req := NewRequest(nil, host, 443, "CONNECT", "https")
+	req.resolved = true
+	for _, address := range addresses {
+		req.destinations = append(req.destinations, net.ParseIP(address))
+	}
+	return req
+}
+
+func TestEveryDestinationChecked(t *testing.T) {
+	_, blocked, _ := net.ParseCIDR("10.0.0.0/8")
+	_, allowed, _ := net.ParseCIDR("10.1.0.0/16")
+	rule := &Rule{
+		Action:          Deny,
+		Destinations:    []net.IPNet{*blocked},
+		NotDestinations: []net.IPNet{*allowed},
+	}
+	if !rule.Match(resolvedRequest("rebind.example.com", "198.51.100.1", "10.2.0.1")) {
+		t.Fatalf("One blocked address should match")
+	}
+	if !rule.Match(resolvedRequest("rebind.example.com", "10.1.0.1", "10.2.0.1")) {
+		t.Fatalf("One address outside of the allowed network should match")
+	}
+	if rule.Match(resolvedRequest("intranet.example.com", "10.1.0.1", "10.1.0.2")) {
+		t.Fatalf("Allowed addresses should not match")
+	}
+	if pinned := resolvedRequest("rebind.example.com", "198.51.100.1", "10.2.0.1").Pinned(); !pinned.Equal(net.ParseIP("198.51.100.1")) {
+		t.Fatalf("Wrong pinned address %s", pinned)
+	}
+	if pinned := resolvedRequest("unknown.example.com").Pinned(); pinned != nil {
+		t.Fatalf("Unresolved host should have no pinned address, got %s", pinned)
+	}
+}
+
+func TestMixedAnswerPinned(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("203.0.113.0/24")
+	_, internal, _ := net.ParseCIDR("10.0.0.0/8")
+	rules := List{
+		{Name: "user", Action: Allow, Destinations: []net.IPNet{*trusted}},
+		{Name: "block_networks", Action: Deny, Destinations: []net.IPNet{*internal}},
+	}
+	// The request allowed by the user rule is pinned to the trusted address, not to the first one of the answer
+	req := resolvedRequest("rebind.example.com", "10.0.0.5", "203.0.113.5")
+	if decision := rules.Evaluate(req); !decision.Allowed() || decision.Rule.Name != "user" {
+		t.Fatalf("Request not allowed by the user rule")
+	}
+	if pinned := req.Pinned(); !pinned.Equal(net.ParseIP("203.0.113.5")) {
+		t.Fatalf("Wrong pinned address %s", pinned)
+	}
+	// Without the allow rule the internal address is denied
+	req = resolvedRequest("rebind.example.com", "10.0.0.5", "203.0.113.5")
+	if decision := rules[1:].Evaluate(req); decision.Allowed() {
+		t.Fatalf("Internal address not denied")
+	}
+	// An allow rule excluding networks pins an address outside of them
+	rules = List{{Name: "user", Action: Allow, NotDestinations: []net.IPNet{*internal}}}
+	req = resolvedRequest("rebind.example.com", "10.0.0.5", "198.51.100.1")
+	if decision := rules.Evaluate(req); !decision.Allowed() || decision.Rule == nil {
+		t.Fatalf("Request not allowed by the user rule")
+	}
+	if pinned := req.Pinned(); !pinned.Equal(net.ParseIP("198.51.100.1")) {
+		t.Fatalf("Wrong pinned address %s", pinned)
+	}
+	// A request allowed without address condition keeps the first address
+	req = resolvedRequest("www.example.com", "198.51.100.1", "198.51.100.2")
+	rules = List{{Name: "user", Action: Allow}}
+	if rules.Evaluate(req); !req.Pinned().Equal(net.ParseIP("198.51.100.1")) {
+		t.Fatalf("Wrong pinned address %s", req.Pinned())
+	}
+}
+
+func TestPrivateResolution(t *testing.T) {
+	rule := &Rule{Action: Deny, PrivateResolution: true}
+	for _, address := range []string{"10.0.0.1", "172.16.5.4", "192.168.1.1", "127.0.0.1", "169.254.169.254", "::1", "fe80::1", "fd00::1"} {
+		if !rule.Match(resolvedRequest("rebind.example.com", "198.51.100.1", address)) {
+			t.Fatalf("Name resolving to %s should match", address)
+		}
+	}
+	if rule.Match(resolvedRequest("www.example.com", "198.51.100.1", "2001:db8::1")) {
+		t.Fatalf("Name resolving to public addresses should not match")
+	}
+	if rule.Match(NewRequest(nil, "192.168.1.1:443", 443, "CONNECT", "https")) {
+		t.Fatalf("Raw IP addresses should not match")
+	}
+}
+
+func TestPaths(t *testing.T) {
+	rule := &Rule{Action: Deny, Paths: []string{"/upload", "/api/share"}}
+	req := NewRequest(nil, "files.example.com", 443, "POST", "https")
+	req.Path = "/upload/new"
+	if !rule.Match(req) {
+		t.Fatalf("Path prefix should match")
+	}
+	req.Path = "/download"
+	if rule.Match(req) {
+		t.Fatalf("Other path should not match")
+	}
+	if rule.Match(NewRequest(nil, "files.example.com:443", 443, "CONNECT", "https")) {
+		t.Fatalf("CONNECT request should not match a path rule")
+	}
+}
+
+func TestUsersAndGroups(t *testing.T) {
+	rule := &Rule{
+		Action:    Deny,
+		Groups:    map[string]bool{"students": true},
+		NotGroups: map[string]bool{"staff": true},
+	}
+	req := NewRequest(nil, "www.example.com", 80, "GET", "http")
+	if rule.Match(req) {
+		t.Fatalf("Anonymous request should not match a group rule")
+	}
+	req.User, req.Groups = "alice", map[string]bool{"students": true}
+	if !rule.Match(req) {
+		t.Fatalf("Group member should match")
+	}
+	req.Groups["staff"] = true
+	if rule.Match(req) {
+		t.Fatalf("Excluded group member should not match")
+	}
+	rule = &Rule{Action: Allow, Users: map[string]bool{"bob": true}}
+	if rule.Match(req) {
+		t.Fatalf("Other user should not match")
+	}
+	req.User = "bob"
+	if !rule.Match(req) {
+		t.Fatalf("Listed user should match")
+	}
+}
@@ -0,0 +1,163 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// Authenticator checks the credentials of the proxy users.
+// Invalid credentials return false without error, an error means the backend cannot answer.
+type Authenticator interface {
+	Authenticate(ctx context.Context, username string, password string) (bool, error)
+}
+
+type Result int
+
+const (
+	Rejected Result = iota
+	Accepted
+	Limited // too many failures from the source, the credentials were not checked
+)
+
+func (r Result) String() string {
+	switch r {
+	case Accepted:
+		return "accepted"
+	case Limited:
+		return "limited"
+	}
+	return "rejected"
+}
+
+// Cache remembers the valid credentials for a duration, the slow or remote backends are not queried for each request.
+// A password changed in the backend stays valid until the end of the duration.
+type Cache struct {
+	Authenticator Authenticator
+	TTL           time.Duration
+	key           []byte // random key of the password digests, they cannot be compared between processes
+	lock          sync.Mutex
+	entries       map[string]time.Time
+	sweep         time.Time
+}
+
+func NewCache(authenticator Authenticator, ttl time.Duration) *Cache {
+	key := make([]byte, sha256.Size)
+	_, _ = rand.Read(key)
+	return &Cache{Authenticator: authenticator, TTL: ttl, key: key, entries: map[string]time.Time{}}
+}
+
+func (c *Cache) digest(username string, password string) string {
+	mac := hmac.New(sha256.New, c.key)
+	_, _ = mac.Write([]byte(username))
+	_, _ = mac.Write([]byte{0})
+	_, _ = mac.Write([]byte(password))
+	return string(mac.Sum(nil))
+}
+
+func (c *Cache) Authenticate(ctx context.Context, username string, password string) (bool, error) {
+	digest := c.digest(username, password)
+	now := time.Now()
+	c.lock.Lock()
+	expires, ok := c.entries[digest]
+	c.lock.Unlock()
+	if ok && now.Before(expires) {
+		return true, nil
+	}
+	valid, err := c.Authenticator.Authenticate(ctx, username, password)
+	if err != nil || !valid {
+		return valid, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if now.After(c.sweep) {
+		for entry, expires := range c.entries {
+			if now.After(expires) {
+				delete(c.entries, entry)
+			}
+		}
+		c.sweep = now.Add(c.TTL)
+	}
+	c.entries[digest] = now.Add(c.TTL)
+	return true, nil
+}
+
+type failures struct {
+	count int
+	reset time.Time
+}
+
+// Limiter counts the authentication failures of each source, a source is limited after Max failures
+// until the end of the window started by its first failure
+type Limiter struct {
+	Max     int
+	Window  time.Duration
+	lock    sync.Mutex
+	sources map[string]*failures
+	sweep   time.Time
+}
+
+func NewLimiter(max int, window time.Duration) *Limiter {
+	return &Limiter{Max: max, Window: window, sources: map[string]*failures{}}
+}
+
+// Limited returns true if source reached the maximum number of failures
+func (l *Limiter) Limited(source string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry, ok := l.sources[source]
+	return ok && entry.count >= l.Max && time.Now().Before(entry.reset)
+}
+
+// Failed records a failure of source
+func (l *Limiter) Failed(source string) {
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if now.After(l.sweep) {
+		for address, entry := range l.sources {
+			if now.After(entry.reset) {
+				delete(l.sources, address)
+			}
+		}
+		l.sweep = now.Add(l.Window)
+	}
+	entry, ok := l.sources[source]
+	if !ok || now.After(entry.reset) {
+		entry = &failures{reset: now.Add(l.Window)}
+		l.sources[source] = entry
+	}
+	entry.count++
+}
+
+// Service checks the credentials sent by a source with an authenticator, the limiter is optional
+type Service struct {
+	Authenticator Authenticator
+	Limiter       *Limiter
+}
+
+// Check returns Accepted if the credentials are valid, the errors of the backend are returned with Rejected
+func (s *Service) Check(ctx context.Context, source string, username string, password string) (Result, error) {
+	if s.Limiter != nil && s.Limiter.Limited(source) {
+		return Limited, nil
+	}
+	// Empty passwords are refused before reaching the backend, an LDAP bind without password is anonymous
+	valid := false
+	var err error
+	if len(username) > 0 && len(password) > 0 {
+		valid, err = s.Authenticator.Authenticate(ctx, username, password)
+	}
+	if err != nil {
+		return Rejected, err
+	}
+	if !valid {
+		if s.Limiter != nil {
+			s.Limiter.Failed(source)
+		}
+		return Rejected, nil
+	}
+	return Accepted, nil
+}
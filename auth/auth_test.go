@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// countingAuthenticator accepts a single password and counts the checks
+type countingAuthenticator struct {
+	password string
+	checks   int
+	err      error
+}
+
+func (a *countingAuthenticator) Authenticate(_ context.Context, _ string, password string) (bool, error) {
+	a.checks++
+	return password == a.password, a.err
+}
+
+func TestCache(t *testing.T) {
+	backend := &countingAuthenticator{password: "secret"}
+	cache := NewCache(backend, 50*time.Millisecond)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		if valid, _ := cache.Authenticate(ctx, "alice", "secret"); !valid {
+			t.Fatalf("Valid password refused")
+		}
+	}
+	if backend.checks != 1 {
+		t.Fatalf("Expected 1 backend check, got %d", backend.checks)
+	}
+	for i := 0; i < 2; i++ {
+		if valid, _ := cache.Authenticate(ctx, "alice", "wrong"); valid {
+			t.Fatalf("Invalid password accepted")
+		}
+	}
+	if backend.checks != 3 {
+		t.Fatalf("Failures must not be cached, got %d backend checks", backend.checks)
+	}
+	if valid, _ := cache.Authenticate(ctx, "bob", "secret"); !valid || backend.checks != 4 {
+		t.Fatalf("Cached password used for another user")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if valid, _ := cache.Authenticate(ctx, "alice", "secret"); !valid || backend.checks != 5 {
+		t.Fatalf("Expired entry used, %d backend checks", backend.checks)
+	}
+}
+
+func TestService(t *testing.T) {
+	backend := &countingAuthenticator{password: "secret"}
+	service := &Service{Authenticator: backend, Limiter: NewLimiter(2, 50*time.Millisecond)}
+	ctx := context.Background()
+	if result, _ := service.Check(ctx, "192.0.2.1", "alice", "secret"); result != Accepted {
+		t.Fatalf("Expected accepted, got %s", result)
+	}
+	for i := 0; i < 2; i++ {
+		if result, _ := service.Check(ctx, "192.0.2.1", "alice", "wrong"); result != Rejected {
+			t.Fatalf("Expected rejected, got %s", result)
+		}
+	}
+	if result, _ := service.Check(ctx, "192.0.2.1", "alice", "secret"); result != Limited {
+		t.Fatalf("Expected limited, got %s", result)
+	}
+	if result, _ := service.Check(ctx, "192.0.2.2", "alice", "secret"); result != Accepted {
+		t.Fatalf("Other source limited, got %s", result)
+	}
+	if result, _ := service.Check(ctx, "192.0.2.2", "alice", ""); result != Rejected || backend.checks != 4 {
+		t.Fatalf("Empty password sent to the backend")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if result, _ := service.Check(ctx, "192.0.2.1", "alice", "secret"); result != Accepted {
+		t.Fatalf("Source still limited after the window, got %s", result)
+	}
+	backend.err = errors.New("unreachable")
+	if result, err := service.Check(ctx, "192.0.2.3", "alice", "wrong"); result != Rejected || err == nil {
+		t.Fatalf("Backend error not reported")
+	}
+	if service.Limiter.Limited("192.0.2.3") || service.Limiter.sources["192.0.2.3"] != nil {
+		t.Fatalf("Backend error counted as a failure")
+	}
+}
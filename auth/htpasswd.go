@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"os"
+	"strings"
+)
+
+const shaPrefix = "{SHA}"
+
+// Htpasswd holds the users of an htpasswd file, the passwords are hashed with bcrypt or SHA-1 ({SHA})
+type Htpasswd struct {
+	Path  string
+	users map[string]string
+}
+
+// ParseHtpasswd reads the users of an htpasswd file from reader, lines with an unsupported hash are errors
+func ParseHtpasswd(reader io.Reader) (map[string]string, error) {
+	users := map[string]string{}
+	scanner := bufio.NewScanner(reader)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		separator := strings.IndexByte(line, ':')
+		if separator <= 0 {
+			return nil, fmt.Errorf("line %d: missing user name", lineNumber)
+		}
+		user, hash := line[:separator], line[separator+1:]
+		if !supportedHash(hash) {
+			return nil, fmt.Errorf("line %d: unsupported password hash for user %s, use bcrypt or SHA", lineNumber, user)
+		}
+		users[user] = hash
+	}
+	return users, scanner.Err()
+}
+
+func supportedHash(hash string) bool {
+	if strings.HasPrefix(hash, shaPrefix) {
+		decoded, err := base64.StdEncoding.DecodeString(hash[len(shaPrefix):])
+		return err == nil && len(decoded) == sha1.Size
+	}
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// LoadHtpasswd loads the users of the htpasswd file stored in path
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	users, err := ParseHtpasswd(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &Htpasswd{Path: path, users: users}, nil
+}
+
+func (h *Htpasswd) Len() int {
+	return len(h.users)
+}
+
+// Authenticate returns true if password is the password of username.
+// bcrypt is slow, the valid passwords should be remembered with a Cache.
+func (h *Htpasswd) Authenticate(_ context.Context, username string, password string) (bool, error) {
+	hash, ok := h.users[username]
+	if !ok {
+		return false, nil
+	}
+	if strings.HasPrefix(hash, shaPrefix) {
+		sum := sha1.Sum([]byte(password))
+		expected := hash[len(shaPrefix):]
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(expected)) == 1, nil
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil, nil
+}
+
+// BasicCredentials parses the value of a Proxy-Authorization header with the Basic scheme
+func BasicCredentials(header string) (string, string, bool) {
+	const prefix = "basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len(prefix):]))
+	if err != nil {
+		return "", "", false
+	}
+	separator := strings.IndexByte(string(decoded), ':')
+	if separator < 0 {
+		return "", "", false
+	}
+	return string(decoded[:separator]), string(decoded[separator+1:]), true
+}
+
+// Challenge returns the value of the Proxy-Authenticate header sent with 407 responses
+func Challenge(realm string) string {
+	return fmt.Sprintf("Basic realm=%q", realm)
+}
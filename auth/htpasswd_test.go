@@ -0,0 +1,65 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+	"testing"
+)
+
+func TestHtpasswd(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Cannot hash password: %s", err)
+	}
+	shaSum := sha1.Sum([]byte("password"))
+	file := "# users\nalice:" + string(bcryptHash) + "\nbob:{SHA}" + base64.StdEncoding.EncodeToString(shaSum[:]) + "\n"
+	users, err := ParseHtpasswd(strings.NewReader(file))
+	if err != nil {
+		t.Fatalf("Cannot parse htpasswd: %s", err)
+	}
+	htpasswd := &Htpasswd{users: users}
+	if htpasswd.Len() != 2 {
+		t.Fatalf("Expected 2 users, got %d", htpasswd.Len())
+	}
+	check := func(user string, password string) bool {
+		valid, err := htpasswd.Authenticate(context.Background(), user, password)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		return valid
+	}
+	if !check("alice", "secret") {
+		t.Fatalf("Valid bcrypt password refused")
+	}
+	if check("alice", "wrong") {
+		t.Fatalf("Invalid bcrypt password accepted")
+	}
+	if !check("bob", "password") || check("bob", "secret") {
+		t.Fatalf("Wrong SHA password check")
+	}
+	if check("carol", "secret") {
+		t.Fatalf("Unknown user accepted")
+	}
+	if _, err := ParseHtpasswd(strings.NewReader("dave:$apr1$salt$hash\n")); err == nil {
+		t.Fatalf("Unsupported hash accepted")
+	}
+}
+
+func TestBasicCredentials(t *testing.T) {
+	header := "Basic " + base64.StdEncoding.EncodeToString([]byte("alice:pass:word"))
+	user, password, ok := BasicCredentials(header)
+	if !ok || user != "alice" || password != "pass:word" {
+		t.Fatalf("Wrong credentials %s %s %v", user, password, ok)
+	}
+	for _, invalid := range []string{"", "Bearer token", "Basic !!!", "Basic " + base64.StdEncoding.EncodeToString([]byte("alice"))} {
+		if _, _, ok := BasicCredentials(invalid); ok {
+			t.Fatalf("Invalid header accepted: %s", invalid)
+		}
+	}
+	if challenge := Challenge("riproxy"); challenge != `Basic realm="riproxy"` {
+		t.Fatalf("Wrong challenge %s", challenge)
+	}
+}
@@ -0,0 +1,286 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+
+	ldapBindRequest   = 0x60 // [APPLICATION 0] constructed
+	ldapBindResponse  = 0x61 // [APPLICATION 1] constructed
+	ldapUnbindRequest = 0x42 // [APPLICATION 2] primitive
+	ldapSimpleAuth    = 0x80 // [0] primitive
+
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+	ldapMaxResponse        = 64 * 1024
+	ldapMaxCredential      = 1024
+
+	// UsernamePlaceholder is replaced by the escaped user name in the bind DN template
+	UsernamePlaceholder = "{username}"
+	DefaultLDAPTimeout  = 5 * time.Second
+)
+
+// LDAP checks the credentials with a simple bind (RFC 4511) on the DN built from BindDN.
+// The servers are ldap:// or ldaps:// URLs tried in order.
+type LDAP struct {
+	Servers   []string
+	BindDN    string
+	Timeout   time.Duration
+	TLSConfig *tls.Config
+}
+
+func (l *LDAP) Authenticate(ctx context.Context, username string, password string) (bool, error) {
+	// A bind without password is an anonymous bind, it always succeeds.
+	// Longer credentials are not sent, they are invalid credentials.
+	if len(password) == 0 || len(password) > ldapMaxCredential || len(username) > ldapMaxCredential {
+		return false, nil
+	}
+	dn := strings.Replace(l.BindDN, UsernamePlaceholder, EscapeDN(username), -1)
+	var err error
+	for _, server := range l.Servers {
+		var valid bool
+		valid, err = l.bind(ctx, server, dn, password)
+		if err == nil {
+			return valid, nil
+		}
+		if ctx.Err() != nil {
+			return false, ctx.Err()
+		}
+	}
+	if err == nil {
+		err = errors.New("no LDAP server configured")
+	}
+	return false, err
+}
+
+// EscapeDN escapes value to be used in a distinguished name attribute value (RFC 4514)
+func EscapeDN(value string) string {
+	var builder strings.Builder
+	for i := 0; i < len(value); i++ {
+		char := value[i]
+		switch {
+		case char == 0:
+			builder.WriteString(`\00`)
+			continue
+		case strings.IndexByte(`,+"\<>;=`, char) >= 0,
+			i == 0 && (char == ' ' || char == '#'),
+			i == len(value)-1 && char == ' ':
+			builder.WriteByte('\\')
+		}
+		builder.WriteByte(char)
+	}
+	return builder.String()
+}
+
+// ParseLDAPURL returns the address and the TLS usage of an ldap:// or ldaps:// URL
+func ParseLDAPURL(server string) (string, bool, error) {
+	parsed, err := url.Parse(server)
+	if err != nil {
+		return "", false, err
+	}
+	port := parsed.Port()
+	useTLS := false
+	switch parsed.Scheme {
+	case "ldap":
+		if len(port) == 0 {
+			port = "389"
+		}
+	case "ldaps":
+		useTLS = true
+		if len(port) == 0 {
+			port = "636"
+		}
+	default:
+		return "", false, fmt.Errorf("unsupported LDAP URL scheme: %s", server)
+	}
+	if len(parsed.Hostname()) == 0 {
+		return "", false, fmt.Errorf("missing LDAP server host: %s", server)
+	}
+	return net.JoinHostPort(parsed.Hostname(), port), useTLS, nil
+}
+
+// berLength encodes length in the short form, or in the long form with as many bytes as needed
+func berLength(length int) []byte {
+	if length < 0x80 {
+		return []byte{byte(length)}
+	}
+	var encoded []byte
+	for ; length > 0; length >>= 8 {
+		encoded = append([]byte{byte(length)}, encoded...)
+	}
+	return append([]byte{0x80 | byte(len(encoded))}, encoded...)
+}
+
+func berElement(tag byte, content ...[]byte) []byte {
+	var value []byte
+	for _, part := range content {
+		value = append(value, part...)
+	}
+	element := append([]byte{tag}, berLength(len(value))...)
+	return append(element, value...)
+}
+
+func bindRequest(id byte, dn string, password string) []byte {
+	return berElement(berSequence,
+		berElement(berInteger, []byte{id}),
+		berElement(ldapBindRequest,
+			berElement(berInteger, []byte{3}),
+			berElement(berOctetString, []byte(dn)),
+			berElement(ldapSimpleAuth, []byte(password)),
+		),
+	)
+}
+
+type elementReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// readElement reads a BER element and returns its tag and content
+func readElement(reader elementReader) (byte, []byte, error) {
+	tag, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	first, err := reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		count := int(first & 0x7f)
+		if count == 0 || count > 3 {
+			return 0, nil, errors.New("unsupported BER length")
+		}
+		length = 0
+		for i := 0; i < count; i++ {
+			next, err := reader.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			length = length<<8 | int(next)
+		}
+	}
+	if length > ldapMaxResponse {
+		return 0, nil, errors.New("LDAP response too large")
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(reader, content); err != nil {
+		return 0, nil, err
+	}
+	return tag, content, nil
+}
+
+// splitElement returns the tag and content of the first BER element of data, and the rest of data
+func splitElement(data []byte) (byte, []byte, []byte, error) {
+	reader := bytes.NewReader(data)
+	tag, content, err := readElement(reader)
+	if err != nil {
+		return 0, nil, nil, errors.New("malformed LDAP response")
+	}
+	return tag, content, data[len(data)-reader.Len():], nil
+}
+
+// bindResult parses a BindResponse message and returns its result code and diagnostic message
+func bindResult(message []byte, id byte) (int, string, error) {
+	tag, messageID, rest, err := splitElement(message)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != berInteger || len(messageID) != 1 || messageID[0] != id {
+		return 0, "", errors.New("unexpected LDAP message ID")
+	}
+	tag, response, _, err := splitElement(rest)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != ldapBindResponse {
+		return 0, "", fmt.Errorf("unexpected LDAP response 0x%x", tag)
+	}
+	tag, code, rest, err := splitElement(response)
+	if err != nil {
+		return 0, "", err
+	}
+	if tag != berEnumerated || len(code) != 1 {
+		return 0, "", errors.New("malformed LDAP result code")
+	}
+	diagnostic := ""
+	if _, _, rest, err = splitElement(rest); err == nil { // matched DN
+		if _, value, _, err := splitElement(rest); err == nil {
+			diagnostic = string(value)
+		}
+	}
+	return int(code[0]), diagnostic, nil
+}
+
+func (l *LDAP) bind(ctx context.Context, server string, dn string, password string) (bool, error) {
+	address, useTLS, err := ParseLDAPURL(server)
+	if err != nil {
+		return false, err
+	}
+	timeout := l.Timeout
+	if timeout <= 0 {
+		timeout = DefaultLDAPTimeout
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return false, err
+	}
+	if useTLS {
+		config := &tls.Config{}
+		if l.TLSConfig != nil {
+			config = l.TLSConfig.Clone()
+		}
+		if len(config.ServerName) == 0 {
+			config.ServerName, _, _ = net.SplitHostPort(address)
+		}
+		conn = tls.Client(conn, config)
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	deadline := time.Now().Add(timeout)
+	if contextDeadline, ok := ctx.Deadline(); ok && contextDeadline.Before(deadline) {
+		deadline = contextDeadline
+	}
+	_ = conn.SetDeadline(deadline)
+	const id = 1
+	if _, err := conn.Write(bindRequest(id, dn, password)); err != nil {
+		return false, fmt.Errorf("LDAP server %s: %s", server, err)
+	}
+	tag, message, err := readElement(bufio.NewReader(conn))
+	if err != nil {
+		return false, fmt.Errorf("LDAP server %s: %s", server, err)
+	}
+	if tag != berSequence {
+		return false, fmt.Errorf("LDAP server %s: malformed response", server)
+	}
+	code, diagnostic, err := bindResult(message, id)
+	if err != nil {
+		return false, fmt.Errorf("LDAP server %s: %s", server, err)
+	}
+	_, _ = conn.Write(berElement(berSequence, berElement(berInteger, []byte{id + 1}), []byte{ldapUnbindRequest, 0}))
+	switch code {
+	case ldapSuccess:
+		return true, nil
+	case ldapInvalidCredentials:
+		return false, nil
+	}
+	return false, fmt.Errorf("LDAP server %s: bind error %d %s", server, code, diagnostic)
+}
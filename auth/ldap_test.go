@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ldapServer answers the bind requests, busy returns an error result to every bind
+type ldapServer struct {
+	listener net.Listener
+	dn       string
+	password string
+	busy     bool
+	binds    int32
+}
+
+func newLDAPServer(t *testing.T, dn string, password string, busy bool) *ldapServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	s := &ldapServer{listener: listener, dn: dn, password: password, busy: busy}
+	go s.serve()
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	return s
+}
+
+func (s *ldapServer) url() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *ldapServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.binds, 1)
+		go s.handle(conn)
+	}
+}
+
+func (s *ldapServer) handle(conn net.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+	_, message, err := readElement(bufio.NewReader(conn))
+	if err != nil {
+		return
+	}
+	_, id, rest, err := splitElement(message)
+	if err != nil {
+		return
+	}
+	_, request, _, err := splitElement(rest)
+	if err != nil {
+		return
+	}
+	_, _, request, _ = splitElement(request) // version
+	_, dn, request, _ := splitElement(request)
+	_, password, _, _ := splitElement(request)
+	code := byte(ldapInvalidCredentials)
+	switch {
+	case s.busy:
+		code = 51
+	case string(dn) == s.dn && string(password) == s.password:
+		code = ldapSuccess
+	}
+	_, _ = conn.Write(berElement(berSequence,
+		berElement(berInteger, id),
+		berElement(ldapBindResponse,
+			berElement(berEnumerated, []byte{code}),
+			berElement(berOctetString),
+			berElement(berOctetString, []byte("stand-in")),
+		),
+	))
+}
+
+func TestLDAP(t *testing.T) {
+	server := newLDAPServer(t, `uid=bob\, jr,ou=people,dc=example,dc=org`, "secret", false)
+	client := &LDAP{Servers: []string{server.url()}, BindDN: "uid={username},ou=people,dc=example,dc=org", Timeout: time.Second}
+	ctx := context.Background()
+	if valid, err := client.Authenticate(ctx, "bob, jr", "secret"); err != nil || !valid {
+		t.Fatalf("Valid password refused: %v %v", valid, err)
+	}
+	if valid, err := client.Authenticate(ctx, "bob, jr", "wrong"); err != nil || valid {
+		t.Fatalf("Invalid password accepted: %v %v", valid, err)
+	}
+	if valid, err := client.Authenticate(ctx, "bob, jr", ""); err != nil || valid {
+		t.Fatalf("Anonymous bind accepted: %v %v", valid, err)
+	}
+	busy := newLDAPServer(t, "", "", true)
+	client.Servers = []string{busy.url()}
+	if valid, err := client.Authenticate(ctx, "bob, jr", "secret"); err == nil || valid {
+		t.Fatalf("Bind error not reported: %v %v", valid, err)
+	}
+	client.Servers = []string{busy.url(), server.url()}
+	if valid, err := client.Authenticate(ctx, "bob, jr", "secret"); err != nil || !valid {
+		t.Fatalf("Second server not used: %v %v", valid, err)
+	}
+}
+
+func TestLDAPCredentialLength(t *testing.T) {
+	server := newLDAPServer(t, "uid=bob,ou=people,dc=example,dc=org", "", false)
+	client := &LDAP{Servers: []string{server.url()}, BindDN: "uid={username},ou=people,dc=example,dc=org", Timeout: time.Second}
+	ctx := context.Background()
+	// A truncated length would send an empty password, an anonymous bind
+	if valid, err := client.Authenticate(ctx, "bob", strings.Repeat("p", 65536)); err != nil || valid {
+		t.Fatalf("Long password accepted: %v %v", valid, err)
+	}
+	if valid, err := client.Authenticate(ctx, strings.Repeat("u", 1025), "secret"); err != nil || valid {
+		t.Fatalf("Long user name accepted: %v %v", valid, err)
+	}
+	if binds := atomic.LoadInt32(&server.binds); binds != 0 {
+		t.Fatalf("Long credentials sent to the server")
+	}
+}
+
+func TestBERLength(t *testing.T) {
+	for length, expected := range map[int][]byte{
+		0:        {0},
+		127:      {127},
+		128:      {0x81, 128},
+		255:      {0x81, 255},
+		256:      {0x82, 1, 0},
+		65535:    {0x82, 255, 255},
+		65536:    {0x83, 1, 0, 0},
+		16777216: {0x84, 1, 0, 0, 0},
+	} {
+		if encoded := berLength(length); !bytes.Equal(encoded, expected) {
+			t.Errorf("Wrong encoding of %d: %v, expected %v", length, encoded, expected)
+		}
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	for value, expected := range map[string]string{
+		"alice":       "alice",
+		"a,b+c=d":     `a\,b\+c\=d`,
+		" #lead ":     `\ #lead\ `,
+		"#x":          `\#x`,
+		"nul\x00byte": `nul\00byte`,
+	} {
+		if escaped := EscapeDN(value); escaped != expected {
+			t.Errorf("EscapeDN(%q) = %s, expected %s", value, escaped, expected)
+		}
+	}
+}
+
+func TestParseLDAPURL(t *testing.T) {
+	for server, expected := range map[string]string{
+		"ldap://ldap.example.org":       "ldap.example.org:389",
+		"ldaps://ldap.example.org":      "ldap.example.org:636",
+		"ldap://[2001:db8::1]:1389":     "[2001:db8::1]:1389",
+		"ldaps://ldap.example.org:3269": "ldap.example.org:3269",
+	} {
+		address, _, err := ParseLDAPURL(server)
+		if err != nil || address != expected {
+			t.Errorf("ParseLDAPURL(%s) = %s %v, expected %s", server, address, err, expected)
+		}
+	}
+	for _, server := range []string{"http://ldap.example.org", "ldap://"} {
+		if _, _, err := ParseLDAPURL(server); err == nil {
+			t.Errorf("Invalid URL accepted: %s", server)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	radiusAccessRequest   = 1
+	radiusAccessAccept    = 2
+	radiusAccessReject    = 3
+	radiusAccessChallenge = 11
+
+	radiusUserName             = 1
+	radiusUserPassword         = 2
+	radiusNASIdentifier        = 32
+	radiusMessageAuthenticator = 80
+
+	radiusHeaderLength = 20
+	radiusMaxLength    = 4096
+	radiusMaxPassword  = 128
+
+	// RADIUSMaxAttributeLength is the longest value of an attribute, like the user name
+	RADIUSMaxAttributeLength = 253
+
+	DefaultRADIUSPort    = "1812"
+	DefaultRADIUSTimeout = 3 * time.Second
+)
+
+// RADIUS checks the credentials with Access-Request packets and the PAP method (RFC 2865).
+// The servers are tried in order, each one Retries times.
+type RADIUS struct {
+	Servers       []string
+	Secret        []byte
+	NASIdentifier string
+	Timeout       time.Duration
+	Retries       int
+}
+
+func (r *RADIUS) Authenticate(ctx context.Context, username string, password string) (bool, error) {
+	// Longer values cannot be encoded in an attribute, they are invalid credentials
+	if len(password) > radiusMaxPassword || len(username) > RADIUSMaxAttributeLength {
+		return false, nil
+	}
+	var err error
+	for _, server := range r.Servers {
+		for try := 0; try <= r.Retries; try++ {
+			var valid bool
+			valid, err = r.exchange(ctx, server, username, password)
+			if err == nil {
+				return valid, nil
+			}
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
+		}
+	}
+	if err == nil {
+		err = errors.New("no RADIUS server configured")
+	}
+	return false, err
+}
+
+func appendAttribute(packet []byte, kind byte, value []byte) []byte {
+	packet = append(packet, kind, byte(len(value)+2))
+	return append(packet, value...)
+}
+
+// radiusPassword hides password with the secret and the request authenticator (RFC 2865 section 5.2)
+func radiusPassword(password string, secret []byte, authenticator []byte) []byte {
+	padded := make([]byte, (len(password)+15)/16*16)
+	if len(padded) == 0 {
+		padded = make([]byte, 16)
+	}
+	copy(padded, password)
+	previous := authenticator
+	for block := 0; block < len(padded); block += 16 {
+		hash := md5.New()
+		_, _ = hash.Write(secret)
+		_, _ = hash.Write(previous)
+		sum := hash.Sum(nil)
+		for i := 0; i < 16; i++ {
+			padded[block+i] ^= sum[i]
+		}
+		previous = padded[block : block+16]
+	}
+	return padded
+}
+
+// radiusRequest returns an Access-Request packet and its authenticator
+func (r *RADIUS) radiusRequest(id byte, username string, password string) ([]byte, []byte, error) {
+	authenticator := make([]byte, 16)
+	if _, err := rand.Read(authenticator); err != nil {
+		return nil, nil, err
+	}
+	packet := []byte{radiusAccessRequest, id, 0, 0}
+	packet = append(packet, authenticator...)
+	packet = appendAttribute(packet, radiusUserName, []byte(username))
+	packet = appendAttribute(packet, radiusUserPassword, radiusPassword(password, r.Secret, authenticator))
+	if len(r.NASIdentifier) > 0 {
+		packet = appendAttribute(packet, radiusNASIdentifier, []byte(r.NASIdentifier))
+	}
+	// The Message-Authenticator is signed with its value set to zeros
+	signature := len(packet) + 2
+	packet = appendAttribute(packet, radiusMessageAuthenticator, make([]byte, 16))
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	mac := hmac.New(md5.New, r.Secret)
+	_, _ = mac.Write(packet)
+	copy(packet[signature:], mac.Sum(nil))
+	return packet, authenticator, nil
+}
+
+// checkRADIUSResponse verifies the response authenticator and the Message-Authenticator.
+// Access-Accept and Access-Reject must be signed with a Message-Authenticator: the response authenticator alone
+// can be forged (CVE-2024-3596, BlastRADIUS).
+func checkRADIUSResponse(response []byte, authenticator []byte, secret []byte) error {
+	hash := md5.New()
+	_, _ = hash.Write(response[:4])
+	_, _ = hash.Write(authenticator)
+	_, _ = hash.Write(response[radiusHeaderLength:])
+	_, _ = hash.Write(secret)
+	if !hmac.Equal(hash.Sum(nil), response[4:radiusHeaderLength]) {
+		return errors.New("invalid RADIUS response authenticator, check the shared secret")
+	}
+	hasSignature := false
+	for offset := radiusHeaderLength; offset < len(response); {
+		if offset+2 > len(response) || response[offset+1] < 2 || offset+int(response[offset+1]) > len(response) {
+			return errors.New("malformed RADIUS attributes")
+		}
+		kind, length := response[offset], int(response[offset+1])
+		if kind == radiusMessageAuthenticator {
+			if length != 18 {
+				return errors.New("malformed RADIUS Message-Authenticator")
+			}
+			signed := make([]byte, len(response))
+			copy(signed, response)
+			copy(signed[4:radiusHeaderLength], authenticator)
+			copy(signed[offset+2:offset+18], make([]byte, 16))
+			mac := hmac.New(md5.New, secret)
+			_, _ = mac.Write(signed)
+			if !hmac.Equal(mac.Sum(nil), response[offset+2:offset+18]) {
+				return errors.New("invalid RADIUS Message-Authenticator")
+			}
+			hasSignature = true
+		}
+		offset += length
+	}
+	if !hasSignature && (response[0] == radiusAccessAccept || response[0] == radiusAccessReject) {
+		return errors.New("RADIUS response without Message-Authenticator")
+	}
+	return nil
+}
+
+func (r *RADIUS) exchange(ctx context.Context, server string, username string, password string) (bool, error) {
+	id := make([]byte, 1)
+	if _, err := rand.Read(id); err != nil {
+		return false, err
+	}
+	request, authenticator, err := r.radiusRequest(id[0], username, password)
+	if err != nil {
+		return false, err
+	}
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = DefaultRADIUSTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if contextDeadline, ok := ctx.Deadline(); ok && contextDeadline.Before(deadline) {
+		deadline = contextDeadline
+	}
+	_ = conn.SetDeadline(deadline)
+	if _, err := conn.Write(request); err != nil {
+		return false, err
+	}
+	buffer := make([]byte, radiusMaxLength)
+	var dropped error
+	for {
+		length, err := conn.Read(buffer)
+		if err != nil {
+			// Report why the answers were dropped, a wrong secret or a server without Message-Authenticator
+			if dropped != nil {
+				err = dropped
+			}
+			return false, fmt.Errorf("RADIUS server %s: %s", server, err)
+		}
+		// Responses to another request are ignored
+		if length < radiusHeaderLength || buffer[1] != id[0] {
+			continue
+		}
+		declared := int(binary.BigEndian.Uint16(buffer[2:4]))
+		if declared < radiusHeaderLength || declared > length {
+			continue
+		}
+		response := buffer[:declared]
+		// A spoofed packet is dropped, it cannot cut off the answer of the server
+		if err := checkRADIUSResponse(response, authenticator, r.Secret); err != nil {
+			dropped = err
+			continue
+		}
+		switch response[0] {
+		case radiusAccessAccept:
+			return true, nil
+		case radiusAccessReject, radiusAccessChallenge: // challenges need another exchange with the user
+			return false, nil
+		}
+		return false, fmt.Errorf("RADIUS server %s: unexpected packet code %d", server, response[0])
+	}
+}
@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// radiusServer accepts the Access-Request of a single user with PAP.
+// An unsigned server sends no Message-Authenticator, a spoofed server sends a forged Access-Accept before each answer.
+type radiusServer struct {
+	t        *testing.T
+	conn     net.PacketConn
+	secret   []byte
+	user     string
+	password string
+	unsigned bool
+	spoofed  bool
+	requests int32
+}
+
+func newRADIUSServer(t *testing.T, secret string, user string, password string) *radiusServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	s := &radiusServer{t: t, conn: conn, secret: []byte(secret), user: user, password: password}
+	go s.serve()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return s
+}
+
+func (s *radiusServer) address() string {
+	return s.conn.LocalAddr().String()
+}
+
+func radiusAttributes(packet []byte) map[byte][]byte {
+	attributes := map[byte][]byte{}
+	for offset := radiusHeaderLength; offset+2 <= len(packet); {
+		length := int(packet[offset+1])
+		if length < 2 || offset+length > len(packet) {
+			break
+		}
+		attributes[packet[offset]] = packet[offset+2 : offset+length]
+		offset += length
+	}
+	return attributes
+}
+
+func (s *radiusServer) serve() {
+	buffer := make([]byte, radiusMaxLength)
+	for {
+		length, client, err := s.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.requests, 1)
+		request := buffer[:length]
+		attributes := radiusAttributes(request)
+		authenticator := request[4:radiusHeaderLength]
+		// Decrypting the password is the same operation as encrypting it with the chained hashes of the cipher text
+		encrypted := attributes[radiusUserPassword]
+		password := make([]byte, len(encrypted))
+		previous := authenticator
+		for block := 0; block < len(encrypted); block += 16 {
+			sum := md5.Sum(append(append([]byte{}, s.secret...), previous...))
+			for i := 0; i < 16; i++ {
+				password[block+i] = encrypted[block+i] ^ sum[i]
+			}
+			previous = encrypted[block : block+16]
+		}
+		signed := append([]byte{}, request...)
+		signature := attributes[radiusMessageAuthenticator]
+		copy(signed[len(signed)-16:], make([]byte, 16))
+		mac := hmac.New(md5.New, s.secret)
+		_, _ = mac.Write(signed)
+		code := byte(radiusAccessReject)
+		if hmac.Equal(mac.Sum(nil), signature) && string(attributes[radiusUserName]) == s.user &&
+			strings.TrimRight(string(password), "\x00") == s.password {
+			code = radiusAccessAccept
+		}
+		if s.spoofed {
+			forged := []byte{radiusAccessAccept, request[1], 0, radiusHeaderLength}
+			forged = append(forged, make([]byte, 16)...)
+			_, _ = s.conn.WriteTo(forged, client)
+		}
+		response := []byte{code, request[1], 0, 0}
+		response = append(response, authenticator...)
+		if !s.unsigned {
+			response = appendAttribute(response, radiusMessageAuthenticator, make([]byte, 16))
+			binary.BigEndian.PutUint16(response[2:], uint16(len(response)))
+			mac := hmac.New(md5.New, s.secret)
+			_, _ = mac.Write(response)
+			copy(response[len(response)-16:], mac.Sum(nil))
+		}
+		binary.BigEndian.PutUint16(response[2:], uint16(len(response)))
+		hash := md5.New()
+		_, _ = hash.Write(response)
+		_, _ = hash.Write(s.secret)
+		copy(response[4:radiusHeaderLength], hash.Sum(nil))
+		_, _ = s.conn.WriteTo(response, client)
+	}
+}
+
+func TestRADIUS(t *testing.T) {
+	server := newRADIUSServer(t, "shared", "alice", "a long password of more than 16 bytes")
+	client := &RADIUS{Servers: []string{server.address()}, Secret: []byte("shared"), NASIdentifier: "riproxy", Timeout: time.Second}
+	ctx := context.Background()
+	if valid, err := client.Authenticate(ctx, "alice", "a long password of more than 16 bytes"); err != nil || !valid {
+		t.Fatalf("Valid password refused: %v %v", valid, err)
+	}
+	if valid, err := client.Authenticate(ctx, "alice", "wrong"); err != nil || valid {
+		t.Fatalf("Invalid password accepted: %v %v", valid, err)
+	}
+	wrongSecret := &RADIUS{Servers: []string{server.address()}, Secret: []byte("other"), Timeout: time.Second}
+	if valid, err := wrongSecret.Authenticate(ctx, "alice", "a long password of more than 16 bytes"); err == nil || valid {
+		t.Fatalf("Response with another secret accepted: %v %v", valid, err)
+	}
+}
+
+func TestRADIUSFailover(t *testing.T) {
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	defer func() {
+		_ = silent.Close()
+	}()
+	server := newRADIUSServer(t, "shared", "alice", "secret")
+	client := &RADIUS{
+		Servers: []string{silent.LocalAddr().String(), server.address()},
+		Secret:  []byte("shared"),
+		Timeout: 100 * time.Millisecond,
+		Retries: 1,
+	}
+	if valid, err := client.Authenticate(context.Background(), "alice", "secret"); err != nil || !valid {
+		t.Fatalf("Second server not used: %v %v", valid, err)
+	}
+	if requests := atomic.LoadInt32(&server.requests); requests != 1 {
+		t.Fatalf("Expected 1 request to the second server, got %d", requests)
+	}
+}
+
+func TestRADIUSMessageAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	// The answers without Message-Authenticator are dropped, even with a valid response authenticator
+	server := newRADIUSServer(t, "shared", "alice", "secret")
+	server.unsigned = true
+	client := &RADIUS{Servers: []string{server.address()}, Secret: []byte("shared"), Timeout: 200 * time.Millisecond}
+	if valid, err := client.Authenticate(ctx, "alice", "secret"); err == nil || valid || !strings.Contains(err.Error(), "Message-Authenticator") {
+		t.Fatalf("Unsigned answer accepted: %v %v", valid, err)
+	}
+	// A forged packet does not cut off the answer of the server
+	server = newRADIUSServer(t, "shared", "alice", "secret")
+	server.spoofed = true
+	client.Servers = []string{server.address()}
+	if valid, err := client.Authenticate(ctx, "alice", "secret"); err != nil || !valid {
+		t.Fatalf("Answer after a forged packet not used: %v %v", valid, err)
+	}
+	if valid, err := client.Authenticate(ctx, "alice", "wrong"); err != nil || valid {
+		t.Fatalf("Forged Access-Accept used: %v %v", valid, err)
+	}
+}
+
+func TestRADIUSAttributeLength(t *testing.T) {
+	long := strings.Repeat("a", 254)
+	server := newRADIUSServer(t, "shared", long, "secret")
+	service := &Service{
+		Authenticator: &RADIUS{Servers: []string{server.address()}, Secret: []byte("shared"), Timeout: time.Second},
+		Limiter:       NewLimiter(1, time.Minute),
+	}
+	ctx := context.Background()
+	if result, err := service.Check(ctx, "192.0.2.1", long, "secret"); err != nil || result != Rejected {
+		t.Fatalf("Long user name not rejected: %v %v", result, err)
+	}
+	if result, err := service.Check(ctx, "192.0.2.2", "alice", strings.Repeat("p", 129)); err != nil || result != Rejected {
+		t.Fatalf("Long password not rejected: %v %v", result, err)
+	}
+	if requests := atomic.LoadInt32(&server.requests); requests != 0 {
+		t.Fatalf("Malformed request sent to the server")
+	}
+	// The rejected credentials are counted as failures
+	if result, _ := service.Check(ctx, "192.0.2.1", "alice", "secret"); result != Limited {
+		t.Fatalf("Failure not counted: %v", result)
+	}
+}
@@ -0,0 +1,280 @@
+package configuration
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/COSAE-FR/riproxy/acl"
+	"github.com/COSAE-FR/riproxy/auth"
+	"github.com/COSAE-FR/riproxy/domains"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultAuthRealm         = "riproxy"
+	defaultAuthCacheTTL      = 5 * time.Minute
+	defaultAuthMaxFailures   = 10
+	defaultAuthFailureWindow = 5 * time.Minute
+)
+
+type RADIUSConfig struct {
+	Servers       []string `yaml:"servers"`
+	Secret        string   `yaml:"secret"`
+	NASIdentifier string   `yaml:"nas_identifier"`
+	TimeoutString string   `yaml:"timeout"`
+	Retries       int      `yaml:"retries"`
+}
+
+func (c *RADIUSConfig) authenticator() (auth.Authenticator, error) {
+	if len(c.Servers) == 0 {
+		return nil, fmt.Errorf("missing RADIUS servers")
+	}
+	if len(c.Secret) == 0 {
+		return nil, fmt.Errorf("missing RADIUS secret")
+	}
+	if c.Retries < 0 {
+		return nil, fmt.Errorf("invalid RADIUS retries: %d", c.Retries)
+	}
+	radius := &auth.RADIUS{Secret: []byte(c.Secret), NASIdentifier: c.NASIdentifier, Retries: c.Retries}
+	for _, server := range c.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), auth.DefaultRADIUSPort)
+		}
+		radius.Servers = append(radius.Servers, server)
+	}
+	if len(radius.NASIdentifier) == 0 {
+		radius.NASIdentifier = defaultAuthRealm
+	}
+	if len(radius.NASIdentifier) > auth.RADIUSMaxAttributeLength {
+		return nil, fmt.Errorf("RADIUS nas_identifier longer than %d bytes", auth.RADIUSMaxAttributeLength)
+	}
+	var err error
+	radius.Timeout, err = parseDuration(c.TimeoutString, auth.DefaultRADIUSTimeout, "RADIUS timeout")
+	return radius, err
+}
+
+type LDAPConfig struct {
+	Servers       []string `yaml:"servers"`
+	BindDN        string   `yaml:"bind_dn"`
+	TimeoutString string   `yaml:"timeout"`
+	CAFile        string   `yaml:"ca_file"`
+}
+
+func (c *LDAPConfig) authenticator() (auth.Authenticator, error) {
+	if len(c.Servers) == 0 {
+		return nil, fmt.Errorf("missing LDAP servers")
+	}
+	for _, server := range c.Servers {
+		if _, _, err := auth.ParseLDAPURL(server); err != nil {
+			return nil, err
+		}
+	}
+	if !strings.Contains(c.BindDN, auth.UsernamePlaceholder) {
+		return nil, fmt.Errorf("LDAP bind_dn must contain %s", auth.UsernamePlaceholder)
+	}
+	ldap := &auth.LDAP{Servers: c.Servers, BindDN: c.BindDN}
+	if len(c.CAFile) > 0 {
+		content, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in LDAP CA file %s", c.CAFile)
+		}
+		ldap.TLSConfig = &tls.Config{RootCAs: pool}
+	}
+	var err error
+	ldap.Timeout, err = parseDuration(c.TimeoutString, auth.DefaultLDAPTimeout, "LDAP timeout")
+	return ldap, err
+}
+
+type AuthGroupConfig struct {
+	Users              []string             `yaml:"users"`
+	BlockListString    []string             `yaml:"block"`
+	BlockFiles         []BlockFileConfig    `yaml:"block_files"`
+	BlockSubscriptions []string             `yaml:"block_subscriptions"`
+	AllowedMethods     []string             `yaml:"allowed_methods"`
+	BlockLists         []domains.DomainTree `yaml:"-"`
+}
+
+type AuthConfig struct {
+	Htpasswd            string                     `yaml:"htpasswd"`
+	RADIUS              *RADIUSConfig              `yaml:"radius"`
+	LDAP                *LDAPConfig                `yaml:"ldap"`
+	Realm               string                     `yaml:"realm"`
+	CacheTTLString      string                     `yaml:"cache_ttl"`
+	MaxFailures         int                        `yaml:"max_failures"`
+	FailureWindowString string                     `yaml:"failure_window"`
+	Groups              map[string]AuthGroupConfig `yaml:"groups"`
+	Service             *auth.Service              `yaml:"-"`
+	userGroups          map[string]map[string]bool
+}
+
+// authenticator returns the configured backend, only one can be used
+func (c *AuthConfig) authenticator(logger *log.Entry) (auth.Authenticator, error) {
+	var backends []string
+	var authenticator auth.Authenticator
+	var err error
+	if len(c.Htpasswd) > 0 {
+		backends = append(backends, "htpasswd")
+		var users *auth.Htpasswd
+		if users, err = auth.LoadHtpasswd(c.Htpasswd); err == nil {
+			logger.WithField("htpasswd", c.Htpasswd).Infof("loaded %d proxy users", users.Len())
+			authenticator = users
+		}
+	}
+	if c.RADIUS != nil {
+		backends = append(backends, "radius")
+		authenticator, err = c.RADIUS.authenticator()
+	}
+	if c.LDAP != nil {
+		backends = append(backends, "ldap")
+		authenticator, err = c.LDAP.authenticator()
+	}
+	switch {
+	case len(backends) == 0:
+		return nil, fmt.Errorf("missing authentication backend: htpasswd, radius or ldap")
+	case len(backends) > 1:
+		return nil, fmt.Errorf("only one authentication backend can be used, found %s", strings.Join(backends, ", "))
+	}
+	return authenticator, err
+}
+
+func (c *AuthConfig) check(defaults *DefaultConfig, blockByIDN bool, logger *log.Entry) error {
+	authenticator, err := c.authenticator(logger)
+	if err != nil {
+		return err
+	}
+	cacheTTL, err := parseDuration(c.CacheTTLString, defaultAuthCacheTTL, "auth cache_ttl")
+	if err != nil {
+		return err
+	}
+	if cacheTTL > 0 {
+		authenticator = auth.NewCache(authenticator, cacheTTL)
+	}
+	c.Service = &auth.Service{Authenticator: authenticator}
+	window, err := parseDuration(c.FailureWindowString, defaultAuthFailureWindow, "auth failure_window")
+	if err != nil {
+		return err
+	}
+	if c.MaxFailures == 0 {
+		c.MaxFailures = defaultAuthMaxFailures
+	}
+	if c.MaxFailures > 0 && window > 0 {
+		c.Service.Limiter = auth.NewLimiter(c.MaxFailures, window)
+	}
+	if len(c.Realm) == 0 {
+		c.Realm = defaultAuthRealm
+	}
+	c.userGroups = map[string]map[string]bool{}
+	for name, group := range c.Groups {
+		for _, user := range group.Users {
+			if c.userGroups[user] == nil {
+				c.userGroups[user] = map[string]bool{}
+			}
+			c.userGroups[user][name] = true
+		}
+		if len(group.BlockListString) > 0 || len(group.BlockFiles) > 0 {
+			tree := newEmptyDomainTree(blockByIDN)
+			for _, domain := range group.BlockListString {
+				tree.Put(domain)
+			}
+			loadBlockFiles(tree, group.BlockFiles, logger)
+			group.BlockLists = []domains.DomainTree{tree}
+		}
+		if defaults != nil {
+			group.BlockLists = append(group.BlockLists, defaults.subscriptionTrees(group.BlockSubscriptions, logger)...)
+		}
+		var methods []string
+		for _, method := range group.AllowedMethods {
+			method = strings.ToUpper(method)
+			if _, ok := httpMethods[method]; ok {
+				methods = append(methods, method)
+			} else {
+				logger.Warnf("Unknown HTTP method %s in group %s, skipping", method, name)
+			}
+		}
+		group.AllowedMethods = methods
+		group.BlockListString = nil
+		c.Groups[name] = group
+	}
+	return nil
+}
+
+// checkOrLock prepares the configuration, if it is invalid no user can authenticate
+func (c *AuthConfig) checkOrLock(defaults *DefaultConfig, blockByIDN bool, logger *log.Entry) {
+	if err := c.check(defaults, blockByIDN, logger); err != nil {
+		logger.Errorf("cannot prepare proxy authentication, every request will be refused: %s", err)
+		c.Service = nil
+	}
+}
+
+// Authenticate checks the credentials sent from source, they are rejected if the configuration is invalid
+func (c *AuthConfig) Authenticate(ctx context.Context, source string, username string, password string) (auth.Result, error) {
+	if c.Service == nil {
+		return auth.Rejected, nil
+	}
+	return c.Service.Check(ctx, source, username, password)
+}
+
+// UserGroups returns the groups of username
+func (c *AuthConfig) UserGroups(username string) map[string]bool {
+	return c.userGroups[username]
+}
+
+// groupNames returns the names of the groups in a stable order
+func (c *AuthConfig) groupNames() []string {
+	names := make([]string, 0, len(c.Groups))
+	for name := range c.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// methodRules returns the allowed methods rules of the groups, and the groups having their own allowed methods
+func (c *AuthConfig) methodRules() (acl.List, map[string]bool) {
+	var rules acl.List
+	groups := map[string]bool{}
+	for _, name := range c.groupNames() {
+		group := c.Groups[name]
+		if len(group.AllowedMethods) == 0 {
+			continue
+		}
+		groups[name] = true
+		rules = append(rules, &acl.Rule{
+			Name:       "group:" + name + ":allowed_methods",
+			Action:     acl.Deny,
+			Message:    "Blocked: method not allowed",
+			Groups:     map[string]bool{name: true},
+			NotMethods: methodSet(group.AllowedMethods),
+		})
+	}
+	return rules, groups
+}
+
+// blockRules returns the block list rules of the groups
+func (c *AuthConfig) blockRules() acl.List {
+	var rules acl.List
+	for _, name := range c.groupNames() {
+		group := c.Groups[name]
+		if len(group.BlockLists) == 0 {
+			continue
+		}
+		rules = append(rules, &acl.Rule{
+			Name:    "group:" + name + ":block",
+			Action:  acl.Deny,
+			Message: "Blocked by group policy",
+			Groups:  map[string]bool{name: true},
+			Domains: group.BlockLists,
+		})
+	}
+	return rules
+}
@@ -0,0 +1,69 @@
+package configuration
+
+import (
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"path/filepath"
+)
+
+// Reasons of the block pages, the reasons without template use the default one
+const (
+	BlockReasonDefault  = "default"
+	BlockReasonPolicy   = "policy"   // denied by a rule or a proxy setting
+	BlockReasonCategory = "category" // denied by a category policy
+	BlockReasonAuth     = "auth"     // missing or invalid credentials, too many failures
+	BlockReasonError    = "error"    // the destination cannot be reached
+	BlockReasonLimit    = "limit"    // too many requests from the client
+)
+
+var blockReasons = map[string]bool{
+	BlockReasonDefault:  true,
+	BlockReasonPolicy:   true,
+	BlockReasonCategory: true,
+	BlockReasonAuth:     true,
+	BlockReasonError:    true,
+	BlockReasonLimit:    true,
+}
+
+type BlockPageConfig struct {
+	Contact   string                        `yaml:"contact"`
+	Files     map[string]string             `yaml:"templates"`
+	Templates map[string]*template.Template `yaml:"-"`
+}
+
+// check parses the templates, the reasons with an invalid template use the default or the built-in one
+func (c *BlockPageConfig) check(logger *log.Entry) {
+	c.Templates = make(map[string]*template.Template, len(c.Files))
+	for reason, path := range c.Files {
+		if !blockReasons[reason] {
+			logger.Errorf("unknown block page reason %s, skipping", reason)
+			continue
+		}
+		page, err := template.New(filepath.Base(path)).ParseFiles(path)
+		if err != nil {
+			logger.Errorf("cannot parse block page template for %s: %s", reason, err)
+			continue
+		}
+		c.Templates[reason] = page
+	}
+	c.Files = nil
+}
+
+// Template returns the template of reason, nil to use the built-in page
+func (c *BlockPageConfig) Template(reason string) *template.Template {
+	if c == nil {
+		return nil
+	}
+	if page, ok := c.Templates[reason]; ok {
+		return page
+	}
+	return c.Templates[BlockReasonDefault]
+}
+
+// SupportContact returns the contact displayed on the block pages
+func (c *BlockPageConfig) SupportContact() string {
+	if c == nil {
+		return ""
+	}
+	return c.Contact
+}
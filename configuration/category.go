@@ -0,0 +1,96 @@
+package configuration
+
+import (
+	"fmt"
+	"github.com/COSAE-FR/riproxy/acl"
+	"github.com/COSAE-FR/riproxy/domains"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sort"
+)
+
+type CategoryConfig struct {
+	Domains       []string             `yaml:"domains"`
+	Files         []BlockFileConfig    `yaml:"files"`
+	Subscriptions []string             `yaml:"subscriptions"`
+	Lists         []domains.DomainTree `yaml:"-"`
+}
+
+func (c *CategoryConfig) check(name string, defaults *DefaultConfig, blockByIDN bool, logger *log.Entry) {
+	tree := newEmptyDomainTree(blockByIDN)
+	for _, domain := range c.Domains {
+		tree.PutEntry(domains.Entry{Pattern: domain, Source: domains.SourceInline, Category: name})
+	}
+	for index := range c.Files {
+		c.Files[index].Category = name
+	}
+	loadBlockFiles(tree, c.Files, logger)
+	c.Lists = append([]domains.DomainTree{tree}, defaults.subscriptionTrees(c.Subscriptions, logger)...)
+	c.Domains = nil
+}
+
+type CategoryPolicyConfig struct {
+	Action  string `yaml:"action"`
+	Message string `yaml:"message"`
+	Status  int    `yaml:"status"`
+}
+
+// Category rules are evaluated by action, then by name
+var categoryActionOrder = map[acl.Action]int{
+	acl.Log:   0,
+	acl.Allow: 1,
+	acl.Deny:  2,
+}
+
+// categoryRules builds the rules of the category policies, the interface policies override the default ones
+func (c *ProxyConfig) categoryRules(defaults *DefaultConfig, logger *log.Entry) acl.List {
+	if defaults == nil {
+		return nil
+	}
+	policies := make(map[string]CategoryPolicyConfig, len(defaults.Proxy.CategoryPolicies)+len(c.CategoryPolicies))
+	for name, policy := range defaults.Proxy.CategoryPolicies {
+		policies[name] = policy
+	}
+	for name, policy := range c.CategoryPolicies {
+		policies[name] = policy
+	}
+	var rules acl.List
+	for name, policy := range policies {
+		category, ok := defaults.Categories[name]
+		if !ok {
+			logger.Errorf("unknown category %s in category policies, skipping", name)
+			continue
+		}
+		action, err := acl.ParseAction(policy.Action)
+		if err != nil {
+			logger.Errorf("cannot parse policy of category %s, skipping: %s", name, err)
+			continue
+		}
+		rule := &acl.Rule{
+			Name:     "category:" + name,
+			Action:   action,
+			Message:  policy.Message,
+			Category: name,
+			Domains:  category.Lists,
+		}
+		if action == acl.Deny {
+			if len(rule.Message) == 0 {
+				rule.Message = fmt.Sprintf("Blocked: category %s", name)
+			}
+			rule.Status = http.StatusForbidden
+			if policy.Status >= 400 && policy.Status < 600 {
+				rule.Status = policy.Status
+			} else if policy.Status != 0 {
+				logger.Warnf("invalid HTTP status %d for category %s, using %d", policy.Status, name, rule.Status)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		if rules[i].Action != rules[j].Action {
+			return categoryActionOrder[rules[i].Action] < categoryActionOrder[rules[j].Action]
+		}
+		return rules[i].Name < rules[j].Name
+	})
+	return rules
+}
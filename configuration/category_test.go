@@ -0,0 +1,94 @@
+package configuration
+
+import (
+	"github.com/COSAE-FR/riproxy/acl"
+	"net/http"
+	"testing"
+)
+
+func testCategories() map[string]CategoryConfig {
+	return map[string]CategoryConfig{
+		"ads":    {Domains: []string{"*.ads.example.com"}},
+		"news":   {Domains: []string{"news.example.com"}},
+		"social": {Domains: []string{"*.social.example"}},
+		"video":  {Domains: []string{"video.example.com"}},
+		"broken": {Domains: []string{"broken.example.com"}},
+	}
+}
+
+func TestCategoryRules(t *testing.T) {
+	logger := testLogger()
+	defaults := DefaultConfig{
+		Categories: testCategories(),
+		Proxy: ProxyConfig{SnapshotDirectory: SnapshotDisabled, CategoryPolicies: map[string]CategoryPolicyConfig{
+			"ads":   {Action: "allow"},
+			"video": {Action: "block", Status: http.StatusUnavailableForLegalReasons},
+		}},
+	}
+	if err := defaults.check(logger); err != nil {
+		t.Fatalf("Cannot check defaults: %s", err)
+	}
+	proxy := ProxyConfig{CategoryPolicies: map[string]CategoryPolicyConfig{
+		"ads":     {Action: "block", Message: "No ads", Status: http.StatusOK},
+		"news":    {Action: "log"},
+		"social":  {Action: "allow"},
+		"unknown": {Action: "block"},
+		"broken":  {Action: "sometimes"},
+	}}
+
+	// Log, then allow, then deny policies, by name; unknown categories and actions are skipped
+	rules := proxy.categoryRules(&defaults, logger)
+	expected := []struct {
+		name    string
+		action  acl.Action
+		status  int
+		message string
+	}{
+		{"category:news", acl.Log, 0, ""},
+		{"category:social", acl.Allow, 0, ""},
+		{"category:ads", acl.Deny, http.StatusForbidden, "No ads"},
+		{"category:video", acl.Deny, http.StatusUnavailableForLegalReasons, "Blocked: category video"},
+	}
+	if len(rules) != len(expected) {
+		t.Fatalf("Wrong rule count %d, expected %d", len(rules), len(expected))
+	}
+	for index, rule := range rules {
+		if rule.Name != expected[index].name || rule.Action != expected[index].action || rule.Status != expected[index].status || rule.Message != expected[index].message {
+			t.Errorf("Wrong rule %d: %s %s %d %q", index, rule.Name, rule.Action, rule.Status, rule.Message)
+		}
+	}
+
+	// The interface policy overrides the default one
+	request := &acl.Request{Host: "www.ads.example.com", Port: 80, Method: "GET", Scheme: "http"}
+	if decision := rules.Evaluate(request); decision.Allowed() || decision.Rule.Category != "ads" {
+		t.Errorf("Interface category policy not applied")
+	}
+	if decision := (&ProxyConfig{}).categoryRules(&defaults, logger).Evaluate(request); decision.Rule == nil || decision.Rule.Action != acl.Allow {
+		t.Errorf("Default category policy not applied")
+	}
+	if rules := (&ProxyConfig{}).categoryRules(nil, logger); len(rules) != 0 {
+		t.Errorf("Category rules without defaults")
+	}
+}
+
+func TestAllowedCategory(t *testing.T) {
+	// An allowed category is evaluated before the block lists and the allowlist policy
+	defaults := DefaultConfig{
+		Categories: testCategories(),
+		Proxy:      ProxyConfig{BlockListString: []string{"*.social.example"}},
+	}
+	proxy := ProxyConfig{
+		Policy:           PolicyAllowList,
+		BlockListString:  []string{"www.social.example"},
+		CategoryPolicies: map[string]CategoryPolicyConfig{"social": {Action: "allow"}},
+	}
+	rules := checkedRules(t, defaults, proxy)
+	request := &acl.Request{Host: "www.social.example", Port: 443, Method: "CONNECT", Scheme: "https"}
+	if decision := rules.Evaluate(request); !decision.Allowed() || decision.Rule.Name != "category:social" {
+		t.Errorf("Allowed category blocked")
+	}
+	request.Host = "www.example.com"
+	if rules.Evaluate(request).Allowed() {
+		t.Errorf("Domain outside the allowed category allowed")
+	}
+}
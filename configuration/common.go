@@ -1,6 +1,7 @@
 package configuration
 
 import (
+	"github.com/COSAE-FR/riputils/common"
 	"net"
 	"net/http"
 )
@@ -54,9 +55,63 @@ var httpMethods = map[string]bool{
 type interfaceInfo struct {
 	Name           string
 	Ip             *net.IPNet
+	Networks       []net.IPNet // every network of the interface, Ip first
 	InterfaceProxy string
 }
 
+// interfaceNetworks returns the networks of the addresses of the interface, primary first.
+// IPv6 link-local addresses are skipped, they are not usable without zone.
+func interfaceNetworks(name string, primary *net.IPNet, ipv6 bool) []net.IPNet {
+	var networks []net.IPNet
+	if primary != nil {
+		networks = append(networks, *primary)
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return networks
+	}
+	addresses, err := iface.Addrs()
+	if err != nil {
+		return networks
+	}
+	for _, address := range addresses {
+		network, ok := address.(*net.IPNet)
+		if !ok || network.IP.IsLinkLocalUnicast() || (primary != nil && network.IP.Equal(primary.IP)) {
+			continue
+		}
+		if network.IP.To4() == nil && !ipv6 {
+			continue
+		}
+		networks = append(networks, *network)
+	}
+	return networks
+}
+
+// localAddresses returns the addresses of the host and the unspecified and loopback addresses of both families
+func localAddresses() []net.IP {
+	candidates := common.GetLocalIPs()
+	if addresses, err := net.InterfaceAddrs(); err == nil {
+		for _, address := range addresses {
+			if network, ok := address.(*net.IPNet); ok {
+				candidates = append(candidates, network.IP)
+			}
+		}
+	}
+	candidates = append(candidates, net.IPv4zero, net.IPv4(127, 0, 0, 1), net.IPv6unspecified, net.IPv6loopback)
+	var ips []net.IP
+	known := map[string]bool{}
+	for _, ip := range candidates {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if !known[ip.String()] {
+			known[ip.String()] = true
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
 func appendNetwork(slice []net.IPNet, network net.IPNet) []net.IPNet {
 	// Normalize to network
 	_, candidateNetwork, err := net.ParseCIDR(network.String())
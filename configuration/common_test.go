@@ -0,0 +1,39 @@
+package configuration
+
+import (
+	"net"
+	"testing"
+)
+
+func TestInterfaceNetworks(t *testing.T) {
+	_, primary, _ := net.ParseCIDR("192.0.2.1/24")
+	if networks := interfaceNetworks("missing0", primary, true); len(networks) != 1 || networks[0].String() != primary.String() {
+		t.Fatalf("Wrong networks of a missing interface: %v", networks)
+	}
+	var loopback *net.Interface
+	if interfaces, err := net.Interfaces(); err == nil {
+		for index := range interfaces {
+			if interfaces[index].Flags&net.FlagLoopback != 0 {
+				loopback = &interfaces[index]
+				break
+			}
+		}
+	}
+	if loopback == nil {
+		t.Skip("No loopback interface")
+	}
+	for _, ipv6 := range []bool{false, true} {
+		networks := interfaceNetworks(loopback.Name, primary, ipv6)
+		if len(networks) == 0 || networks[0].String() != primary.String() {
+			t.Fatalf("Primary network not first: %v", networks)
+		}
+		for _, network := range networks[1:] {
+			if network.IP.IsLinkLocalUnicast() {
+				t.Errorf("Link-local network %s returned", network.String())
+			}
+			if !ipv6 && network.IP.To4() == nil {
+				t.Errorf("IPv6 network %s returned without IPv6", network.String())
+			}
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package configuration
 
 import (
-	"fmt"
+	"github.com/COSAE-FR/riproxy/acl"
 	"github.com/COSAE-FR/riproxy/utils"
 	"github.com/COSAE-FR/riputils/common"
 	"github.com/COSAE-FR/riputils/common/logging"
@@ -13,14 +13,59 @@ import (
 )
 
 type DefaultConfig struct {
-	Direct LocalNetworks `yaml:",inline"`
-	Proxy  ProxyConfig   `yaml:",inline"`
+	Direct        LocalNetworks                 `yaml:",inline"`
+	Proxy         ProxyConfig                   `yaml:",inline"`
+	Subscriptions map[string]SubscriptionConfig `yaml:"subscriptions"`
+	Categories    map[string]CategoryConfig     `yaml:"categories"`
+	Resolver      *ResolverConfig               `yaml:"resolver"`
+	Upstream      *UpstreamConfig               `yaml:"upstream"`
+	Mitm          *MitmConfig                   `yaml:"mitm"`
+	BlockPages    *BlockPageConfig              `yaml:"block_pages"`
 }
 
 func (c *DefaultConfig) check(logger *log.Entry) error {
+	if c.Resolver != nil {
+		if err := c.Resolver.check(logger); err != nil {
+			logger.Errorf("cannot prepare resolver, using the system resolver: %s", err)
+			c.Resolver = nil
+		}
+	}
+	if c.Upstream != nil {
+		var resolver acl.Resolver
+		if configured := c.LookupResolver(); configured != nil {
+			resolver = configured
+		}
+		if err := c.Upstream.check(c.Proxy.BlockByIDN, resolver, logger); err != nil {
+			return err
+		}
+	}
+	for name, subscription := range c.Subscriptions {
+		if err := subscription.check(name, c.Proxy.BlockByIDN, logger); err != nil {
+			logger.Errorf("cannot prepare block list subscription %s: %s", name, err)
+			delete(c.Subscriptions, name)
+			continue
+		}
+		c.Subscriptions[name] = subscription
+	}
+	for name, category := range c.Categories {
+		category.check(name, c, c.Proxy.BlockByIDN, logger)
+		c.Categories[name] = category
+	}
+	if c.BlockPages != nil {
+		c.BlockPages.check(logger)
+	}
+	if c.Mitm != nil {
+		if err := c.Mitm.check(c, c.Proxy.BlockByIDN, logger); err != nil {
+			return err
+		}
+	}
 	if err := c.Proxy.check(nil, nil, logger); err != nil {
 		return err
 	}
+	c.Proxy.SubscriptionLists = c.subscriptionTrees(c.Proxy.BlockSubscriptions, logger)
+	if c.Proxy.Auth != nil {
+		c.Proxy.Auth.checkOrLock(c, c.Proxy.BlockByIDN, logger)
+	}
 	if err := c.Direct.check(nil, nil, logger); err != nil {
 		return err
 	}
@@ -30,6 +75,8 @@ func (c *DefaultConfig) check(logger *log.Entry) error {
 type InterfaceConfig struct {
 	Name           string                        `yaml:"-"`
 	Ip             net.IP                        `yaml:"-"`
+	Ips            []net.IP                      `yaml:"-"` // every address the services listen on, Ip first
+	DisableIPv6    bool                          `yaml:"disable_ipv6"`
 	EnableProxy    bool                          `yaml:"enable_proxy"`
 	Proxy          ProxyConfig                   `yaml:",inline"`
 	Direct         LocalNetworks                 `yaml:",inline"`
@@ -43,16 +90,26 @@ func (i InterfaceConfig) ShouldStartHttp() bool {
 
 func (i *InterfaceConfig) check(name string, defaults *DefaultConfig, logger *log.Entry) error {
 	interfaceIP, err := common.GetIPForInterface(name)
+	networks := interfaceNetworks(name, interfaceIP, !i.DisableIPv6)
 	if err != nil {
-		logger.Errorf("cannot get interface ip: %s'%s'", name, err)
-		return err
+		// IPv6 only interface
+		if len(networks) == 0 {
+			logger.Errorf("cannot get interface ip: %s'%s'", name, err)
+			return err
+		}
+		interfaceIP = &networks[0]
 	}
 	i.Name = name
 	infos := &interfaceInfo{
-		Name: name,
-		Ip:   interfaceIP,
+		Name:     name,
+		Ip:       interfaceIP,
+		Networks: networks,
 	}
 	i.Ip = interfaceIP.IP
+	i.Ips = nil
+	for _, network := range networks {
+		i.Ips = append(i.Ips, network.IP)
+	}
 
 	// Check Proxy configuration before, we need it to check Http
 	err = i.Proxy.check(infos, defaults, logger)
@@ -61,7 +118,7 @@ func (i *InterfaceConfig) check(name string, defaults *DefaultConfig, logger *lo
 		return err
 	}
 	if i.EnableProxy {
-		infos.InterfaceProxy = fmt.Sprintf("%s:%d", i.Ip.String(), i.Proxy.Port)
+		infos.InterfaceProxy = i.Proxy.Connection
 	}
 
 	// Check the direct networks
@@ -71,6 +128,9 @@ func (i *InterfaceConfig) check(name string, defaults *DefaultConfig, logger *lo
 		return err
 	}
 
+	// Translate the proxy settings into rules evaluated after the configured ones
+	i.Proxy.Rules = append(i.Proxy.Rules, i.Proxy.policyRules(i.Direct, defaults, logger)...)
+
 	// Check our reverse proxy hosts
 	proxies := make(map[string]ReverseProxyConfig)
 	if len(i.ReverseProxies) > 0 {
@@ -26,10 +26,11 @@ func (c *LocalNetworks) check(infos *interfaceInfo, defaults *DefaultConfig, log
 				logger.Errorf("cannot parse network: %s'%s'", netString, err)
 				continue
 			}
-			_, network, err = net.ParseCIDR(ip.String())
-			if err != nil {
-				network = ip
+			// Every network of the interface, IPv4 and IPv6
+			for _, interfaceNetwork := range interfaceNetworks(netString, ip, true) {
+				c.Networks = appendNetwork(c.Networks, interfaceNetwork)
 			}
+			continue
 		}
 		c.Networks = appendNetwork(c.Networks, *network)
 	}
@@ -37,7 +38,9 @@ func (c *LocalNetworks) check(infos *interfaceInfo, defaults *DefaultConfig, log
 		c.InterfaceNetworkDirect = true
 	}
 	if infos != nil && c.InterfaceNetworkDirect {
-		c.Networks = appendNetwork(c.Networks, *infos.Ip)
+		for _, network := range infos.Networks {
+			c.Networks = appendNetwork(c.Networks, network)
+		}
 	}
 	c.NetworkStrings = nil
 	return nil
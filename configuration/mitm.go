@@ -0,0 +1,78 @@
+package configuration
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/COSAE-FR/riproxy/acl"
+	"github.com/COSAE-FR/riproxy/mitm"
+	log "github.com/sirupsen/logrus"
+)
+
+// MitmConfig intercepts the TLS connections to a few domains, the other CONNECT requests stay blind tunnels
+type MitmConfig struct {
+	Certificate        string           `yaml:"ca_cert"`
+	Key                string           `yaml:"ca_key"`
+	Domains            []string         `yaml:"domains"`
+	Categories         []string         `yaml:"categories"`
+	TrustStore         []string         `yaml:"trust_store"`
+	ExcludeSystemRoots bool             `yaml:"exclude_system_roots"`
+	CacheTTLString     string           `yaml:"cache_ttl"`
+	CacheSize          int              `yaml:"cache_size"`
+	CA                 *tls.Certificate `yaml:"-"`
+	RootCAs            *x509.CertPool   `yaml:"-"` // verifies the intercepted servers
+	Certificates       *mitm.CertCache  `yaml:"-"`
+	Rule               *acl.Rule        `yaml:"-"` // matches the intercepted hosts
+}
+
+func (c *MitmConfig) check(defaults *DefaultConfig, blockByIDN bool, logger *log.Entry) error {
+	if len(c.Certificate) == 0 || len(c.Key) == 0 {
+		return errors.New("missing mitm ca_cert or ca_key")
+	}
+	var err error
+	if c.CA, err = mitm.LoadCA(c.Certificate, c.Key); err != nil {
+		return fmt.Errorf("cannot load mitm CA: %s", err)
+	}
+	if c.RootCAs, err = mitm.TrustStore(c.TrustStore, !c.ExcludeSystemRoots); err != nil {
+		return fmt.Errorf("cannot load mitm trust store: %s", err)
+	}
+	ttl, err := parseDuration(c.CacheTTLString, mitm.DefaultCacheTTL, "mitm cache_ttl")
+	if err != nil {
+		return err
+	}
+	if c.CacheSize <= 0 {
+		c.CacheSize = mitm.DefaultCacheSize
+	}
+	c.Certificates = mitm.NewCertCache(ttl, c.CacheSize)
+	c.Rule = &acl.Rule{Name: "mitm", Action: acl.Allow}
+	if len(c.Domains) > 0 {
+		c.Rule.Domains = append(c.Rule.Domains, newDomainTree(c.Domains, blockByIDN))
+	}
+	for _, name := range c.Categories {
+		category, ok := defaults.Categories[name]
+		if !ok {
+			return fmt.Errorf("unknown category %s in mitm categories", name)
+		}
+		c.Rule.Domains = append(c.Rule.Domains, category.Lists...)
+	}
+	if len(c.Rule.Domains) == 0 {
+		return errors.New("no mitm domains or categories")
+	}
+	logger.WithField("ca_subject", c.CA.Leaf.Subject.String()).Warnf("TLS interception enabled for %d domains and %d categories", len(c.Domains), len(c.Categories))
+	c.Domains = nil
+	return nil
+}
+
+// Intercepts returns true if the TLS connection of the CONNECT request must be intercepted
+func (c *MitmConfig) Intercepts(req *acl.Request) bool {
+	return c != nil && c.Rule.Match(req)
+}
+
+// MitmCertificate returns the CA certificate of the TLS interception in PEM format, nil if interception is disabled
+func (c *DefaultConfig) MitmCertificate() []byte {
+	if c == nil || c.Mitm == nil {
+		return nil
+	}
+	return mitm.PEM(c.Mitm.CA)
+}
@@ -1,28 +1,223 @@
 package configuration
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"github.com/COSAE-FR/riproxy/acl"
 	"github.com/COSAE-FR/riproxy/domains"
-	"github.com/COSAE-FR/riputils/common"
 	log "github.com/sirupsen/logrus"
 	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
+const (
+	PolicyBlockList = "blocklist"
+	PolicyAllowList = "allowlist"
+)
+
+const SnapshotDisabled = "none"
+
+func newEmptyDomainTree(idn bool) domains.DomainTree {
+	if idn {
+		return domains.NewIDNA()
+	}
+	return domains.New()
+}
+
+func newDomainTree(list []string, idn bool) domains.DomainTree {
+	if idn {
+		return domains.NewIDNAFromList(list)
+	}
+	return domains.NewFromList(list)
+}
+
+type BlockFileConfig struct {
+	Path     string `yaml:"path"`
+	Format   string `yaml:"format"`
+	Category string `yaml:"category"`
+}
+
+// UnmarshalYAML accepts a bare path as well as a path and format mapping
+func (c *BlockFileConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var path string
+	if err := unmarshal(&path); err == nil {
+		c.Path = path
+		return nil
+	}
+	type plain BlockFileConfig
+	return unmarshal((*plain)(c))
+}
+
+// loadBlockFiles loads every block file in tree and logs a summary per file, it returns false if a file cannot be loaded
+func loadBlockFiles(tree domains.DomainTree, files []BlockFileConfig, logger *log.Entry) bool {
+	loaded := true
+	for _, file := range files {
+		fileLogger := logger.WithField("block_file", file.Path)
+		format, err := domains.ParseFormat(file.Format)
+		if err != nil {
+			fileLogger.Errorf("cannot load block file: %s", err)
+			loaded = false
+			continue
+		}
+		result, err := domains.LoadFile(tree, file.Path, file.Category, format)
+		for _, lineError := range result.Errors {
+			fileLogger.Warnf("invalid block file entry: %s", lineError)
+		}
+		if err != nil {
+			fileLogger.Errorf("cannot load block file: %s", err)
+			loaded = false
+			continue
+		}
+		fileLogger.WithFields(log.Fields{
+			"entries": result.Entries,
+			"skipped": result.Skipped,
+			"errors":  len(result.Errors),
+		}).Infof("loaded %d entries from block file", result.Entries)
+	}
+	return loaded
+}
+
+// blockListFingerprint returns the name of the snapshot of a block list configuration
+// and the fingerprint of its sources: inline entries, block files and their size and modification time
+func blockListFingerprint(list []string, files []BlockFileConfig, idn bool) (string, []byte) {
+	config := sha256.New()
+	_, _ = fmt.Fprintf(config, "idn=%v\n", idn)
+	for _, domain := range list {
+		_, _ = fmt.Fprintf(config, "block=%s\n", domain)
+	}
+	for _, file := range files {
+		_, _ = fmt.Fprintf(config, "file=%s format=%s category=%s\n", file.Path, file.Format, file.Category)
+	}
+	name := config.Sum(nil)
+	sources := sha256.New()
+	_, _ = sources.Write(name)
+	for _, file := range files {
+		if info, err := os.Stat(file.Path); err == nil {
+			_, _ = fmt.Fprintf(sources, "%s %d %d\n", file.Path, info.Size(), info.ModTime().UnixNano())
+		} else {
+			_, _ = fmt.Fprintf(sources, "%s missing\n", file.Path)
+		}
+	}
+	return hex.EncodeToString(name[:8]), sources.Sum(nil)
+}
+
+// parsePorts parses a list of ports and port ranges, invalid entries are skipped
+func parsePorts(list []string, name string, logger *log.Entry) acl.PortRanges {
+	var ports acl.PortRanges
+	for _, port := range list {
+		portRange, err := acl.ParsePortRange(port)
+		if err != nil {
+			logger.Warnf("invalid port in %s, skipping: %s", name, err)
+			continue
+		}
+		ports = append(ports, portRange)
+	}
+	return ports
+}
+
+// parseNetworkList parses a list of networks in CIDR format or IP addresses, invalid entries are skipped
+func parseNetworkList(list []string, name string, logger *log.Entry) []net.IPNet {
+	var networks []net.IPNet
+	for _, netString := range list {
+		network, err := parseNetworks([]string{netString})
+		if err != nil {
+			logger.Warnf("invalid network in %s, skipping: %s", name, err)
+			continue
+		}
+		networks = append(networks, network...)
+	}
+	return networks
+}
+
+// loadBlockList builds the block list, the lists with block files are loaded from a snapshot if their sources did not change
+func (c *ProxyConfig) loadBlockList(logger *log.Entry) {
+	if len(c.BlockFiles) == 0 {
+		c.BlockList = newDomainTree(c.BlockListString, c.BlockByIDN)
+		return
+	}
+	var snapshotLogger *log.Entry
+	var path string
+	var fingerprint []byte
+	if c.SnapshotDirectory != SnapshotDisabled {
+		var name string
+		name, fingerprint = blockListFingerprint(c.BlockListString, c.BlockFiles, c.BlockByIDN)
+		path = filepath.Join(c.SnapshotDirectory, "blocklist-"+name+".snapshot")
+		snapshotLogger = logger.WithField("snapshot", path)
+		tree, err := domains.ReadSnapshotFile(path, fingerprint)
+		if err == nil {
+			snapshotLogger.Info("loaded block list from snapshot")
+			c.BlockList = tree
+			return
+		}
+		if !os.IsNotExist(err) {
+			snapshotLogger.Infof("cannot use block list snapshot, rebuilding it: %s", err)
+		}
+	}
+	c.BlockList = newEmptyDomainTree(c.BlockByIDN)
+	for _, domain := range c.BlockListString {
+		c.BlockList.Put(domain)
+	}
+	if !loadBlockFiles(c.BlockList, c.BlockFiles, logger) || len(path) == 0 {
+		return
+	}
+	if _, current := blockListFingerprint(c.BlockListString, c.BlockFiles, c.BlockByIDN); !bytes.Equal(current, fingerprint) {
+		snapshotLogger.Warn("block files changed while loading, snapshot not written")
+		return
+	}
+	if err := domains.WriteSnapshotFile(path, c.BlockList, fingerprint); err != nil {
+		snapshotLogger.Warnf("cannot write block list snapshot: %s", err)
+	}
+}
+
 type ProxyConfig struct {
-	Port                 uint16             `yaml:"port,omitempty"`
-	Connection           string             `yaml:"-"`
-	BlockByIDN           bool               `yaml:"block_by_idn"`
-	BlockListString      []string           `yaml:"block"`
-	BlockList            domains.DomainTree `yaml:"-"`
-	AllowHighPorts       bool               `yaml:"allow_high_ports"`
-	AllowLowPorts        bool               `yaml:"allow_low_ports"`
-	BlockIPs             bool               `yaml:"block_ips"`
-	BlockLocalServices   bool               `yaml:"block_local_services"`
-	LocalIps             []net.IP           `yaml:"-"`
-	AllowedMethods       []string           `yaml:"allowed_methods"`
-	HttpTransparent      bool               `yaml:"http_transparent"`
-	HttpsTransparentPort uint16             `yaml:"https_transparent_port"`
+	Port                 uint16                          `yaml:"port,omitempty"`
+	Connection           string                          `yaml:"-"`
+	Connections          []string                        `yaml:"-"` // proxy address of every address of the interface, Connection first
+	BlockByIDN           bool                            `yaml:"block_by_idn"`
+	BlockListString      []string                        `yaml:"block"`
+	BlockFiles           []BlockFileConfig               `yaml:"block_files"`
+	BlockList            domains.DomainTree              `yaml:"-"`
+	BlockSubscriptions   []string                        `yaml:"block_subscriptions"`
+	SubscriptionLists    []domains.DomainTree            `yaml:"-"`
+	Policy               string                          `yaml:"policy"`
+	AllowListString      []string                        `yaml:"allow"`
+	AllowList            domains.DomainTree              `yaml:"-"`
+	PortExceptionsString []string                        `yaml:"port_exceptions"`
+	PortExceptions       domains.DomainTree              `yaml:"-"`
+	AllowHighPorts       bool                            `yaml:"allow_high_ports"`
+	AllowLowPorts        bool                            `yaml:"allow_low_ports"`
+	AllowedPortsString   []string                        `yaml:"allowed_ports"`
+	AllowedPorts         acl.PortRanges                  `yaml:"-"`
+	DeniedPortsString    []string                        `yaml:"denied_ports"`
+	DeniedPorts          acl.PortRanges                  `yaml:"-"`
+	ConnectAllowedString []string                        `yaml:"connect_allowed_ports"`
+	ConnectAllowed       acl.PortRanges                  `yaml:"-"`
+	ConnectDeniedString  []string                        `yaml:"connect_denied_ports"`
+	ConnectDenied        acl.PortRanges                  `yaml:"-"`
+	BlockIPs             bool                            `yaml:"block_ips"`
+	BlockLocalServices   bool                            `yaml:"block_local_services"`
+	BlockNetworksString  []string                        `yaml:"block_networks"`
+	BlockNetworks        []net.IPNet                     `yaml:"-"`
+	AllowNetworksString  []string                        `yaml:"allow_networks"`
+	AllowNetworks        []net.IPNet                     `yaml:"-"`
+	AllowDirectNetworks  bool                            `yaml:"allow_direct_networks"`
+	BlockPrivateNames    bool                            `yaml:"block_private_resolutions"`
+	LocalIps             []net.IP                        `yaml:"-"`
+	AllowedMethods       []string                        `yaml:"allowed_methods"`
+	HttpTransparent      bool                            `yaml:"http_transparent"`
+	HttpsTransparentPort uint16                          `yaml:"https_transparent_port"`
+	SocksPort            uint16                          `yaml:"socks_port"`
+	SnapshotDirectory    string                          `yaml:"snapshot_directory"`
+	Auth                 *AuthConfig                     `yaml:"auth"`
+	RateLimit            *RateLimitConfig                `yaml:"rate_limit"`
+	CategoryPolicies     map[string]CategoryPolicyConfig `yaml:"category_policies"`
+	RuleList             []RuleConfig                    `yaml:"rules"`
+	Rules                acl.List                        `yaml:"-"`
 }
 
 func (c *ProxyConfig) check(infos *interfaceInfo, defaults *DefaultConfig, logger *log.Entry) error {
@@ -37,7 +232,11 @@ func (c *ProxyConfig) check(infos *interfaceInfo, defaults *DefaultConfig, logge
 	}
 	if defaults != nil {
 		if infos != nil {
-			c.Connection = fmt.Sprintf("%s:%d", infos.Ip.IP.String(), c.Port)
+			port := strconv.Itoa(int(c.Port))
+			c.Connection = net.JoinHostPort(infos.Ip.IP.String(), port)
+			for _, network := range infos.Networks {
+				c.Connections = append(c.Connections, net.JoinHostPort(network.IP.String(), port))
+			}
 		}
 		if !c.BlockByIDN && defaults.Proxy.BlockByIDN {
 			c.BlockByIDN = true
@@ -54,22 +253,103 @@ func (c *ProxyConfig) check(infos *interfaceInfo, defaults *DefaultConfig, logge
 		if !c.BlockLocalServices && defaults.Proxy.BlockLocalServices {
 			c.BlockLocalServices = true
 		}
+		if !c.AllowDirectNetworks && defaults.Proxy.AllowDirectNetworks {
+			c.AllowDirectNetworks = true
+		}
+		if !c.BlockPrivateNames && defaults.Proxy.BlockPrivateNames {
+			c.BlockPrivateNames = true
+		}
 		if !c.HttpTransparent && defaults.Proxy.HttpTransparent {
 			c.HttpTransparent = true
 		}
 		if c.HttpsTransparentPort == 0 && defaults.Proxy.HttpsTransparentPort != 0 {
 			c.HttpsTransparentPort = defaults.Proxy.HttpsTransparentPort
 		}
+		if c.SocksPort == 0 && defaults.Proxy.SocksPort != 0 {
+			c.SocksPort = defaults.Proxy.SocksPort
+		}
+		if len(c.Policy) == 0 {
+			c.Policy = defaults.Proxy.Policy
+		}
+		if len(c.SnapshotDirectory) == 0 {
+			c.SnapshotDirectory = defaults.Proxy.SnapshotDirectory
+		}
+		c.SubscriptionLists = defaults.subscriptionTrees(c.BlockSubscriptions, logger)
+		// Without its own users, the interface uses the users of the defaults
+		if c.Auth == nil {
+			c.Auth = defaults.Proxy.Auth
+		} else {
+			c.Auth.checkOrLock(defaults, c.BlockByIDN, logger)
+		}
+		// Without its own limits, the interface shares the limiter of the defaults
+		if c.RateLimit == nil {
+			c.RateLimit = defaults.Proxy.RateLimit
+		} else {
+			c.RateLimit.check(defaults.Proxy.RateLimit, logger)
+		}
+	} else if c.RateLimit != nil {
+		c.RateLimit.check(nil, logger)
+	}
+	switch strings.ToLower(c.Policy) {
+	case "", PolicyBlockList:
+		c.Policy = PolicyBlockList
+	case PolicyAllowList:
+		c.Policy = PolicyAllowList
+	default:
+		logger.Errorf("unknown proxy policy %s, using %s", c.Policy, PolicyAllowList)
+		c.Policy = PolicyAllowList
 	}
 	if defaults != nil && c.BlockLocalServices {
-		c.LocalIps = common.GetLocalIPs()
+		c.LocalIps = localAddresses()
 	}
-	if c.BlockByIDN {
-		c.BlockList = domains.NewIDNAFromList(c.BlockListString)
-	} else {
-		c.BlockList = domains.NewFromList(c.BlockListString)
+	if len(c.SnapshotDirectory) == 0 {
+		c.SnapshotDirectory = DefaultCacheDirectory
 	}
+	c.loadBlockList(logger)
+	if c.BlockList == nil {
+		c.BlockList = newEmptyDomainTree(c.BlockByIDN)
+	}
+	// Block entries can be added or removed while the proxy is serving
+	c.BlockList = domains.NewSafe(c.BlockList)
 	c.BlockListString = nil
+	c.AllowList = newDomainTree(c.AllowListString, c.BlockByIDN)
+	c.AllowListString = nil
+	c.PortExceptions = newDomainTree(c.PortExceptionsString, c.BlockByIDN)
+	c.PortExceptionsString = nil
+	c.AllowedPorts = parsePorts(c.AllowedPortsString, "allowed_ports", logger)
+	c.DeniedPorts = parsePorts(c.DeniedPortsString, "denied_ports", logger)
+	c.ConnectAllowed = parsePorts(c.ConnectAllowedString, "connect_allowed_ports", logger)
+	c.ConnectDenied = parsePorts(c.ConnectDeniedString, "connect_denied_ports", logger)
+	if defaults != nil {
+		if len(c.AllowedPortsString) == 0 {
+			c.AllowedPorts = defaults.Proxy.AllowedPorts
+		}
+		if len(c.DeniedPortsString) == 0 {
+			c.DeniedPorts = defaults.Proxy.DeniedPorts
+		}
+		if len(c.ConnectAllowedString) == 0 {
+			c.ConnectAllowed = defaults.Proxy.ConnectAllowed
+		}
+		if len(c.ConnectDeniedString) == 0 {
+			c.ConnectDenied = defaults.Proxy.ConnectDenied
+		}
+	}
+	// The networks of the interface are added to the default ones
+	c.BlockNetworks = parseNetworkList(c.BlockNetworksString, "block_networks", logger)
+	c.AllowNetworks = parseNetworkList(c.AllowNetworksString, "allow_networks", logger)
+	if defaults != nil {
+		c.BlockNetworks = append(c.BlockNetworks, defaults.Proxy.BlockNetworks...)
+		c.AllowNetworks = append(c.AllowNetworks, defaults.Proxy.AllowNetworks...)
+	}
+	c.BlockNetworksString, c.AllowNetworksString = nil, nil
+	c.AllowedPortsString, c.DeniedPortsString, c.ConnectAllowedString, c.ConnectDeniedString = nil, nil, nil, nil
+	if defaults != nil {
+		c.Rules = compileRules(c.RuleList, "interface", c.BlockByIDN, logger)
+		c.Rules = append(c.Rules, defaults.Proxy.Rules...)
+	} else {
+		c.Rules = compileRules(c.RuleList, "defaults", c.BlockByIDN, logger)
+	}
+	c.RuleList = nil
 	if len(c.AllowedMethods) > 0 {
 		var allowed []string
 		for _, method := range c.AllowedMethods {
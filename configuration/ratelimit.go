@@ -0,0 +1,51 @@
+package configuration
+
+import (
+	"github.com/COSAE-FR/riproxy/ratelimit"
+	log "github.com/sirupsen/logrus"
+)
+
+// RateLimitConfig limits the requests and the CONNECT tunnels of each client,
+// the unset values of an interface come from the defaults and a negative value disables the limit
+type RateLimitConfig struct {
+	RequestsPerSecond float64            `yaml:"requests_per_second"`
+	Burst             int                `yaml:"burst"`
+	MaxTunnels        int                `yaml:"max_tunnels"`
+	Limiter           *ratelimit.Limiter `yaml:"-"`
+}
+
+func (c *RateLimitConfig) check(defaults *RateLimitConfig, logger *log.Entry) {
+	if defaults != nil {
+		if c.RequestsPerSecond == 0 {
+			c.RequestsPerSecond = defaults.RequestsPerSecond
+		}
+		if c.Burst == 0 {
+			c.Burst = defaults.Burst
+		}
+		if c.MaxTunnels == 0 {
+			c.MaxTunnels = defaults.MaxTunnels
+		}
+	}
+	// Without burst, a client can send the requests of one second at once
+	if c.Burst <= 0 && c.RequestsPerSecond > 0 {
+		c.Burst = int(c.RequestsPerSecond)
+	}
+	if c.RequestsPerSecond <= 0 && c.MaxTunnels <= 0 {
+		c.Limiter = nil
+		return
+	}
+	c.Limiter = ratelimit.NewLimiter(c.RequestsPerSecond, c.Burst, c.MaxTunnels)
+	logger.WithFields(log.Fields{
+		"requests_per_second": c.RequestsPerSecond,
+		"burst":               c.Limiter.Burst,
+		"max_tunnels":         c.MaxTunnels,
+	}).Info("client rate limits enabled")
+}
+
+// ClientLimiter returns the limiter of the clients, nil if no limit is set
+func (c *RateLimitConfig) ClientLimiter() *ratelimit.Limiter {
+	if c == nil {
+		return nil
+	}
+	return c.Limiter
+}
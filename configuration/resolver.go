@@ -0,0 +1,87 @@
+package configuration
+
+import (
+	"fmt"
+	"github.com/COSAE-FR/riproxy/resolver"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+	"time"
+)
+
+type ResolverConfig struct {
+	Servers              []string           `yaml:"servers"`
+	Protocol             string             `yaml:"protocol"`
+	ServerName           string             `yaml:"server_name"`
+	TimeoutString        string             `yaml:"timeout"`
+	MinTTLString         string             `yaml:"min_ttl"`
+	MaxTTLString         string             `yaml:"max_ttl"`
+	NegativeMinTTLString string             `yaml:"negative_min_ttl"`
+	NegativeMaxTTLString string             `yaml:"negative_max_ttl"`
+	MaxEntries           int                `yaml:"max_entries"`
+	Resolver             *resolver.Resolver `yaml:"-"`
+}
+
+// parseDuration parses value if set, fallback is returned otherwise
+func parseDuration(value string, fallback time.Duration, name string) (time.Duration, error) {
+	if len(value) == 0 {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid %s: %s", name, value)
+	}
+	return duration, nil
+}
+
+func (c *ResolverConfig) check(logger *log.Entry) error {
+	var err error
+	config := resolver.Config{ServerName: c.ServerName, MaxEntries: c.MaxEntries}
+	if c.MaxEntries < 0 {
+		return fmt.Errorf("invalid resolver max_entries: %d", c.MaxEntries)
+	}
+	if config.Protocol, err = resolver.ParseProtocol(c.Protocol); err != nil {
+		return err
+	}
+	for _, server := range c.Servers {
+		host := server
+		if splitHost, _, err := net.SplitHostPort(server); err == nil {
+			host = splitHost
+		}
+		if net.ParseIP(strings.Trim(host, "[]")) == nil {
+			return fmt.Errorf("invalid resolver server address: %s", server)
+		}
+		config.Servers = append(config.Servers, server)
+	}
+	if config.Timeout, err = parseDuration(c.TimeoutString, resolver.DefaultTimeout, "resolver timeout"); err != nil {
+		return err
+	}
+	if config.MinTTL, err = parseDuration(c.MinTTLString, resolver.DefaultMinTTL, "resolver min_ttl"); err != nil {
+		return err
+	}
+	if config.MaxTTL, err = parseDuration(c.MaxTTLString, resolver.DefaultMaxTTL, "resolver max_ttl"); err != nil {
+		return err
+	}
+	if config.NegativeMinTTL, err = parseDuration(c.NegativeMinTTLString, resolver.DefaultNegativeMinTTL, "resolver negative_min_ttl"); err != nil {
+		return err
+	}
+	if config.NegativeMaxTTL, err = parseDuration(c.NegativeMaxTTLString, resolver.DefaultNegativeMaxTTL, "resolver negative_max_ttl"); err != nil {
+		return err
+	}
+	if config.MaxTTL < config.MinTTL || config.NegativeMaxTTL < config.NegativeMinTTL {
+		logger.Warn("resolver maximum TTL lower than the minimum TTL, using the minimum")
+	}
+	c.Resolver = resolver.New(config, logger)
+	if len(c.Resolver.Config.Servers) == 0 {
+		return fmt.Errorf("no resolver server configured and none found in /etc/resolv.conf")
+	}
+	return nil
+}
+
+// LookupResolver returns the resolver of the proxies, nil if the system resolver is used
+func (c *DefaultConfig) LookupResolver() *resolver.Resolver {
+	if c == nil || c.Resolver == nil {
+		return nil
+	}
+	return c.Resolver.Resolver
+}
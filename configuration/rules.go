@@ -0,0 +1,339 @@
+package configuration
+
+import (
+	"fmt"
+	"github.com/COSAE-FR/riproxy/acl"
+	"github.com/COSAE-FR/riproxy/domains"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"strings"
+)
+
+const defaultDenyMessage = "Blocked by policy"
+
+type RuleConfig struct {
+	Name              string   `yaml:"name"`
+	Action            string   `yaml:"action"`
+	Message           string   `yaml:"message"`
+	Status            int      `yaml:"status"`
+	Sources           []string `yaml:"sources"`
+	Domains           []string `yaml:"domains"`
+	NotDomains        []string `yaml:"not_domains"`
+	Destinations      []string `yaml:"destinations"`
+	NotDestinations   []string `yaml:"not_destinations"`
+	Ports             []string `yaml:"ports"`
+	NotPorts          []string `yaml:"not_ports"`
+	Methods           []string `yaml:"methods"`
+	NotMethods        []string `yaml:"not_methods"`
+	Schemes           []string `yaml:"schemes"`
+	Paths             []string `yaml:"paths"`
+	RawIP             bool     `yaml:"raw_ip"`
+	PrivateResolution bool     `yaml:"private_resolution"`
+	Users             []string `yaml:"users"`
+	Groups            []string `yaml:"groups"`
+	NotGroups         []string `yaml:"not_groups"`
+}
+
+func stringSet(list []string) map[string]bool {
+	if len(list) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(list))
+	for _, value := range list {
+		set[value] = true
+	}
+	return set
+}
+
+func parseNetworks(list []string) ([]net.IPNet, error) {
+	var networks []net.IPNet
+	for _, netString := range list {
+		_, network, err := net.ParseCIDR(netString)
+		if err != nil {
+			ip := net.ParseIP(netString)
+			if ip == nil {
+				return nil, fmt.Errorf("cannot parse network: %s", netString)
+			}
+			network = hostNetwork(ip)
+		}
+		networks = append(networks, *network)
+	}
+	return networks, nil
+}
+
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func methodSet(methods []string) map[string]bool {
+	if len(methods) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		set[strings.ToUpper(method)] = true
+	}
+	return set
+}
+
+func (c RuleConfig) compile(name string, blockByIDN bool) (*acl.Rule, error) {
+	var err error
+	rule := &acl.Rule{
+		Name:              name,
+		Message:           c.Message,
+		Methods:           methodSet(c.Methods),
+		NotMethods:        methodSet(c.NotMethods),
+		Paths:             c.Paths,
+		RawIP:             c.RawIP,
+		PrivateResolution: c.PrivateResolution,
+		Users:             stringSet(c.Users),
+		Groups:            stringSet(c.Groups),
+		NotGroups:         stringSet(c.NotGroups),
+	}
+	if len(c.Name) > 0 {
+		rule.Name = c.Name
+	}
+	rule.Action, err = acl.ParseAction(c.Action)
+	if err != nil {
+		return nil, err
+	}
+	if rule.Action == acl.Deny && len(rule.Message) == 0 {
+		rule.Message = defaultDenyMessage
+	}
+	if c.Status != 0 {
+		if c.Status < 400 || c.Status > 599 {
+			return nil, fmt.Errorf("invalid HTTP status: %d", c.Status)
+		}
+		rule.Status = c.Status
+	}
+	if rule.Sources, err = parseNetworks(c.Sources); err != nil {
+		return nil, err
+	}
+	if rule.NotDestinations, err = parseNetworks(c.NotDestinations); err != nil {
+		return nil, err
+	}
+	if rule.Destinations, err = parseNetworks(c.Destinations); err != nil {
+		return nil, err
+	}
+	if rule.Ports, err = acl.ParsePortRanges(c.Ports); err != nil {
+		return nil, err
+	}
+	if rule.NotPorts, err = acl.ParsePortRanges(c.NotPorts); err != nil {
+		return nil, err
+	}
+	if len(c.Domains) > 0 {
+		rule.Domains = []domains.DomainTree{newDomainTree(c.Domains, blockByIDN)}
+	}
+	if len(c.NotDomains) > 0 {
+		rule.NotDomains = []domains.DomainTree{newDomainTree(c.NotDomains, blockByIDN)}
+	}
+	if len(c.Schemes) > 0 {
+		rule.Schemes = make(map[string]bool, len(c.Schemes))
+		for _, scheme := range c.Schemes {
+			rule.Schemes[strings.ToLower(scheme)] = true
+		}
+	}
+	return rule, nil
+}
+
+func compileRules(list []RuleConfig, prefix string, blockByIDN bool, logger *log.Entry) acl.List {
+	var rules acl.List
+	for index, config := range list {
+		rule, err := config.compile(fmt.Sprintf("%s#%d", prefix, index+1), blockByIDN)
+		if err != nil {
+			logger.Errorf("cannot parse rule %d in %s rules, skipping: %s", index+1, prefix, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// blockLists returns the inline and file block list followed by the subscribed lists
+func (c *ProxyConfig) blockLists() []domains.DomainTree {
+	var lists []domains.DomainTree
+	if c.BlockList != nil {
+		lists = append(lists, c.BlockList)
+	}
+	return append(lists, c.SubscriptionLists...)
+}
+
+// portRules returns the port policy rules of a scheme: plain HTTP uses allowed_ports and denied_ports,
+// CONNECT uses connect_allowed_ports and connect_denied_ports.
+// Without allowed ports, the default port (80 or 443) and the ports allowed by allow_low_ports and allow_high_ports are allowed.
+// The unparsable ports (port 0) are always denied.
+func (c *ProxyConfig) portRules(scheme string, name string, message string, exceptions []domains.DomainTree) acl.List {
+	allowed, denied, defaultPort := c.AllowedPorts, c.DeniedPorts, uint16(80)
+	if scheme == "https" {
+		allowed, denied, defaultPort = c.ConnectAllowed, c.ConnectDenied, 443
+	}
+	var rules acl.List
+	if len(denied) > 0 {
+		rules = append(rules, &acl.Rule{
+			Name:       name,
+			Action:     acl.Deny,
+			Message:    message,
+			Schemes:    map[string]bool{scheme: true},
+			Ports:      denied,
+			NotDomains: exceptions,
+		})
+	}
+	if len(allowed) == 0 {
+		allowed = acl.PortRanges{{Low: defaultPort, High: defaultPort}}
+		if c.AllowLowPorts {
+			allowed = append(allowed, acl.PortRange{Low: 1, High: 1024})
+		}
+		if c.AllowHighPorts {
+			allowed = append(allowed, acl.PortRange{Low: 1025, High: 65535})
+		}
+	}
+	return append(rules, &acl.Rule{
+		Name:       name,
+		Action:     acl.Deny,
+		Message:    message,
+		Schemes:    map[string]bool{scheme: true},
+		NotPorts:   allowed,
+		NotDomains: exceptions,
+	})
+}
+
+// policyRules translates the proxy settings into rules appended after the configured ones
+func (c *ProxyConfig) policyRules(direct LocalNetworks, defaults *DefaultConfig, logger *log.Entry) acl.List {
+	var rules acl.List
+
+	// Block if destination is a local service
+	if c.BlockLocalServices && len(c.LocalIps) > 0 {
+		localNetworks := make([]net.IPNet, 0, len(c.LocalIps))
+		for _, ip := range c.LocalIps {
+			localNetworks = append(localNetworks, *hostNetwork(ip))
+		}
+		rules = append(rules, &acl.Rule{
+			Name:            "block_local_services",
+			Action:          acl.Deny,
+			Message:         "Blocked: destination is not allowed: local service",
+			Destinations:    localNetworks,
+			NotDestinations: c.AllowNetworks,
+		})
+	}
+
+	// Block if destination is a direct network, unless direct networks are only used in the PAC file
+	if len(direct.Networks) > 0 && !c.AllowDirectNetworks {
+		rules = append(rules, &acl.Rule{
+			Name:            "direct_networks",
+			Action:          acl.Deny,
+			Message:         "Blocked: destination is not allowed: local subnet",
+			Destinations:    direct.Networks,
+			NotDestinations: c.AllowNetworks,
+		})
+	}
+
+	// Block if destination is in a blocked network
+	if len(c.BlockNetworks) > 0 {
+		rules = append(rules, &acl.Rule{
+			Name:            "block_networks",
+			Action:          acl.Deny,
+			Message:         "Blocked: destination is not allowed: blocked network",
+			Destinations:    c.BlockNetworks,
+			NotDestinations: c.AllowNetworks,
+		})
+	}
+
+	// Block host names resolving to private addresses, a hostile DNS answer could reach internal services
+	if c.BlockPrivateNames {
+		rules = append(rules, &acl.Rule{
+			Name:              "block_private_resolutions",
+			Action:            acl.Deny,
+			Message:           "Blocked: destination is not allowed: name resolves to a private address",
+			PrivateResolution: true,
+			NotDestinations:   c.AllowNetworks,
+		})
+	}
+
+	// Block if method is not allowed, the groups with their own allowed methods replace the interface ones
+	var groupMethods map[string]bool
+	if c.Auth != nil {
+		var groupRules acl.List
+		groupRules, groupMethods = c.Auth.methodRules()
+		rules = append(rules, groupRules...)
+	}
+	allowedMethods := make(map[string]bool, len(c.AllowedMethods))
+	for _, method := range c.AllowedMethods {
+		allowedMethods[method] = true
+	}
+	rules = append(rules, &acl.Rule{
+		Name:       "allowed_methods",
+		Action:     acl.Deny,
+		Message:    "Blocked: method not allowed",
+		NotMethods: allowedMethods,
+		NotGroups:  groupMethods,
+	})
+
+	// Block host IPs if configured
+	if c.BlockIPs {
+		rules = append(rules, &acl.Rule{
+			Name:    "block_ips",
+			Action:  acl.Deny,
+			Message: "Blocked by host policy",
+			RawIP:   true,
+		})
+	}
+
+	// Block if destination port is not allowed
+	// Domains with a port exception are never blocked by the port policy
+	var portExceptions []domains.DomainTree
+	if c.PortExceptions != nil {
+		portExceptions = append(portExceptions, c.PortExceptions)
+	}
+	if defaults != nil && defaults.Proxy.PortExceptions != nil {
+		portExceptions = append(portExceptions, defaults.Proxy.PortExceptions)
+	}
+	rules = append(rules, c.portRules("http", "http_ports", "Blocked by host port policy", portExceptions)...)
+	rules = append(rules, c.portRules("https", "connect_ports", "Connect port not allowed", portExceptions)...)
+
+	// Category policies
+	rules = append(rules, c.categoryRules(defaults, logger)...)
+
+	// Group, interface and global domain block lists
+	if c.Auth != nil {
+		rules = append(rules, c.Auth.blockRules()...)
+	}
+	if blockLists := c.blockLists(); len(blockLists) > 0 {
+		rules = append(rules, &acl.Rule{
+			Name:    "block",
+			Action:  acl.Deny,
+			Message: "Blocked by interface policy",
+			Domains: blockLists,
+		})
+	}
+	if defaults != nil {
+		if blockLists := defaults.Proxy.blockLists(); len(blockLists) > 0 {
+			rules = append(rules, &acl.Rule{
+				Name:    "global_block",
+				Action:  acl.Deny,
+				Message: "Blocked by global policy",
+				Domains: blockLists,
+			})
+		}
+	}
+
+	// Only allow listed domains in allowlist mode
+	if c.Policy == PolicyAllowList {
+		rule := &acl.Rule{
+			Name:    "allow",
+			Action:  acl.Deny,
+			Message: "Blocked: domain not in allow list",
+		}
+		if c.AllowList != nil {
+			rule.NotDomains = append(rule.NotDomains, c.AllowList)
+		}
+		if defaults != nil && defaults.Proxy.AllowList != nil {
+			rule.NotDomains = append(rule.NotDomains, defaults.Proxy.AllowList)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
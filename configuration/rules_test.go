@@ -0,0 +1,107 @@
+package configuration
+
+import (
+	"github.com/COSAE-FR/riproxy/acl"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"testing"
+)
+
+func testLogger() *log.Entry {
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	return log.NewEntry(logger)
+}
+
+// checkedRules checks the defaults and the interface proxy configurations and returns the policy rules of the interface
+func checkedRules(t *testing.T, defaults DefaultConfig, proxy ProxyConfig) acl.List {
+	logger := testLogger()
+	defaults.Proxy.SnapshotDirectory = SnapshotDisabled
+	if err := defaults.check(logger); err != nil {
+		t.Fatalf("Cannot check defaults: %s", err)
+	}
+	if err := proxy.check(nil, &defaults, logger); err != nil {
+		t.Fatalf("Cannot check proxy configuration: %s", err)
+	}
+	return proxy.policyRules(LocalNetworks{}, &defaults, logger)
+}
+
+func TestPortRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  ProxyConfig
+		scheme  string
+		allowed []uint16
+		denied  []uint16
+	}{
+		{"default", ProxyConfig{}, "http", []uint16{80}, []uint16{0, 22, 443, 8080}},
+		{"connect default", ProxyConfig{}, "https", []uint16{443}, []uint16{0, 80, 8443}},
+		{"low ports", ProxyConfig{AllowLowPorts: true}, "http", []uint16{21, 80, 1024}, []uint16{0, 1025, 8080}},
+		{"high ports", ProxyConfig{AllowHighPorts: true}, "http", []uint16{80, 1025, 65535}, []uint16{0, 22, 1024}},
+		{"all ports", ProxyConfig{AllowLowPorts: true, AllowHighPorts: true}, "http", []uint16{1, 80, 65535}, []uint16{0}},
+		{"allowed list", ProxyConfig{AllowedPorts: acl.PortRanges{{Low: 8080, High: 8081}}}, "http", []uint16{8080, 8081}, []uint16{0, 80, 443}},
+		{"connect allowed list", ProxyConfig{ConnectAllowed: acl.PortRanges{{Low: 8443, High: 8443}}, AllowLowPorts: true}, "https", []uint16{8443}, []uint16{0, 443, 22}},
+		{"denied list", ProxyConfig{AllowLowPorts: true, DeniedPorts: acl.PortRanges{{Low: 25, High: 25}}}, "http", []uint16{80, 110}, []uint16{0, 25}},
+	}
+	for _, test := range tests {
+		rules := test.config.portRules(test.scheme, "ports", "Blocked", nil)
+		for _, port := range test.allowed {
+			if !rules.Evaluate(&acl.Request{Host: "www.example.com", Port: port, Scheme: test.scheme}).Allowed() {
+				t.Errorf("%s: port %d denied", test.name, port)
+			}
+		}
+		for _, port := range test.denied {
+			if rules.Evaluate(&acl.Request{Host: "www.example.com", Port: port, Scheme: test.scheme}).Allowed() {
+				t.Errorf("%s: port %d allowed", test.name, port)
+			}
+		}
+	}
+}
+
+func TestAllowListPolicy(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults ProxyConfig
+		proxy    ProxyConfig
+		allowed  []string
+		denied   []string
+	}{
+		{"allowlist", ProxyConfig{}, ProxyConfig{Policy: PolicyAllowList, AllowListString: []string{"www.example.com"}},
+			[]string{"www.example.com"}, []string{"other.example.com", "example.com", "www.example.org"}},
+		{"default allow list", ProxyConfig{AllowListString: []string{"*.example.org"}}, ProxyConfig{Policy: PolicyAllowList, AllowListString: []string{"www.example.com"}},
+			[]string{"www.example.com", "www.example.org"}, []string{"other.example.com"}},
+		{"default policy", ProxyConfig{Policy: PolicyAllowList}, ProxyConfig{AllowListString: []string{"www.example.com"}},
+			[]string{"www.example.com"}, []string{"other.example.com"}},
+		{"empty allow list", ProxyConfig{}, ProxyConfig{Policy: PolicyAllowList}, nil, []string{"www.example.com"}},
+		{"unknown policy", ProxyConfig{}, ProxyConfig{Policy: "whitelist", AllowListString: []string{"www.example.com"}},
+			[]string{"www.example.com"}, []string{"other.example.com"}},
+		{"policy case", ProxyConfig{}, ProxyConfig{Policy: "AllowList", AllowListString: []string{"www.example.com"}},
+			[]string{"www.example.com"}, []string{"other.example.com"}},
+		{"blocklist", ProxyConfig{}, ProxyConfig{Policy: PolicyBlockList, AllowListString: []string{"www.example.com"}},
+			[]string{"www.example.com", "other.example.com"}, nil},
+		{"IDN", ProxyConfig{}, ProxyConfig{Policy: PolicyAllowList, BlockByIDN: true, AllowListString: []string{"bücher.example"}},
+			[]string{"xn--bcher-kva.example", "XN--BCHER-KVA.example"}, []string{"other.example"}},
+		{"IDN from defaults", ProxyConfig{BlockByIDN: true}, ProxyConfig{Policy: PolicyAllowList, AllowListString: []string{"bücher.example"}},
+			[]string{"xn--bcher-kva.example"}, nil},
+		{"without IDN", ProxyConfig{}, ProxyConfig{Policy: PolicyAllowList, AllowListString: []string{"bücher.example"}},
+			nil, []string{"xn--bcher-kva.example"}},
+	}
+	for _, test := range tests {
+		rules := checkedRules(t, DefaultConfig{Proxy: test.defaults}, test.proxy)
+		// Plain HTTP and CONNECT requests are checked by the same allow list
+		for _, request := range []acl.Request{{Port: 80, Method: "GET", Scheme: "http"}, {Port: 443, Method: "CONNECT", Scheme: "https"}} {
+			for _, host := range test.allowed {
+				request.Host = host
+				if decision := rules.Evaluate(&request); !decision.Allowed() {
+					t.Errorf("%s: %s %s denied by %s", test.name, request.Method, host, decision.Rule.Name)
+				}
+			}
+			for _, host := range test.denied {
+				request.Host = host
+				if decision := rules.Evaluate(&request); decision.Allowed() || decision.Rule.Name != "allow" {
+					t.Errorf("%s: %s %s not denied by the allow list", test.name, request.Method, host)
+				}
+			}
+		}
+	}
+}
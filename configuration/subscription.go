@@ -0,0 +1,83 @@
+package configuration
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"github.com/COSAE-FR/riproxy/domains"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+const defaultSubscriptionInterval = time.Hour
+const minSubscriptionInterval = time.Minute
+const DefaultCacheDirectory = "/var/cache/riproxy"
+
+type SubscriptionConfig struct {
+	Url             string              `yaml:"url"`
+	IntervalString  string              `yaml:"interval"`
+	Interval        time.Duration       `yaml:"-"`
+	Format          string              `yaml:"format"`
+	ListFormat      domains.Format      `yaml:"-"`
+	PublicKeyString string              `yaml:"public_key"`
+	PublicKey       ed25519.PublicKey   `yaml:"-"`
+	SignatureUrl    string              `yaml:"signature_url"`
+	Cache           string              `yaml:"cache"`
+	Category        string              `yaml:"category"`
+	BlockByIDN      bool                `yaml:"-"`
+	Tree            *domains.AtomicTree `yaml:"-"`
+}
+
+func (c *SubscriptionConfig) check(name string, blockByIDN bool, logger *log.Entry) error {
+	parsed, err := url.Parse(c.Url)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return fmt.Errorf("invalid subscription URL: %s", c.Url)
+	}
+	c.Interval = defaultSubscriptionInterval
+	if len(c.IntervalString) > 0 {
+		c.Interval, err = time.ParseDuration(c.IntervalString)
+		if err != nil {
+			return fmt.Errorf("invalid subscription interval: %s", c.IntervalString)
+		}
+		if c.Interval < minSubscriptionInterval {
+			logger.Warnf("subscription %s interval too short, using %s", name, minSubscriptionInterval)
+			c.Interval = minSubscriptionInterval
+		}
+	}
+	c.ListFormat, err = domains.ParseFormat(c.Format)
+	if err != nil {
+		return err
+	}
+	if len(c.PublicKeyString) > 0 {
+		key, err := base64.StdEncoding.DecodeString(c.PublicKeyString)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid ed25519 public key for subscription %s", name)
+		}
+		c.PublicKey = key
+		if len(c.SignatureUrl) == 0 {
+			c.SignatureUrl = c.Url + ".sig"
+		}
+	}
+	if len(c.Cache) == 0 {
+		c.Cache = filepath.Join(DefaultCacheDirectory, name+".list")
+	}
+	c.BlockByIDN = blockByIDN
+	c.Tree = domains.NewAtomic(nil)
+	return nil
+}
+
+// subscriptionTrees returns the trees of the named subscriptions
+func (c *DefaultConfig) subscriptionTrees(names []string, logger *log.Entry) []domains.DomainTree {
+	var trees []domains.DomainTree
+	for _, name := range names {
+		subscription, ok := c.Subscriptions[name]
+		if !ok || subscription.Tree == nil {
+			logger.Errorf("unknown block list subscription %s, skipping", name)
+			continue
+		}
+		trees = append(trees, subscription.Tree)
+	}
+	return trees
+}
@@ -0,0 +1,84 @@
+package configuration
+
+import (
+	"fmt"
+	"github.com/COSAE-FR/riproxy/acl"
+	"github.com/COSAE-FR/riproxy/upstream"
+	log "github.com/sirupsen/logrus"
+)
+
+// UpstreamRouteConfig sends the requests matching the rule conditions to parents, the action of the rule is not used
+type UpstreamRouteConfig struct {
+	RuleConfig `yaml:",inline"`
+	Parents    []string `yaml:"parents"`
+	Direct     bool     `yaml:"direct"`
+}
+
+type UpstreamConfig struct {
+	Parents              map[string]string     `yaml:"parents"`
+	Routes               []UpstreamRouteConfig `yaml:"routes"`
+	HealthIntervalString string                `yaml:"health_check_interval"`
+	HealthTimeoutString  string                `yaml:"health_check_timeout"`
+	Router               *upstream.Router      `yaml:"-"`
+}
+
+func (c *UpstreamConfig) check(blockByIDN bool, resolver acl.Resolver, logger *log.Entry) error {
+	parents := map[string]*upstream.Parent{}
+	var parentList []*upstream.Parent
+	for name, rawURL := range c.Parents {
+		if name == upstream.Direct {
+			return fmt.Errorf("reserved parent proxy name: %s", name)
+		}
+		parent, err := upstream.ParseParent(name, rawURL)
+		if err != nil {
+			return fmt.Errorf("parent proxy %s: %s", name, err)
+		}
+		parents[name] = parent
+		parentList = append(parentList, parent)
+	}
+	var routes []*upstream.Route
+	for index, routeConfig := range c.Routes {
+		name := fmt.Sprintf("upstream:%d", index+1)
+		if len(routeConfig.Name) > 0 {
+			name = routeConfig.Name
+		}
+		routeConfig.Action = "allow"
+		rule, err := routeConfig.compile(name, blockByIDN)
+		if err != nil {
+			return fmt.Errorf("upstream route %s: %s", name, err)
+		}
+		route := &upstream.Route{Name: rule.Name, Rule: rule, Direct: routeConfig.Direct}
+		for _, parentName := range routeConfig.Parents {
+			parent, ok := parents[parentName]
+			if !ok {
+				return fmt.Errorf("upstream route %s: unknown parent proxy %s", route.Name, parentName)
+			}
+			route.Parents = append(route.Parents, parent)
+		}
+		if len(route.Parents) == 0 && !route.Direct {
+			return fmt.Errorf("upstream route %s: no parent proxy and no direct connection", route.Name)
+		}
+		routes = append(routes, route)
+	}
+	c.Router = upstream.New(parentList, routes, resolver, logger)
+	var err error
+	if c.Router.HealthInterval, err = parseDuration(c.HealthIntervalString, upstream.DefaultHealthInterval, "upstream health_check_interval"); err != nil {
+		return err
+	}
+	if c.Router.HealthTimeout, err = parseDuration(c.HealthTimeoutString, upstream.DefaultHealthTimeout, "upstream health_check_timeout"); err != nil {
+		return err
+	}
+	if c.Router.HealthInterval == 0 {
+		return fmt.Errorf("invalid upstream health_check_interval: %s", c.HealthIntervalString)
+	}
+	logger.Infof("loaded %d parent proxies and %d upstream routes", len(parentList), len(routes))
+	return nil
+}
+
+// UpstreamRouter returns the router of the parent proxies, nil if every request is sent directly
+func (c *DefaultConfig) UpstreamRouter() *upstream.Router {
+	if c == nil || c.Upstream == nil {
+		return nil
+	}
+	return c.Upstream.Router
+}
@@ -0,0 +1,92 @@
+package domains
+
+import "sync/atomic"
+
+// AtomicTree holds a DomainTree that can be replaced while it is being read
+type AtomicTree struct {
+	value atomic.Value
+}
+
+type treeHolder struct {
+	tree DomainTree
+}
+
+func NewAtomic(tree DomainTree) *AtomicTree {
+	atomicTree := &AtomicTree{}
+	atomicTree.Swap(tree)
+	return atomicTree
+}
+
+// Swap atomically replaces the current tree
+func (a *AtomicTree) Swap(tree DomainTree) {
+	a.value.Store(treeHolder{tree: tree})
+}
+
+// Load returns the current tree, it may be nil
+func (a *AtomicTree) Load() DomainTree {
+	holder, _ := a.value.Load().(treeHolder)
+	return holder.tree
+}
+
+// Put adds key to the current tree, it is not safe to call while the tree is read
+func (a *AtomicTree) Put(key string) {
+	if tree := a.Load(); tree != nil {
+		tree.Put(key)
+	}
+}
+
+// PutEntry adds entry to the current tree, it is not safe to call while the tree is read
+func (a *AtomicTree) PutEntry(entry Entry) {
+	if tree := a.Load(); tree != nil {
+		tree.PutEntry(entry)
+	}
+}
+
+// Delete removes key from the current tree, it is not safe to call while the tree is read
+func (a *AtomicTree) Delete(key string) bool {
+	if tree := a.Load(); tree != nil {
+		return tree.Delete(key)
+	}
+	return false
+}
+
+func (a *AtomicTree) Len() int {
+	if tree := a.Load(); tree != nil {
+		return tree.Len()
+	}
+	return 0
+}
+
+func (a *AtomicTree) Walk(fn func(entry Entry) bool) {
+	if tree := a.Load(); tree != nil {
+		tree.Walk(fn)
+	}
+}
+
+func (a *AtomicTree) Get(key string) bool {
+	if tree := a.Load(); tree != nil {
+		return tree.Get(key)
+	}
+	return false
+}
+
+func (a *AtomicTree) Lookup(key string) *Entry {
+	if tree := a.Load(); tree != nil {
+		return tree.Lookup(key)
+	}
+	return nil
+}
+
+func (a *AtomicTree) LookupPort(host string, port uint16) *Entry {
+	if tree := a.Load(); tree != nil {
+		return tree.LookupPort(host, port)
+	}
+	return nil
+}
+
+func (a *AtomicTree) Dump() string {
+	if tree := a.Load(); tree != nil {
+		return tree.Dump()
+	}
+	return ""
+}
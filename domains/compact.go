@@ -0,0 +1,326 @@
+package domains
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A compact tree is a read-only DomainTree stored as a sorted array of domains with reversed labels
+// (www.example.com is stored as com.example.www). All the keys share a single string and each record
+// uses 8 bytes, it avoids the maps and pointers of the node trie for lists of several million entries.
+// A lookup is a binary search for each label of the searched domain.
+
+const (
+	compactKindBits      = 2
+	compactExceptionFlag = 1 << compactKindBits
+	compactOriginShift   = compactKindBits + 1
+	maxCompactOrigins    = 1 << (32 - compactOriginShift)
+)
+
+// origin is the source and category shared by many entries
+type origin struct {
+	source   string
+	category string
+}
+
+type compactRecord struct {
+	key   string
+	meta  uint32 // kind, exception flag and origin index
+	ports PortRanges
+}
+
+// same returns true if both records have the same domain, kind and ports, the last one overrides the other
+func (r compactRecord) same(other compactRecord) bool {
+	return r.key == other.key && compactKind(r.meta) == compactKind(other.meta) && r.ports.String() == other.ports.String()
+}
+
+type compact struct {
+	keys      string
+	ends      []uint32 // end offset of each key in keys
+	metas     []uint32
+	ports     map[uint32]PortRanges // port qualifiers by record, they are uncommon
+	origins   []origin
+	formatter func(string) string
+	idn       bool
+}
+
+// CompactBuilder collects the entries of a compact tree, it can be used with Load
+type CompactBuilder struct {
+	records   []compactRecord
+	origins   []origin
+	index     map[origin]uint32
+	formatter func(string) string
+	idn       bool
+	err       error
+}
+
+func NewCompactBuilder() *CompactBuilder {
+	return &CompactBuilder{formatter: strings.ToLower, index: map[origin]uint32{}}
+}
+
+func NewIDNACompactBuilder() *CompactBuilder {
+	return &CompactBuilder{formatter: idnaFormatter, idn: true, index: map[origin]uint32{}}
+}
+
+func reverseLabels(domain string) string {
+	var builder strings.Builder
+	builder.Grow(len(domain))
+	for part, i := domainSegmenter(domain, 0); part != ""; part, i = domainSegmenter(domain, i) {
+		if builder.Len() > 0 {
+			builder.WriteByte('.')
+		}
+		builder.WriteString(part)
+	}
+	return builder.String()
+}
+
+func (b *CompactBuilder) Put(key string) {
+	b.PutEntry(Entry{Pattern: key, Source: SourceInline})
+}
+
+// PutEntry adds an entry to the builder, it accepts the same patterns as the node trie
+func (b *CompactBuilder) PutEntry(entry Entry) {
+	domain, kind, exception, ports := parsePattern(entry.Pattern)
+	key := reverseLabels(b.formatter(domain))
+	if index := strings.Index(key+".", "*."); index == 0 || index > 0 && key[index-1] == '.' {
+		// Wildcard label inside the domain, everything after it is ignored like in the node trie
+		key, kind = strings.TrimSuffix(key[:index], "."), kindWildcard
+	}
+	b.add(key, kind, exception, ports, origin{source: entry.Source, category: entry.Category})
+}
+
+// add appends a record, key is the formatted domain with reversed labels
+func (b *CompactBuilder) add(key string, kind entryKind, exception bool, ports PortRanges, o origin) {
+	originIndex, ok := b.index[o]
+	if !ok {
+		if len(b.origins) >= maxCompactOrigins {
+			b.err = fmt.Errorf("too many sources and categories in compact tree")
+			return
+		}
+		originIndex = uint32(len(b.origins))
+		b.origins = append(b.origins, o)
+		b.index[o] = originIndex
+	}
+	meta := uint32(kind) | originIndex<<compactOriginShift
+	if exception {
+		meta |= compactExceptionFlag
+	}
+	b.records = append(b.records, compactRecord{key: key, meta: meta, ports: ports})
+}
+
+func compactKind(meta uint32) entryKind {
+	return entryKind(meta & (compactExceptionFlag - 1))
+}
+
+// Build returns the compiled tree, the builder must not be used afterwards.
+// As in the node trie, the last entry with the same domain, kind and ports wins.
+func (b *CompactBuilder) Build() (DomainTree, error) {
+	tree, err := b.build()
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+func (b *CompactBuilder) build() (*compact, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	records := b.records
+	b.records = nil
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].key != records[j].key {
+			return records[i].key < records[j].key
+		}
+		if compactKind(records[i].meta) != compactKind(records[j].meta) {
+			return compactKind(records[i].meta) < compactKind(records[j].meta)
+		}
+		// Records restricted to ports first, they win over the other records of the same kind
+		if (len(records[i].ports) > 0) != (len(records[j].ports) > 0) {
+			return len(records[i].ports) > 0
+		}
+		return records[i].ports.String() < records[j].ports.String()
+	})
+	tree := &compact{origins: b.origins, formatter: b.formatter, idn: b.idn}
+	size := 0
+	count := 0
+	for i := range records {
+		if i+1 < len(records) && records[i+1].same(records[i]) {
+			continue
+		}
+		size += len(records[i].key)
+		count++
+	}
+	var keys strings.Builder
+	keys.Grow(size)
+	tree.ends = make([]uint32, 0, count)
+	tree.metas = make([]uint32, 0, count)
+	for i := range records {
+		if i+1 < len(records) && records[i+1].same(records[i]) {
+			continue // Overridden by the next entry
+		}
+		if len(records[i].ports) > 0 {
+			if tree.ports == nil {
+				tree.ports = map[uint32]PortRanges{}
+			}
+			tree.ports[uint32(len(tree.ends))] = records[i].ports
+		}
+		keys.WriteString(records[i].key)
+		if keys.Len() > int(^uint32(0)) {
+			return nil, fmt.Errorf("compact tree larger than 4GB")
+		}
+		tree.ends = append(tree.ends, uint32(keys.Len()))
+		tree.metas = append(tree.metas, records[i].meta)
+	}
+	tree.keys = keys.String()
+	return tree, nil
+}
+
+// NewCompactFromList compiles a read-only tree from a list of patterns
+func NewCompactFromList(list []string) DomainTree {
+	return newCompactFromList(NewCompactBuilder(), list)
+}
+
+// NewIDNACompactFromList compiles a read-only tree from a list of patterns normalized in IDN format
+func NewIDNACompactFromList(list []string) DomainTree {
+	return newCompactFromList(NewIDNACompactBuilder(), list)
+}
+
+func newCompactFromList(builder *CompactBuilder, list []string) DomainTree {
+	if list != nil && len(list) > 0 {
+		for _, domain := range list {
+			builder.Put(domain)
+		}
+		tree, err := builder.Build()
+		if err == nil {
+			return tree
+		}
+	}
+	return nil
+}
+
+func (c *compact) key(i int) string {
+	start := uint32(0)
+	if i > 0 {
+		start = c.ends[i-1]
+	}
+	return c.keys[start:c.ends[i]]
+}
+
+// find returns the range of records stored for key
+func (c *compact) find(key string) (int, int) {
+	start := sort.Search(len(c.ends), func(i int) bool {
+		return c.key(i) >= key
+	})
+	end := start
+	for end < len(c.ends) && c.key(end) == key {
+		end++
+	}
+	return start, end
+}
+
+// match returns the record of kind matching port in a range, records restricted to the port win
+func (c *compact) match(start int, end int, kind entryKind, port uint16) int {
+	for i := start; i < end; i++ {
+		if compactKind(c.metas[i]) != kind {
+			continue
+		}
+		ports, restricted := c.ports[uint32(i)]
+		if !restricted || port != 0 && ports.Contains(port) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (c *compact) entry(i int) *Entry {
+	meta := c.metas[i]
+	o := c.origins[meta>>compactOriginShift]
+	entry := &Entry{
+		Source:    o.source,
+		Category:  o.category,
+		Exception: meta&compactExceptionFlag != 0,
+		Ports:     c.ports[uint32(i)],
+	}
+	entry.Pattern = formatPattern(reverseLabels(c.key(i)), compactKind(meta), entry)
+	return entry
+}
+
+// The tree is read-only, Put, PutEntry and Delete are ignored. Wrap it with NewSafe to modify it.
+func (c *compact) Put(string) {}
+
+func (c *compact) PutEntry(Entry) {}
+
+func (c *compact) Delete(string) bool {
+	return false
+}
+
+func (c *compact) Get(key string) bool {
+	return c.Lookup(key) != nil
+}
+
+// Lookup has the same semantics as the node trie, the longest parent with an entry wins.
+// The pattern of the returned entry is normalized: ||example.com is returned as .example.com
+func (c *compact) Lookup(key string) *Entry {
+	return c.LookupPort(splitHostPort(key))
+}
+
+func (c *compact) LookupPort(host string, port uint16) *Entry {
+	key := reverseLabels(c.formatter(trimDots(host)))
+	if len(key) == 0 {
+		return nil
+	}
+	start, end := c.find(key)
+	if i := c.match(start, end, kindExact, port); i >= 0 {
+		return matchedEntry(c.entry(i))
+	}
+	if i := c.match(start, end, kindApex, port); i >= 0 {
+		return matchedEntry(c.entry(i))
+	}
+	for dot := strings.LastIndexByte(key, '.'); ; dot = strings.LastIndexByte(key[:dot], '.') {
+		parent := ""
+		if dot > 0 {
+			parent = key[:dot]
+		}
+		start, end = c.find(parent)
+		if i := c.match(start, end, kindWildcard, port); i >= 0 {
+			return matchedEntry(c.entry(i))
+		}
+		if i := c.match(start, end, kindApex, port); i >= 0 {
+			return matchedEntry(c.entry(i))
+		}
+		if dot <= 0 {
+			return nil
+		}
+	}
+}
+
+// walk calls fn for every entry of the tree, in the order of the reversed domains, until fn returns false
+func (c *compact) walk(fn func(domain string, kind entryKind, entry *Entry) bool) {
+	for i := range c.ends {
+		if !fn(reverseLabels(c.key(i)), compactKind(c.metas[i]), c.entry(i)) {
+			return
+		}
+	}
+}
+
+func (c *compact) Walk(fn func(entry Entry) bool) {
+	c.walk(func(domain string, kind entryKind, entry *Entry) bool {
+		return fn(*entry)
+	})
+}
+
+func (c *compact) Len() int {
+	return len(c.ends)
+}
+
+// Dump renders the entries like the node trie, in the order of the reversed domains
+func (c *compact) Dump() string {
+	var builder strings.Builder
+	c.walk(func(domain string, kind entryKind, entry *Entry) bool {
+		dumpEntry(&builder, domain, kind, entry)
+		return true
+	})
+	return builder.String()
+}
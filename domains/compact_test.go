@@ -0,0 +1,75 @@
+package domains
+
+import (
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	list := []string{
+		"test.exampLe.com",
+		"*.example.org",
+		"!login.example.org",
+		"!*.cdn.example.org",
+		"ads.cdn.example.org",
+		".example.net",
+		"||example.info^",
+		"a.*.example.biz",
+	}
+	tree := NewCompactFromList(list)
+	reference := NewFromList(list)
+	domains := []string{
+		"test.example.com", "TEST.example.com.", "sub.test.example.com", "example.com", "com",
+		"example.org", "www.example.org", "login.example.org", "sub.login.example.org",
+		"cdn.example.org", "img.cdn.example.org", "ads.cdn.example.org",
+		"example.net", "www.example.net", "example.info", "www.example.info",
+		"example.biz", "a.example.biz", "b.a.example.biz",
+	}
+	for _, domain := range domains {
+		if found, expected := tree.Get(domain), reference.Get(domain); found != expected {
+			t.Errorf("Wrong result for %s: %v instead of %v", domain, found, expected)
+		}
+	}
+	if entry := tree.Lookup("www.example.net"); entry == nil || entry.Pattern != ".example.net" || entry.Source != SourceInline {
+		t.Fatalf("Wrong apex entry %+v", entry)
+	}
+}
+
+func TestCompactEntries(t *testing.T) {
+	builder := NewIDNACompactBuilder()
+	builder.PutEntry(Entry{Pattern: "*.éxample.com", Source: "ads.txt", Category: "ads"})
+	builder.PutEntry(Entry{Pattern: "example.org", Source: "a.txt"})
+	builder.PutEntry(Entry{Pattern: "example.org", Source: "b.txt"})
+	tree, err := builder.Build()
+	if err != nil {
+		t.Fatalf("Cannot build tree: %s", err)
+	}
+	entry := tree.Lookup("test.éxample.com")
+	if entry == nil || entry.Pattern != "*.xn--xample-9ua.com" || entry.Source != "ads.txt" || entry.Category != "ads" {
+		t.Fatalf("Wrong IDN entry %+v", entry)
+	}
+	if entry = tree.Lookup("example.org"); entry == nil || entry.Source != "b.txt" {
+		t.Fatalf("Last entry should win, got %+v", entry)
+	}
+	expected := `*.xn--xample-9ua.com (subdomains, ads.txt)
+example.org (exact, b.txt)
+`
+	if dump := tree.Dump(); dump != expected {
+		t.Fatalf("Wrong dump:\n%s", dump)
+	}
+}
+
+func TestCompactRandom(t *testing.T) {
+	tree := NewIDNACompactFromList(pathKeys[:])
+	reference := NewIDNAFromList(pathKeys[:])
+	for _, domain := range pathKeys {
+		if !tree.Get(domain) {
+			t.Fatalf("Cannot find domain %s", domain)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		domain := randDomain(partsPerKey, bytesPerPart)
+		if found, expected := tree.Get(domain), reference.Get(domain); found != expected {
+			t.Fatalf("Wrong result for %s: %v instead of %v", domain, found, expected)
+		}
+	}
+}
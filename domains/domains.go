@@ -2,6 +2,7 @@ package domains
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -29,16 +30,73 @@ func trimDots(s string) string {
 	return s
 }
 
+// Entry describes the list entry matched by a lookup
+type Entry struct {
+	Pattern   string     // entry as written in the list
+	Source    string     // origin of the entry: inline, file name or subscription
+	Category  string     // optional category label
+	Exception bool       // the entry carves a domain out of a wildcard
+	Ports     PortRanges // ports the entry applies to, every port if empty
+}
+
+const SourceInline = "inline"
+
 type DomainTree interface {
 	Put(key string)
+	PutEntry(entry Entry)
+	Delete(key string) bool
 	Get(key string) bool
+	Lookup(key string) *Entry
+	LookupPort(host string, port uint16) *Entry
+	Len() int
+	Walk(fn func(entry Entry) bool)
 	Dump() string
 }
 
+type entryKind int
+
+const (
+	kindExact    entryKind = iota // example.com
+	kindWildcard                  // *.example.com, subdomains only
+	kindApex                      // .example.com or ||example.com, domain and subdomains
+)
+
+// parsePattern splits a list pattern in its domain, kind, exception flag and port qualifier
+func parsePattern(pattern string) (domain string, kind entryKind, exception bool, ports PortRanges) {
+	if strings.HasPrefix(pattern, "!") {
+		exception = true
+		pattern = pattern[1:]
+	}
+	switch {
+	case strings.HasPrefix(pattern, "||"):
+		kind = kindApex
+		pattern = strings.TrimSuffix(pattern[2:], "^")
+	case strings.HasPrefix(pattern, "*."):
+		kind = kindWildcard
+		pattern = pattern[2:]
+	case strings.HasPrefix(pattern, "."):
+		kind = kindApex
+		pattern = pattern[1:]
+	}
+	pattern, ports = splitPortQualifier(pattern)
+	return strings.TrimSuffix(pattern, "."), kind, exception, ports
+}
+
+// portEntry is an entry restricted to some ports
+type portEntry struct {
+	kind  entryKind
+	entry *Entry
+}
+
 type node struct {
-	andChildren bool
-	children    map[string]*node
-	formatter   func(string) string
+	entry     *Entry // exact match
+	wildcard  *Entry // matches every subdomain
+	apex      *Entry // matches the domain and every subdomain
+	ports     []portEntry
+	children  map[string]*node
+	formatter func(string) string
+	idn       bool
+	size      int // number of entries, only maintained on the root
 }
 
 func New() DomainTree {
@@ -59,17 +117,59 @@ func NewFromList(list []string) DomainTree {
 }
 
 func (trie *node) Put(key string) {
-	key = trimDots(key)
+	trie.PutEntry(Entry{Pattern: key, Source: SourceInline})
+}
+
+// slot returns the field holding the entries of kind
+func (trie *node) slot(kind entryKind) **Entry {
+	switch kind {
+	case kindWildcard:
+		return &trie.wildcard
+	case kindApex:
+		return &trie.apex
+	}
+	return &trie.entry
+}
+
+func (trie *node) isEmpty() bool {
+	return trie.entry == nil && trie.wildcard == nil && trie.apex == nil && len(trie.ports) == 0 && len(trie.children) == 0
+}
+
+// portEntry returns the index of the port entry of kind with the same ports as entry
+func (trie *node) portEntry(kind entryKind, entry *Entry) int {
+	ports := entry.Ports.String()
+	for i, ported := range trie.ports {
+		if ported.kind == kind && ported.entry.Ports.String() == ports {
+			return i
+		}
+	}
+	return -1
+}
+
+// find returns the entry of kind matching port, entries restricted to the port win
+func (trie *node) find(kind entryKind, port uint16) *Entry {
+	if port != 0 {
+		for _, ported := range trie.ports {
+			if ported.kind == kind && ported.entry.Ports.Contains(port) {
+				return ported.entry
+			}
+		}
+	}
+	return *trie.slot(kind)
+}
+
+// PutEntry adds an entry, patterns starting with ! are exceptions
+// and patterns ending with a port qualifier (example.com:80,8000-8100) only apply to these ports
+func (trie *node) PutEntry(entry Entry) {
+	key, kind, exception, ports := parsePattern(entry.Pattern)
+	entry.Exception = exception
+	entry.Ports = ports
 	key = trie.formatter(key)
 	currentNode := trie
 	for part, i := domainSegmenter(key, 0); part != ""; part, i = domainSegmenter(key, i) {
-		if currentNode.andChildren {
-			return
-		}
 		if part == "*" {
-			currentNode.andChildren = true
-			currentNode.children = nil
-			return
+			kind = kindWildcard
+			break
 		}
 		child, _ := currentNode.children[part]
 		if child == nil {
@@ -81,32 +181,197 @@ func (trie *node) Put(key string) {
 		}
 		currentNode = child
 	}
+	if len(entry.Ports) > 0 {
+		if index := currentNode.portEntry(kind, &entry); index >= 0 {
+			currentNode.ports[index].entry = &entry
+		} else {
+			currentNode.ports = append(currentNode.ports, portEntry{kind: kind, entry: &entry})
+			trie.size++
+		}
+		return
+	}
+	slot := currentNode.slot(kind)
+	if *slot == nil {
+		trie.size++
+	}
+	*slot = &entry
+}
+
+// Delete removes the entry added with the pattern key, it returns false if there is no such entry
+func (trie *node) Delete(key string) bool {
+	key, kind, exception, ports := parsePattern(key)
+	key = trie.formatter(key)
+	path := []*node{trie}
+	var labels []string
+	currentNode := trie
+	for part, i := domainSegmenter(key, 0); part != ""; part, i = domainSegmenter(key, i) {
+		if part == "*" {
+			kind = kindWildcard
+			break
+		}
+		currentNode = currentNode.children[part]
+		if currentNode == nil {
+			return false
+		}
+		path = append(path, currentNode)
+		labels = append(labels, part)
+	}
+	if len(ports) > 0 {
+		index := currentNode.portEntry(kind, &Entry{Ports: ports})
+		if index < 0 || currentNode.ports[index].entry.Exception != exception {
+			return false
+		}
+		currentNode.ports = append(currentNode.ports[:index], currentNode.ports[index+1:]...)
+	} else {
+		slot := currentNode.slot(kind)
+		if *slot == nil || (*slot).Exception != exception {
+			return false
+		}
+		*slot = nil
+	}
+	trie.size--
+	// Remove the nodes left empty
+	for i := len(path) - 1; i > 0 && path[i].isEmpty(); i-- {
+		delete(path[i-1].children, labels[i-1])
+	}
+	return true
+}
+
+func (trie *node) Len() int {
+	return trie.size
 }
 
 func (trie *node) Get(key string) bool {
-	key = trimDots(key)
+	return trie.Lookup(key) != nil
+}
+
+func matchedEntry(entry *Entry) *Entry {
+	if entry == nil || entry.Exception {
+		return nil
+	}
+	return entry
+}
+
+// Lookup returns the most specific entry matching key, a domain optionally followed by a port.
+// Exact entries win over apex entries and apex entries win over the wildcards of their parents.
+// It returns nil if no entry matches or if the most specific entry is an exception.
+func (trie *node) Lookup(key string) *Entry {
+	return trie.LookupPort(splitHostPort(key))
+}
+
+// LookupPort returns the most specific entry matching host and port, a zero port only matches entries without ports.
+// On the same domain, the entries restricted to the port win over the other ones.
+func (trie *node) LookupPort(host string, port uint16) *Entry {
+	key := trimDots(host)
+	var wildcard *Entry
 	currentNode := trie
 	for part, i := domainSegmenter(key, 0); part != ""; part, i = domainSegmenter(key, i) {
-		if len(part) > 0 && currentNode.andChildren {
-			return true
+		if entry := currentNode.find(kindWildcard, port); entry != nil {
+			wildcard = entry
+		} else if entry := currentNode.find(kindApex, port); entry != nil {
+			wildcard = entry
 		}
 		part = trie.formatter(part)
 		currentNode = currentNode.children[part]
 		if currentNode == nil {
+			return matchedEntry(wildcard)
+		}
+	}
+	if entry := currentNode.find(kindExact, port); entry != nil {
+		return matchedEntry(entry)
+	}
+	if entry := currentNode.find(kindApex, port); entry != nil {
+		return matchedEntry(entry)
+	}
+	return matchedEntry(wildcard)
+}
+
+// walk calls fn for every entry of the tree, sorted by domain, until fn returns false
+func (trie *node) walk(domain string, fn func(domain string, kind entryKind, entry *Entry) bool) bool {
+	for _, kind := range []entryKind{kindExact, kindWildcard, kindApex} {
+		for _, ported := range trie.ports {
+			if ported.kind == kind && !fn(domain, kind, ported.entry) {
+				return false
+			}
+		}
+		if entry := *trie.slot(kind); entry != nil && !fn(domain, kind, entry) {
 			return false
 		}
 	}
-	return currentNode.children == nil && !currentNode.andChildren
+	names := make([]string, 0, len(trie.children))
+	for name := range trie.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		child := name
+		if len(domain) > 0 {
+			child = name + "." + domain
+		}
+		if !trie.children[name].walk(child, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// Walk calls fn for every entry of the tree until fn returns false, the patterns of the entries are normalized
+func (trie *node) Walk(fn func(entry Entry) bool) {
+	trie.walk("", func(domain string, kind entryKind, entry *Entry) bool {
+		return fn(normalizedEntry(domain, kind, entry))
+	})
 }
 
+// Dump renders the entries of the tree, one per line, sorted by domain:
+// exact entries as example.com, wildcards as *.example.com and apex entries as .example.com.
+// Exceptions are prefixed with !
 func (trie *node) Dump() string {
-	result := ""
-	currentNode := trie
-	if currentNode.children != nil {
-		for name, n := range currentNode.children {
-			result += fmt.Sprintf("%s: is wildcard: %v", name, n.andChildren)
-			result += fmt.Sprintf("\n %s", n.Dump())
+	var builder strings.Builder
+	trie.walk("", func(domain string, kind entryKind, entry *Entry) bool {
+		dumpEntry(&builder, domain, kind, entry)
+		return true
+	})
+	return builder.String()
+}
+
+var entryKindDescriptions = map[entryKind]string{
+	kindExact:    "exact",
+	kindApex:     "domain and subdomains",
+	kindWildcard: "subdomains",
+}
+
+// formatPattern returns the normalized pattern of an entry
+func formatPattern(domain string, kind entryKind, entry *Entry) string {
+	pattern := domain
+	switch kind {
+	case kindWildcard:
+		if len(domain) == 0 {
+			pattern = "*"
+		} else {
+			pattern = "*." + domain
 		}
+	case kindApex:
+		pattern = "." + domain
+	}
+	if entry.Exception {
+		pattern = "!" + pattern
+	}
+	if len(entry.Ports) > 0 {
+		pattern += ":" + entry.Ports.String()
+	}
+	return pattern
+}
+
+func normalizedEntry(domain string, kind entryKind, entry *Entry) Entry {
+	normalized := *entry
+	normalized.Pattern = formatPattern(domain, kind, entry)
+	return normalized
+}
+
+func dumpEntry(builder *strings.Builder, domain string, kind entryKind, entry *Entry) {
+	description := entryKindDescriptions[kind]
+	if len(domain) == 0 && kind == kindWildcard {
+		description = "any domain"
 	}
-	return result
+	_, _ = fmt.Fprintf(builder, "%s (%s, %s)\n", formatPattern(domain, kind, entry), description, entry.Source)
 }
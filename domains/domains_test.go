@@ -2,6 +2,8 @@ package domains
 
 import (
 	"math/rand"
+	"runtime"
+	"sync"
 	"testing"
 )
 
@@ -42,6 +44,171 @@ func TestWildcardDomain(t *testing.T) {
 	}
 }
 
+func TestApexDomain(t *testing.T) {
+	for _, pattern := range []string{".exampLe.com", "||example.com", "||example.com^"} {
+		tree := New()
+		tree.Put(pattern)
+		for _, domain := range []string{"example.com", "example.com.", "test.example.com", "sub.test.example.com"} {
+			if found := tree.Get(domain); found == false {
+				t.Fatalf("Cannot find domain %s with %s", domain, pattern)
+			}
+		}
+		if found := tree.Get("com"); found == true {
+			t.Fatalf("Found domain %s with %s", "com", pattern)
+		}
+	}
+	tree := New()
+	tree.Put(".example.com")
+	tree.Put("!.login.example.com")
+	if found := tree.Get("login.example.com"); found == true {
+		t.Fatalf("Found domain %s", "login.example.com")
+	}
+	if found := tree.Get("sub.login.example.com"); found == true {
+		t.Fatalf("Found domain %s", "sub.login.example.com")
+	}
+}
+
+func TestDump(t *testing.T) {
+	tree := New()
+	tree.Put("example.com")
+	tree.Put("*.example.com")
+	tree.Put(".example.org")
+	tree.Put("!login.example.org")
+	expected := `example.com (exact, inline)
+*.example.com (subdomains, inline)
+.example.org (domain and subdomains, inline)
+!login.example.org (exact, inline)
+`
+	if dump := tree.Dump(); dump != expected {
+		t.Fatalf("Wrong dump:\n%s", dump)
+	}
+}
+
+func TestPortQualifier(t *testing.T) {
+	list := []string{"example.com:8443", "*.corp.example:8000-8100", "*.example.org", "!*.example.org:80,443"}
+	for _, tree := range []DomainTree{NewFromList(list), NewCompactFromList(list)} {
+		matches := map[string]bool{
+			"example.com:8443":       true,
+			"example.com:443":        false,
+			"example.com":            false,
+			"www.corp.example:8000":  true,
+			"www.corp.example:8101":  false,
+			"www.example.org:8080":   true,
+			"www.example.org":        true,
+			"www.example.org:443":    false,
+			"[2001:db8::1]:8443":     false,
+			"example.com:not-a-port": false,
+		}
+		for key, expected := range matches {
+			if found := tree.Get(key); found != expected {
+				t.Errorf("%T: wrong result for %s: %v", tree, key, found)
+			}
+		}
+		if entry := tree.LookupPort("example.com", 8443); entry == nil || entry.Pattern != "example.com:8443" || len(entry.Ports) != 1 {
+			t.Errorf("%T: wrong entry %+v", tree, entry)
+		}
+	}
+	tree := New()
+	tree.Put("example.com:80")
+	tree.Put("example.com")
+	if tree.Len() != 2 || !tree.Delete("example.com:80") || tree.Delete("example.com:443") || !tree.Get("example.com:80") {
+		t.Fatalf("Wrong port qualified entries:\n%s", tree.Dump())
+	}
+}
+
+func TestDelete(t *testing.T) {
+	tree := New()
+	tree.Put("*.example.com")
+	tree.Put("!login.example.com")
+	tree.Put("www.test.example.com")
+	if tree.Len() != 3 {
+		t.Fatalf("Wrong length %d", tree.Len())
+	}
+	if tree.Delete("login.example.com") || tree.Delete("example.com") || tree.Delete("other.example.com") {
+		t.Fatalf("Deleted a missing entry")
+	}
+	if !tree.Delete("!login.example.com") || !tree.Get("login.example.com") {
+		t.Fatalf("Cannot delete exception")
+	}
+	if !tree.Delete("*.EXAMPLE.com") || tree.Get("login.example.com") {
+		t.Fatalf("Cannot delete wildcard")
+	}
+	if !tree.Delete("www.test.example.com") || tree.Len() != 0 {
+		t.Fatalf("Cannot delete entry")
+	}
+	if dump := tree.Dump(); dump != "" || len(tree.(*node).children) != 0 {
+		t.Fatalf("Empty nodes not removed: %s", dump)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	tree := New()
+	tree.Put("||example.org^")
+	tree.PutEntry(Entry{Pattern: "*.example.com", Source: "ads.txt"})
+	tree.Put("example.com")
+	var patterns []string
+	tree.Walk(func(entry Entry) bool {
+		patterns = append(patterns, entry.Pattern)
+		return true
+	})
+	if len(patterns) != 3 || patterns[0] != "example.com" || patterns[1] != "*.example.com" || patterns[2] != ".example.org" {
+		t.Fatalf("Wrong entries %v", patterns)
+	}
+	count := 0
+	tree.Walk(func(entry Entry) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Fatalf("Walk not stopped")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	tree := New()
+	tree.Put("*.example.com")
+	tree.PutEntry(Entry{Pattern: "ads.example.org", Source: "ads.txt", Category: "ads"})
+	tree.Put("example.org")
+	entry := tree.Lookup("www.example.com")
+	if entry == nil || entry.Pattern != "*.example.com" || entry.Source != SourceInline {
+		t.Fatalf("Wrong wildcard entry %+v", entry)
+	}
+	entry = tree.Lookup("ADS.example.org.")
+	if entry == nil || entry.Pattern != "ads.example.org" || entry.Source != "ads.txt" || entry.Category != "ads" {
+		t.Fatalf("Wrong exact entry %+v", entry)
+	}
+	if entry = tree.Lookup("example.org"); entry == nil || entry.Pattern != "example.org" {
+		t.Fatalf("Wrong parent entry %+v", entry)
+	}
+	if entry = tree.Lookup("www.example.org"); entry != nil {
+		t.Fatalf("Found entry %+v", entry)
+	}
+}
+
+func TestException(t *testing.T) {
+	tree := New()
+	tree.Put("*.example.com")
+	tree.Put("!login.example.com")
+	tree.Put("!*.cdn.example.com")
+	tree.Put("ads.cdn.example.com")
+	tree.Put("*.tracker.cdn.example.com")
+	blocked := []string{"www.example.com", "sub.login.example.com", "cdn.example.com", "ads.cdn.example.com", "a.tracker.cdn.example.com"}
+	allowed := []string{"example.com", "login.example.com", "LOGIN.example.com.", "img.cdn.example.com", "a.img.cdn.example.com", "tracker.cdn.example.com"}
+	for _, domain := range blocked {
+		if found := tree.Get(domain); found == false {
+			t.Fatalf("Cannot find domain %s", domain)
+		}
+	}
+	for _, domain := range allowed {
+		if found := tree.Get(domain); found == true {
+			t.Fatalf("Found domain %s", domain)
+		}
+	}
+	if entry := tree.Lookup("ads.cdn.example.com"); entry == nil || entry.Pattern != "ads.cdn.example.com" {
+		t.Fatalf("Wrong exact entry %+v", entry)
+	}
+}
+
 func TestIDNASimpleDomain(t *testing.T) {
 	tree := NewIDNA()
 	tree.Put("test.exampLe.com")
@@ -151,6 +318,15 @@ func BenchmarkNode_Get(b *testing.B) {
 	}
 }
 
+func BenchmarkCompact_Get(b *testing.B) {
+	tree := NewCompactFromList(pathKeys[:])
+	needle := pathKeys[rand.Intn(len(pathKeys))]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = tree.Get(needle)
+	}
+}
+
 func BenchmarkIDNANode_Get(b *testing.B) {
 	tree := NewIDNAFromList(pathKeys[:])
 	needle := pathKeys[rand.Intn(len(pathKeys))]
@@ -177,3 +353,69 @@ func BenchmarkIDNANode_NoGet(b *testing.B) {
 		_ = tree.Get(needle)
 	}
 }
+
+func BenchmarkCompact_NoGet(b *testing.B) {
+	tree := NewCompactFromList(pathKeys[:])
+	needle := randDomain(partsPerKey, bytesPerPart)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = tree.Get(needle)
+	}
+}
+
+// Large lists, similar to public threat feeds
+const largeKeysN = 1000000
+
+var largeKeys []string
+var largeKeysOnce sync.Once
+
+func getLargeKeys() []string {
+	largeKeysOnce.Do(func() {
+		largeKeys = make([]string, largeKeysN)
+		for i := range largeKeys {
+			largeKeys[i] = randDomain(partsPerKey, bytesPerPart)
+		}
+	})
+	return largeKeys
+}
+
+func benchmarkLargeBuild(b *testing.B, build func([]string) DomainTree) {
+	keys := getLargeKeys()
+	var before, after runtime.MemStats
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		tree := build(keys)
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(len(keys)), "heap-B/entry")
+		b.ReportMetric(float64(after.HeapObjects-before.HeapObjects), "heap-objects")
+		runtime.KeepAlive(tree)
+	}
+}
+
+func benchmarkLargeGet(b *testing.B, build func([]string) DomainTree) {
+	keys := getLargeKeys()
+	tree := build(keys)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = tree.Get(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkNode_BuildLarge(b *testing.B) {
+	benchmarkLargeBuild(b, NewFromList)
+}
+
+func BenchmarkCompact_BuildLarge(b *testing.B) {
+	benchmarkLargeBuild(b, NewCompactFromList)
+}
+
+func BenchmarkNode_GetLarge(b *testing.B) {
+	benchmarkLargeGet(b, NewFromList)
+}
+
+func BenchmarkCompact_GetLarge(b *testing.B) {
+	benchmarkLargeGet(b, NewCompactFromList)
+}
@@ -65,6 +65,7 @@ func idnaFormatter(key string) string {
 func NewIDNA() DomainTree {
 	return &node{
 		formatter: idnaFormatter,
+		idn:       true,
 	}
 }
 
@@ -0,0 +1,311 @@
+package domains
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+type Format string
+
+const (
+	FormatAuto    Format = "auto"
+	FormatPlain   Format = "domains"
+	FormatHosts   Format = "hosts"
+	FormatAdBlock Format = "adblock"
+	FormatRPZ     Format = "rpz"
+)
+
+func ParseFormat(format string) (Format, error) {
+	switch Format(strings.ToLower(format)) {
+	case "", FormatAuto:
+		return FormatAuto, nil
+	case FormatPlain, "plain":
+		return FormatPlain, nil
+	case FormatHosts:
+		return FormatHosts, nil
+	case FormatAdBlock, "abp":
+		return FormatAdBlock, nil
+	case FormatRPZ:
+		return FormatRPZ, nil
+	}
+	return FormatAuto, fmt.Errorf("unknown list format: %s", format)
+}
+
+// Names found in most hosts files, they are never loaded
+var hostsIgnored = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// EntryPutter receives the entries of a loaded list
+type EntryPutter interface {
+	PutEntry(entry Entry)
+}
+
+type LineError struct {
+	Source string
+	Line   int
+	Err    error
+}
+
+func (e LineError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Source, e.Line, e.Err)
+}
+
+type LoadResult struct {
+	Source  string
+	Entries int
+	Skipped int
+	Errors  []LineError
+}
+
+func validDomain(domain string) error {
+	if len(domain) == 0 {
+		return fmt.Errorf("empty domain")
+	}
+	if len(domain) > 253 {
+		return fmt.Errorf("domain too long: %s", domain)
+	}
+	for i, label := range strings.Split(domain, ".") {
+		if len(label) == 0 {
+			return fmt.Errorf("empty label in %s", domain)
+		}
+		if label == "*" && i == 0 {
+			continue
+		}
+		if len(label) > 63 {
+			return fmt.Errorf("label too long in %s", domain)
+		}
+		for _, c := range label {
+			if c >= utf8.RuneSelf { // Non ASCII labels are normalized by the IDN formatter
+				continue
+			}
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid character %q in %s", c, domain)
+			}
+		}
+	}
+	return nil
+}
+
+type listParser struct {
+	format  Format
+	origin  string
+	adblock bool // auto format: AdBlock rules were found, the lines starting with ! are comments
+}
+
+func stripComment(line string, markers string) string {
+	if index := strings.IndexAny(line, markers); index >= 0 {
+		line = line[:index]
+	}
+	return strings.TrimSpace(line)
+}
+
+// parse returns the domains found in a line, nil if the line holds no entry
+func (p *listParser) parse(line string) ([]string, error) {
+	trimmed := strings.TrimSpace(line)
+	if len(trimmed) == 0 {
+		return nil, nil
+	}
+	format := p.format
+	if format == FormatAuto {
+		format = p.detect(trimmed)
+	}
+	switch format {
+	case FormatHosts:
+		return p.parseHosts(trimmed)
+	case FormatAdBlock:
+		return p.parseAdBlock(trimmed)
+	case FormatRPZ:
+		return p.parseRPZ(line)
+	default:
+		domain := stripComment(trimmed, "#")
+		if len(domain) == 0 {
+			return nil, nil
+		}
+		return []string{domain}, nil
+	}
+}
+
+func (p *listParser) detect(line string) Format {
+	switch {
+	case strings.HasPrefix(line, "||"), strings.HasPrefix(line, "@@"), len(line) >= 8 && strings.EqualFold(line[:8], "[Adblock"):
+		p.adblock = true
+		return FormatAdBlock
+	case strings.HasPrefix(line, "!"):
+		// A domain after the mark is an exception of a plain list, AdBlock comments are free text
+		if !p.adblock && plainException(line) {
+			return FormatPlain
+		}
+		return FormatAdBlock
+	case strings.HasPrefix(line, "["):
+		return FormatAdBlock
+	case strings.HasPrefix(line, "$"), strings.HasPrefix(line, ";"):
+		return FormatRPZ
+	}
+	fields := strings.Fields(stripComment(line, "#"))
+	if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		return FormatHosts
+	}
+	if len(fields) > 2 {
+		return FormatRPZ
+	}
+	return FormatPlain
+}
+
+// plainException returns true if line is a valid exception entry of a plain list
+func plainException(line string) bool {
+	check, _, _, _ := parsePattern(stripComment(line, "#"))
+	return validDomain(check) == nil
+}
+
+func (p *listParser) parseHosts(line string) ([]string, error) {
+	fields := strings.Fields(stripComment(line, "#"))
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	if net.ParseIP(fields[0]) == nil {
+		return nil, fmt.Errorf("invalid address: %s", fields[0])
+	}
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("missing host name")
+	}
+	var result []string
+	for _, host := range fields[1:] {
+		if !hostsIgnored[strings.ToLower(host)] {
+			result = append(result, host)
+		}
+	}
+	return result, nil
+}
+
+func (p *listParser) parseAdBlock(line string) ([]string, error) {
+	if strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		return nil, nil // comment or header
+	}
+	prefix := ""
+	if strings.HasPrefix(line, "@@") {
+		prefix = "!"
+		line = line[2:]
+	}
+	if !strings.HasPrefix(line, "||") {
+		return nil, nil // cosmetic or URL rule, not a domain rule
+	}
+	rule := line[2:]
+	end := strings.IndexByte(rule, '^')
+	if end < 0 || end < len(rule)-1 {
+		return nil, nil // path or modifiers, not a domain-wide rule
+	}
+	domain := rule[:end]
+	if strings.ContainsAny(domain, "/*:") {
+		return nil, nil
+	}
+	// Block, or allow, the domain and its subdomains
+	return []string{prefix + "||" + domain}, nil
+}
+
+func (p *listParser) parseRPZ(line string) ([]string, error) {
+	startsWithBlank := len(line) > 0 && (line[0] == ' ' || line[0] == '\t')
+	fields := strings.Fields(stripComment(line, ";"))
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	if strings.EqualFold(fields[0], "$ORIGIN") {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("missing origin")
+		}
+		p.origin = strings.ToLower(strings.TrimSuffix(fields[1], "."))
+		return nil, nil
+	}
+	if strings.HasPrefix(fields[0], "$") || startsWithBlank || fields[0] == "@" {
+		return nil, nil // directive, continuation or zone apex
+	}
+	recordType := ""
+	for _, field := range fields[1:] {
+		switch strings.ToUpper(field) {
+		case "SOA", "NS":
+			return nil, nil
+		case "CNAME", "A", "AAAA", "TXT":
+			recordType = strings.ToUpper(field)
+		}
+		if len(recordType) > 0 {
+			break
+		}
+	}
+	if len(recordType) == 0 {
+		return nil, fmt.Errorf("unknown record: %s", line)
+	}
+	prefix := ""
+	if recordType == "CNAME" && strings.EqualFold(fields[len(fields)-1], "rpz-passthru.") {
+		prefix = "!" // passthru policy, exception to the other rules
+	}
+	owner := fields[0]
+	if strings.HasSuffix(owner, ".") { // Absolute name, remove the zone origin
+		owner = strings.ToLower(strings.TrimSuffix(owner, "."))
+		if len(p.origin) == 0 || !strings.HasSuffix(owner, "."+p.origin) {
+			return nil, fmt.Errorf("name %s outside of zone %s", fields[0], p.origin)
+		}
+		owner = strings.TrimSuffix(owner, "."+p.origin)
+	}
+	if strings.HasPrefix(owner, "rpz-") || strings.Contains(owner, ".rpz-") {
+		return nil, nil // IP, NSDNAME and NSIP triggers are not domain rules
+	}
+	return []string{prefix + owner}, nil
+}
+
+// Load parses a list from reader and puts every domain in tree, tagged with source and category
+func Load(tree EntryPutter, reader io.Reader, source string, category string, format Format) (LoadResult, error) {
+	result := LoadResult{Source: source}
+	parser := &listParser{format: format}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		entries, err := parser.parse(scanner.Text())
+		if err != nil {
+			result.Errors = append(result.Errors, LineError{Source: source, Line: lineNumber, Err: err})
+			continue
+		}
+		for _, domain := range entries {
+			check, _, _, _ := parsePattern(domain)
+			if err := validDomain(check); err != nil {
+				result.Errors = append(result.Errors, LineError{Source: source, Line: lineNumber, Err: err})
+				continue
+			}
+			tree.PutEntry(Entry{Pattern: domain, Source: source, Category: category})
+			result.Entries++
+		}
+		if len(entries) == 0 {
+			result.Skipped++
+		}
+	}
+	return result, scanner.Err()
+}
+
+// LoadFile opens path and loads its content in tree
+func LoadFile(tree EntryPutter, path string, category string, format Format) (LoadResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return LoadResult{Source: path}, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return Load(tree, file, path, category, format)
+}
@@ -0,0 +1,114 @@
+package domains
+
+import (
+	"strings"
+	"testing"
+)
+
+func loadString(t *testing.T, content string, format Format) (DomainTree, LoadResult) {
+	tree := New()
+	result, err := Load(tree, strings.NewReader(content), "test", "", format)
+	if err != nil {
+		t.Fatalf("Cannot load list: %s", err)
+	}
+	return tree, result
+}
+
+func TestLoadHosts(t *testing.T) {
+	tree, result := loadString(t, `# hosts file
+127.0.0.1 localhost
+0.0.0.0 ads.example.com tracker.example.com # trackers
+::1 ip6-localhost
+0.0.0.0 bad_host!
+`, FormatHosts)
+	if result.Entries != 2 {
+		t.Fatalf("Wrong number of entries %d", result.Entries)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Line != 5 {
+		t.Fatalf("Wrong errors %+v", result.Errors)
+	}
+	if !tree.Get("tracker.example.com") || tree.Get("localhost") {
+		t.Fatalf("Wrong hosts content")
+	}
+}
+
+func TestLoadAdBlock(t *testing.T) {
+	tree, result := loadString(t, `[Adblock Plus 2.0]
+! Title: test
+||ads.example.com^
+||example.org/banner^
+@@||good.example.com^
+example.net##.banner
+`, FormatAdBlock)
+	if result.Entries != 2 {
+		t.Fatalf("Wrong number of entries %d", result.Entries)
+	}
+	if !tree.Get("ads.example.com") || !tree.Get("sub.ads.example.com") {
+		t.Fatalf("Domain rule should block domain and subdomains")
+	}
+	if tree.Get("example.org") {
+		t.Fatalf("Path rules should be skipped")
+	}
+	if entry := tree.Lookup("www.good.example.com"); entry != nil {
+		t.Fatalf("Exception rule should allow subdomains, found %+v", entry)
+	}
+}
+
+func TestLoadRPZ(t *testing.T) {
+	tree, result := loadString(t, `$TTL 300
+$ORIGIN rpz.example.
+@ IN SOA localhost. root.localhost. 1 3600 600 86400 300
+  IN NS localhost.
+ads.example.com CNAME .
+*.ads.example.com CNAME .
+tracker.example.com.rpz.example. 300 IN CNAME .
+good.example.com CNAME rpz-passthru.
+32.1.2.0.192.rpz-ip CNAME .
+other.example.com.other.zone. CNAME .
+`, FormatRPZ)
+	if result.Entries != 4 {
+		t.Fatalf("Wrong number of entries %d", result.Entries)
+	}
+	if len(result.Errors) != 1 || result.Errors[0].Line != 10 {
+		t.Fatalf("Wrong errors %+v", result.Errors)
+	}
+	if !tree.Get("tracker.example.com") || !tree.Get("www.ads.example.com") || tree.Get("good.example.com") {
+		t.Fatalf("Wrong RPZ content")
+	}
+}
+
+func TestLoadAuto(t *testing.T) {
+	tree, result := loadString(t, `plain.example.com
+0.0.0.0 hosts.example.com
+||adblock.example.com^
+`, FormatAuto)
+	if result.Entries != 3 {
+		t.Fatalf("Wrong number of entries %d", result.Entries)
+	}
+	for _, domain := range []string{"plain.example.com", "hosts.example.com", "adblock.example.com"} {
+		if !tree.Get(domain) {
+			t.Errorf("Cannot find domain %s", domain)
+		}
+	}
+	// Without AdBlock rules, a domain after ! is a plain exception
+	tree, result = loadString(t, `*.example.com
+!login.example.com
+`, FormatAuto)
+	if result.Entries != 2 || result.Skipped != 0 {
+		t.Fatalf("Wrong result %+v", result)
+	}
+	if tree.Get("login.example.com") || !tree.Get("www.example.com") {
+		t.Fatalf("Plain exception not loaded")
+	}
+	// Once AdBlock rules are found, the lines starting with ! are comments
+	tree, result = loadString(t, `! Title: test
+||ads.example.com^
+!login.ads.example.com
+`, FormatAuto)
+	if result.Entries != 1 || result.Skipped != 2 {
+		t.Fatalf("Wrong AdBlock result %+v", result)
+	}
+	if !tree.Get("login.ads.example.com") {
+		t.Fatalf("AdBlock comment loaded as an exception")
+	}
+}
@@ -0,0 +1,103 @@
+package domains
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+type PortRange struct {
+	Low  uint16
+	High uint16
+}
+
+// ParsePortRange parses a single port ("443") or an inclusive range ("8000-8100")
+func ParsePortRange(portRange string) (PortRange, error) {
+	parts := strings.SplitN(strings.TrimSpace(portRange), "-", 2)
+	low, err := strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 16)
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port: %s", portRange)
+	}
+	high := low
+	if len(parts) == 2 {
+		high, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 16)
+		if err != nil || high < low {
+			return PortRange{}, fmt.Errorf("invalid port range: %s", portRange)
+		}
+	}
+	return PortRange{Low: uint16(low), High: uint16(high)}, nil
+}
+
+func (p PortRange) Contains(port uint16) bool {
+	return port >= p.Low && port <= p.High
+}
+
+func (p PortRange) String() string {
+	if p.Low == p.High {
+		return strconv.Itoa(int(p.Low))
+	}
+	return fmt.Sprintf("%d-%d", p.Low, p.High)
+}
+
+type PortRanges []PortRange
+
+func ParsePortRanges(list []string) (PortRanges, error) {
+	var ranges PortRanges
+	for _, portRange := range list {
+		parsed, err := ParsePortRange(portRange)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, parsed)
+	}
+	return ranges, nil
+}
+
+func (p PortRanges) Contains(port uint16) bool {
+	for _, portRange := range p {
+		if portRange.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the ranges separated by commas, as accepted by the port qualifier of domain entries
+func (p PortRanges) String() string {
+	parts := make([]string, len(p))
+	for i, portRange := range p {
+		parts[i] = portRange.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// splitPortQualifier splits example.com:80,8000-8100 in its domain and port ranges.
+// Patterns with an invalid qualifier are kept as is and never match.
+func splitPortQualifier(pattern string) (string, PortRanges) {
+	index := strings.LastIndexByte(pattern, ':')
+	if index < 0 || strings.IndexByte(pattern, ':') != index { // No qualifier or IPv6 address
+		return pattern, nil
+	}
+	ports, err := ParsePortRanges(strings.Split(pattern[index+1:], ","))
+	if err != nil {
+		return pattern, nil
+	}
+	return pattern[:index], ports
+}
+
+// splitHostPort splits host:port, the port is 0 if key has no valid port
+func splitHostPort(key string) (string, uint16) {
+	if strings.IndexByte(key, ':') < 0 {
+		return key, 0
+	}
+	host, portString, err := net.SplitHostPort(key)
+	if err != nil {
+		return key, 0
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return host, 0
+	}
+	return host, uint16(port)
+}
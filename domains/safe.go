@@ -0,0 +1,90 @@
+package domains
+
+import "sync"
+
+// SafeTree is a DomainTree safe for concurrent use: lookups share a read lock and modifications take the write lock.
+// A read-only tree (compact tree or snapshot) is copied in a node trie at the first modification.
+type SafeTree struct {
+	lock sync.RWMutex
+	tree DomainTree
+}
+
+func NewSafe(tree DomainTree) *SafeTree {
+	if tree == nil {
+		tree = New()
+	}
+	return &SafeTree{tree: tree}
+}
+
+// mutable returns a tree that can be modified, the caller holds the write lock
+func (s *SafeTree) mutable() DomainTree {
+	c, ok := s.tree.(*compact)
+	if !ok {
+		return s.tree
+	}
+	tree := New()
+	if c.idn {
+		tree = NewIDNA()
+	}
+	c.Walk(func(entry Entry) bool {
+		tree.PutEntry(entry)
+		return true
+	})
+	s.tree = tree
+	return tree
+}
+
+func (s *SafeTree) Put(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.mutable().Put(key)
+}
+
+func (s *SafeTree) PutEntry(entry Entry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.mutable().PutEntry(entry)
+}
+
+func (s *SafeTree) Delete(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.mutable().Delete(key)
+}
+
+func (s *SafeTree) Get(key string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.tree.Get(key)
+}
+
+func (s *SafeTree) Lookup(key string) *Entry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.tree.Lookup(key)
+}
+
+func (s *SafeTree) LookupPort(host string, port uint16) *Entry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.tree.LookupPort(host, port)
+}
+
+func (s *SafeTree) Len() int {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.tree.Len()
+}
+
+// Walk holds the read lock while fn is called, fn must not modify the tree
+func (s *SafeTree) Walk(fn func(entry Entry) bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	s.tree.Walk(fn)
+}
+
+func (s *SafeTree) Dump() string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.tree.Dump()
+}
@@ -0,0 +1,47 @@
+package domains
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSafeTree(t *testing.T) {
+	tree := NewSafe(NewCompactFromList([]string{"*.example.com", "example.org"}))
+	tree.Put("!login.example.com")
+	if tree.Get("login.example.com") || !tree.Get("www.example.com") || !tree.Get("example.org") {
+		t.Fatalf("Wrong content after modification:\n%s", tree.Dump())
+	}
+	if !tree.Delete("example.org") || tree.Get("example.org") || tree.Len() != 2 {
+		t.Fatalf("Cannot delete entry:\n%s", tree.Dump())
+	}
+}
+
+func TestSafeTreeConcurrent(t *testing.T) {
+	tree := NewSafe(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				domain := fmt.Sprintf("d%d-%d.example.com", i, j)
+				tree.Put(domain)
+				if j%2 == 0 {
+					tree.Delete(domain)
+				}
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				_ = tree.Get(fmt.Sprintf("d%d-%d.example.com", i, j))
+				_ = tree.Len()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if tree.Len() != 400 {
+		t.Fatalf("Wrong length %d", tree.Len())
+	}
+}
@@ -0,0 +1,283 @@
+package domains
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A snapshot is a compiled tree stored in a binary file:
+//
+//	magic "RIPXTREE", version (uint16), flags (uint16), fingerprint (uint32 length and bytes),
+//	origins (uint32 count, then source and category as uint32 length and bytes),
+//	records (uint32 count), keys (uint32 length and bytes), key end offsets and metas (uint32 each),
+//	port qualifiers (uint32 count, then record index, uint32 count of ranges and low and high ports as uint16),
+//	SHA-256 checksum of everything before it.
+//
+// Integers are little endian. Any tree can be written, snapshots are loaded as compact read-only trees.
+
+const SnapshotVersion = 2
+
+const snapshotFlagIDN = 1
+
+var snapshotMagic = []byte("RIPXTREE")
+
+var (
+	ErrSnapshotVersion     = errors.New("unsupported snapshot version")
+	ErrSnapshotChecksum    = errors.New("snapshot checksum mismatch")
+	ErrSnapshotFingerprint = errors.New("snapshot fingerprint mismatch")
+)
+
+// compile returns the compact form of tree
+func compile(tree DomainTree) (*compact, error) {
+	switch t := tree.(type) {
+	case *compact:
+		return t, nil
+	case *AtomicTree:
+		return compile(t.Load())
+	case *SafeTree:
+		t.lock.RLock()
+		defer t.lock.RUnlock()
+		return compile(t.tree)
+	case *node:
+		builder := NewCompactBuilder()
+		if t.idn {
+			builder = NewIDNACompactBuilder()
+		}
+		t.walk("", func(domain string, kind entryKind, entry *Entry) bool {
+			builder.add(reverseLabels(domain), kind, entry.Exception, entry.Ports, origin{source: entry.Source, category: entry.Category})
+			return true
+		})
+		return builder.build()
+	case nil:
+		return NewCompactBuilder().build()
+	}
+	return nil, fmt.Errorf("cannot compile tree of type %T", tree)
+}
+
+type snapshotWriter struct {
+	writer io.Writer
+	err    error
+}
+
+func (w *snapshotWriter) write(data interface{}) {
+	if w.err == nil {
+		w.err = binary.Write(w.writer, binary.LittleEndian, data)
+	}
+}
+
+func (w *snapshotWriter) writeBytes(data []byte) {
+	w.write(uint32(len(data)))
+	if w.err == nil {
+		_, w.err = w.writer.Write(data)
+	}
+}
+
+// WriteSnapshot writes tree and the fingerprint of its sources to writer
+func WriteSnapshot(writer io.Writer, tree DomainTree, fingerprint []byte) error {
+	c, err := compile(tree)
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewWriter(writer)
+	checksum := sha256.New()
+	w := &snapshotWriter{writer: io.MultiWriter(buffered, checksum)}
+	flags := uint16(0)
+	if c.idn {
+		flags |= snapshotFlagIDN
+	}
+	w.write(snapshotMagic)
+	w.write(uint16(SnapshotVersion))
+	w.write(flags)
+	w.writeBytes(fingerprint)
+	w.write(uint32(len(c.origins)))
+	for _, o := range c.origins {
+		w.writeBytes([]byte(o.source))
+		w.writeBytes([]byte(o.category))
+	}
+	w.write(uint32(len(c.ends)))
+	w.writeBytes([]byte(c.keys))
+	w.write(c.ends)
+	w.write(c.metas)
+	indexes := make([]uint32, 0, len(c.ports))
+	for index := range c.ports {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool {
+		return indexes[i] < indexes[j]
+	})
+	w.write(uint32(len(indexes)))
+	for _, index := range indexes {
+		w.write(index)
+		w.write(uint32(len(c.ports[index])))
+		for _, portRange := range c.ports[index] {
+			w.write(portRange.Low)
+			w.write(portRange.High)
+		}
+	}
+	if w.err != nil {
+		return w.err
+	}
+	if _, err := buffered.Write(checksum.Sum(nil)); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+type snapshotReader struct {
+	data []byte
+	err  error
+}
+
+func (r *snapshotReader) next(size int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if size < 0 || size > len(r.data) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	result := r.data[:size]
+	r.data = r.data[size:]
+	return result
+}
+
+func (r *snapshotReader) uint16() uint16 {
+	if data := r.next(2); data != nil {
+		return binary.LittleEndian.Uint16(data)
+	}
+	return 0
+}
+
+func (r *snapshotReader) uint32() uint32 {
+	if data := r.next(4); data != nil {
+		return binary.LittleEndian.Uint32(data)
+	}
+	return 0
+}
+
+func (r *snapshotReader) bytes() []byte {
+	return r.next(int(r.uint32()))
+}
+
+func (r *snapshotReader) uint32s(count int) []uint32 {
+	if count > len(r.data)/4 {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	result := make([]uint32, count)
+	for i := range result {
+		result[i] = r.uint32()
+	}
+	return result
+}
+
+// ReadSnapshot loads a snapshot written by WriteSnapshot.
+// ErrSnapshotFingerprint is returned if fingerprint does not match the one of the snapshot.
+func ReadSnapshot(reader io.Reader, fingerprint []byte) (DomainTree, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(snapshotMagic)+sha256.Size || !bytes.Equal(data[:len(snapshotMagic)], snapshotMagic) {
+		return nil, errors.New("not a snapshot")
+	}
+	content, checksum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if sum := sha256.Sum256(content); !bytes.Equal(sum[:], checksum) {
+		return nil, ErrSnapshotChecksum
+	}
+	r := &snapshotReader{data: content[len(snapshotMagic):]}
+	if version := r.uint16(); r.err == nil && version != SnapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+	c := &compact{formatter: strings.ToLower}
+	if flags := r.uint16(); flags&snapshotFlagIDN != 0 {
+		c.formatter, c.idn = idnaFormatter, true
+	}
+	if stored := r.bytes(); r.err == nil && !bytes.Equal(stored, fingerprint) {
+		return nil, ErrSnapshotFingerprint
+	}
+	originCount := int(r.uint32())
+	for i := 0; i < originCount && r.err == nil; i++ {
+		source := string(r.bytes())
+		category := string(r.bytes())
+		c.origins = append(c.origins, origin{source: source, category: category})
+	}
+	count := int(r.uint32())
+	c.keys = string(r.bytes())
+	c.ends = r.uint32s(count)
+	c.metas = r.uint32s(count)
+	portCount := int(r.uint32())
+	for i := 0; i < portCount && r.err == nil; i++ {
+		index := r.uint32()
+		rangeCount := int(r.uint32())
+		if int(index) >= count || rangeCount == 0 || rangeCount > len(r.data)/4 {
+			return nil, fmt.Errorf("invalid snapshot port qualifier %d", i)
+		}
+		ports := make(PortRanges, rangeCount)
+		for j := range ports {
+			ports[j] = PortRange{Low: r.uint16(), High: r.uint16()}
+		}
+		if c.ports == nil {
+			c.ports = map[uint32]PortRanges{}
+		}
+		c.ports[index] = ports
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) > 0 {
+		return nil, errors.New("trailing data in snapshot")
+	}
+	previous := uint32(0)
+	for i := range c.ends {
+		if c.ends[i] < previous || int(c.ends[i]) > len(c.keys) ||
+			compactKind(c.metas[i]) > kindApex || int(c.metas[i]>>compactOriginShift) >= len(c.origins) {
+			return nil, fmt.Errorf("invalid snapshot record %d", i)
+		}
+		previous = c.ends[i]
+	}
+	return c, nil
+}
+
+// WriteSnapshotFile atomically replaces the snapshot stored in path
+func WriteSnapshotFile(path string, tree DomainTree, fingerprint []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := WriteSnapshot(tmp, tree, fingerprint); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// ReadSnapshotFile loads the snapshot stored in path
+func ReadSnapshotFile(path string, fingerprint []byte) (DomainTree, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return ReadSnapshot(file, fingerprint)
+}
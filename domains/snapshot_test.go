@@ -0,0 +1,53 @@
+package domains
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	tree := NewIDNA()
+	tree.PutEntry(Entry{Pattern: "*.éxample.com", Source: "ads.txt", Category: "ads"})
+	tree.Put(".example.org")
+	tree.Put("!login.example.org")
+	tree.Put("example.net:8000-8100")
+	var buffer bytes.Buffer
+	if err := WriteSnapshot(&buffer, tree, []byte("v1")); err != nil {
+		t.Fatalf("Cannot write snapshot: %s", err)
+	}
+	data := buffer.Bytes()
+
+	loaded, err := ReadSnapshot(bytes.NewReader(data), []byte("v1"))
+	if err != nil {
+		t.Fatalf("Cannot read snapshot: %s", err)
+	}
+	if loaded.Dump() != tree.Dump() {
+		t.Fatalf("Wrong snapshot content:\n%s", loaded.Dump())
+	}
+	for _, domain := range []string{"test.éxample.com", "example.org", "www.example.org"} {
+		if !loaded.Get(domain) {
+			t.Errorf("Cannot find domain %s", domain)
+		}
+	}
+	if !loaded.Get("example.net:8080") || loaded.Get("example.net:443") {
+		t.Errorf("Wrong port qualified entry")
+	}
+	if loaded.Get("login.example.org") || loaded.Get("éxample.com") {
+		t.Errorf("Wrong snapshot content")
+	}
+	if entry := loaded.Lookup("test.éxample.com"); entry == nil || entry.Source != "ads.txt" || entry.Category != "ads" {
+		t.Errorf("Wrong entry %+v", entry)
+	}
+
+	if _, err := ReadSnapshot(bytes.NewReader(data), []byte("v2")); err != ErrSnapshotFingerprint {
+		t.Fatalf("Stale snapshot accepted: %v", err)
+	}
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	if _, err := ReadSnapshot(bytes.NewReader(corrupted), []byte("v1")); err != ErrSnapshotChecksum {
+		t.Fatalf("Corrupted snapshot accepted: %v", err)
+	}
+	if _, err := ReadSnapshot(bytes.NewReader(data[:len(data)-1]), []byte("v1")); err == nil {
+		t.Fatalf("Truncated snapshot accepted")
+	}
+}
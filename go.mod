@@ -7,6 +7,7 @@ require (
 	github.com/elazarl/goproxy v0.0.0-20240909085733-6741dbfc16a1
 	github.com/inconshreveable/go-vhost v1.0.0
 	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.28.0
 	golang.org/x/net v0.30.0
 	gopkg.in/hlandau/easyconfig.v1 v1.0.18
 	gopkg.in/hlandau/service.v2 v2.0.17
@@ -0,0 +1,129 @@
+package mitm
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCacheTTL  = 24 * time.Hour
+	DefaultCacheSize = 1024
+)
+
+// LoadCA loads the certificate authority signing the certificates of the intercepted hosts
+func LoadCA(certFile string, keyFile string) (*tls.Certificate, error) {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !ca.Leaf.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+	if time.Now().After(ca.Leaf.NotAfter) {
+		return nil, fmt.Errorf("CA certificate %s expired on %s", certFile, ca.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return &ca, nil
+}
+
+// PEM returns the certificate of the authority in PEM format
+func PEM(ca *tls.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]})
+}
+
+// TrustStore returns the pool verifying the certificates of the intercepted servers:
+// the system roots, unless excluded, and the certificates of the PEM files
+func TrustStore(files []string, systemRoots bool) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if systemRoots {
+		system, err := x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("cannot load system roots: %s", err)
+		}
+		pool = system
+	}
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate in %s", file)
+		}
+	}
+	if !systemRoots && len(files) == 0 {
+		return nil, errors.New("empty trust store")
+	}
+	return pool, nil
+}
+
+type cachedCertificate struct {
+	certificate *tls.Certificate
+	expires     time.Time
+}
+
+// CertCache keeps the signed host certificates for a duration, each certificate is signed once per host.
+// It implements the goproxy.CertStorage interface.
+type CertCache struct {
+	TTL     time.Duration
+	Size    int // maximum number of certificates
+	lock    sync.Mutex
+	entries map[string]cachedCertificate
+}
+
+func NewCertCache(ttl time.Duration, size int) *CertCache {
+	return &CertCache{TTL: ttl, Size: size, entries: map[string]cachedCertificate{}}
+}
+
+// Fetch returns the cached certificate of hostname or signs a new one with generate
+func (c *CertCache) Fetch(hostname string, generate func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	now := time.Now()
+	c.lock.Lock()
+	entry, ok := c.entries[hostname]
+	c.lock.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.certificate, nil
+	}
+	certificate, err := generate()
+	if err != nil {
+		return nil, err
+	}
+	expires := now.Add(c.TTL)
+	if leaf, err := x509.ParseCertificate(certificate.Certificate[0]); err == nil && leaf.NotAfter.Before(expires) {
+		expires = leaf.NotAfter
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= c.Size {
+		for name, cached := range c.entries {
+			if now.After(cached.expires) {
+				delete(c.entries, name)
+			}
+		}
+		// Still full, drop any certificate
+		for name := range c.entries {
+			if len(c.entries) < c.Size {
+				break
+			}
+			delete(c.entries, name)
+		}
+	}
+	c.entries[hostname] = cachedCertificate{certificate: certificate, expires: expires}
+	return certificate, nil
+}
+
+// Len returns the number of cached certificates
+func (c *CertCache) Len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.entries)
+}
@@ -0,0 +1,119 @@
+package mitm
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate and its key, isCA sets the CA basic constraint
+func writeCertificate(t *testing.T, dir string, name string, isCA bool) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Cannot create certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Cannot marshal key: %s", err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatalf("Cannot write certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("Cannot write key: %s", err)
+	}
+	return certFile, keyFile
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "riproxy")
+	if err != nil {
+		t.Fatalf("Cannot create directory: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func TestLoadCA(t *testing.T) {
+	dir := tempDir(t)
+	certFile, keyFile := writeCertificate(t, dir, "ca", true)
+	ca, err := LoadCA(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Cannot load CA: %s", err)
+	}
+	if block, _ := pem.Decode(PEM(ca)); block == nil || block.Type != "CERTIFICATE" {
+		t.Fatalf("Wrong PEM certificate")
+	}
+	leafCert, leafKey := writeCertificate(t, dir, "leaf", false)
+	if _, err := LoadCA(leafCert, leafKey); err == nil {
+		t.Fatalf("Certificate without CA constraint accepted")
+	}
+	if _, err := LoadCA(certFile, leafKey); err == nil {
+		t.Fatalf("Mismatching key accepted")
+	}
+}
+
+func TestTrustStore(t *testing.T) {
+	dir := tempDir(t)
+	certFile, _ := writeCertificate(t, dir, "internal", true)
+	if _, err := TrustStore([]string{certFile}, false); err != nil {
+		t.Fatalf("Cannot load trust store: %s", err)
+	}
+	if _, err := TrustStore(nil, false); err == nil {
+		t.Fatalf("Empty trust store accepted")
+	}
+	if _, err := TrustStore([]string{filepath.Join(dir, "internal.key")}, false); err == nil {
+		t.Fatalf("File without certificate accepted")
+	}
+}
+
+func TestCertCache(t *testing.T) {
+	cache := NewCertCache(time.Hour, 2)
+	signed := 0
+	generate := func() (*tls.Certificate, error) {
+		signed++
+		return &tls.Certificate{Certificate: [][]byte{{0}}}, nil
+	}
+	first, _ := cache.Fetch("www.example.com", generate)
+	second, _ := cache.Fetch("www.example.com", generate)
+	if first != second || signed != 1 {
+		t.Fatalf("Certificate signed %d times", signed)
+	}
+	_, _ = cache.Fetch("files.example.com", generate)
+	_, _ = cache.Fetch("mail.example.com", generate)
+	if cache.Len() != 2 || signed != 3 {
+		t.Fatalf("Cache size not enforced: %d entries", cache.Len())
+	}
+	cache.TTL = -time.Second
+	_, _ = cache.Fetch("api.example.com", generate)
+	_, _ = cache.Fetch("api.example.com", generate)
+	if signed != 5 {
+		t.Fatalf("Expired certificate reused")
+	}
+}
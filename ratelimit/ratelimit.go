@@ -0,0 +1,175 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// ReportInterval is the minimum delay between two reported refusals of a client
+const ReportInterval = 10 * time.Second
+
+// Result of a limit check, Hits is the number of refusals of the client since the last report.
+// Hits is 0 if the refusal does not need to be reported, a refused client is reported once per ReportInterval.
+type Result struct {
+	Allowed bool
+	Hits    uint64
+}
+
+// report counts the refusals of a client since they were last reported
+type report struct {
+	hits     uint64
+	reported time.Time
+}
+
+type client struct {
+	tokens      float64
+	updated     time.Time
+	tunnels     int
+	requestHits report
+	tunnelHits  report
+}
+
+// Limiter keeps a token bucket of requests and the number of open tunnels of each client,
+// a client is identified by one or more keys like its address and its MAC address
+type Limiter struct {
+	Rate       float64 // requests per second, 0 disables the request limit
+	Burst      int
+	MaxTunnels int // 0 disables the tunnel limit
+	lock       sync.Mutex
+	clients    map[string]*client
+	sweep      time.Time
+	requests   uint64
+	tunnels    uint64
+}
+
+func NewLimiter(rate float64, burst int, maxTunnels int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{Rate: rate, Burst: burst, MaxTunnels: maxTunnels, clients: map[string]*client{}}
+}
+
+// client returns the entry of key with its bucket refilled, the idle clients are removed once per ReportInterval
+func (l *Limiter) client(key string, now time.Time) *client {
+	if now.After(l.sweep) {
+		idle := ReportInterval
+		if l.Rate > 0 {
+			if refill := time.Duration(float64(l.Burst) / l.Rate * float64(time.Second)); refill > idle {
+				idle = refill
+			}
+		}
+		for name, entry := range l.clients {
+			if entry.tunnels == 0 && now.Sub(entry.updated) > idle {
+				delete(l.clients, name)
+			}
+		}
+		l.sweep = now.Add(ReportInterval)
+	}
+	entry, ok := l.clients[key]
+	if !ok {
+		entry = &client{tokens: float64(l.Burst), updated: now}
+		l.clients[key] = entry
+		return entry
+	}
+	entry.tokens += now.Sub(entry.updated).Seconds() * l.Rate
+	if entry.tokens > float64(l.Burst) {
+		entry.tokens = float64(l.Burst)
+	}
+	entry.updated = now
+	return entry
+}
+
+// refuse counts a refusal in the report of each client
+func refuse(reports []*report, now time.Time) Result {
+	var result Result
+	for _, entry := range reports {
+		entry.hits++
+		if now.Sub(entry.reported) >= ReportInterval && entry.hits > result.Hits {
+			result.Hits = entry.hits
+		}
+	}
+	if result.Hits > 0 {
+		for _, entry := range reports {
+			entry.hits, entry.reported = 0, now
+		}
+	}
+	return result
+}
+
+// Allow takes a request token from every key, the request is refused if a key has no token left
+func (l *Limiter) Allow(keys ...string) Result {
+	if l == nil || l.Rate <= 0 {
+		return Result{Allowed: true}
+	}
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	clients := make([]*client, len(keys))
+	for i, key := range keys {
+		clients[i] = l.client(key, now)
+		if clients[i].tokens < 1 {
+			l.requests++
+			reports := make([]*report, i+1)
+			for j := range reports {
+				reports[j] = &clients[j].requestHits
+			}
+			return refuse(reports, now)
+		}
+	}
+	for _, entry := range clients {
+		entry.tokens--
+	}
+	return Result{Allowed: true}
+}
+
+// Open counts a new tunnel of every key, the tunnel is refused if a key reached MaxTunnels.
+// Every allowed tunnel must be closed with Close.
+func (l *Limiter) Open(keys ...string) Result {
+	if l == nil || l.MaxTunnels <= 0 {
+		return Result{Allowed: true}
+	}
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	clients := make([]*client, len(keys))
+	for i, key := range keys {
+		clients[i] = l.client(key, now)
+		if clients[i].tunnels >= l.MaxTunnels {
+			l.tunnels++
+			reports := make([]*report, i+1)
+			for j := range reports {
+				reports[j] = &clients[j].tunnelHits
+			}
+			return refuse(reports, now)
+		}
+	}
+	for _, entry := range clients {
+		entry.tunnels++
+	}
+	return Result{Allowed: true}
+}
+
+// Close releases a tunnel opened with the same keys
+func (l *Limiter) Close(keys ...string) {
+	if l == nil || l.MaxTunnels <= 0 {
+		return
+	}
+	now := time.Now()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, key := range keys {
+		if entry := l.client(key, now); entry.tunnels > 0 {
+			entry.tunnels--
+		}
+	}
+}
+
+// Refused returns the number of refused requests and tunnels
+func (l *Limiter) Refused() (uint64, uint64) {
+	if l == nil {
+		return 0, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.requests, l.tunnels
+}
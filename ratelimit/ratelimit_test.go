@@ -0,0 +1,90 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	limiter := NewLimiter(20, 2, 0)
+	for i := 0; i < 2; i++ {
+		if !limiter.Allow("192.0.2.1").Allowed {
+			t.Fatalf("Request %d refused within burst", i)
+		}
+	}
+	result := limiter.Allow("192.0.2.1")
+	if result.Allowed || result.Hits != 1 {
+		t.Fatalf("Request over burst: %+v", result)
+	}
+	if result := limiter.Allow("192.0.2.1"); result.Allowed || result.Hits != 0 {
+		t.Fatalf("Refusal reported twice: %+v", result)
+	}
+	if !limiter.Allow("192.0.2.2").Allowed {
+		t.Fatalf("Other client refused")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !limiter.Allow("192.0.2.1").Allowed {
+		t.Fatalf("Bucket not refilled")
+	}
+	if requests, tunnels := limiter.Refused(); requests != 2 || tunnels != 0 {
+		t.Fatalf("Wrong refusal count: %d requests, %d tunnels", requests, tunnels)
+	}
+}
+
+func TestAllowKeys(t *testing.T) {
+	limiter := NewLimiter(1, 1, 0)
+	if !limiter.Allow("192.0.2.1", "00:00:5e:00:53:01").Allowed {
+		t.Fatalf("First request refused")
+	}
+	// Same MAC address, new address
+	if limiter.Allow("192.0.2.2", "00:00:5e:00:53:01").Allowed {
+		t.Fatalf("MAC address not limited")
+	}
+	// The refused request did not take the token of the new address
+	if !limiter.Allow("192.0.2.2").Allowed {
+		t.Fatalf("Token taken by a refused request")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	limiter := NewLimiter(0, 0, 2)
+	for i := 0; i < 2; i++ {
+		if !limiter.Open("192.0.2.1").Allowed {
+			t.Fatalf("Tunnel %d refused", i)
+		}
+	}
+	if result := limiter.Open("192.0.2.1"); result.Allowed || result.Hits != 1 {
+		t.Fatalf("Tunnel over limit: %+v", result)
+	}
+	limiter.Close("192.0.2.1")
+	if !limiter.Open("192.0.2.1").Allowed {
+		t.Fatalf("Closed tunnel not released")
+	}
+	if !limiter.Allow("192.0.2.1").Allowed {
+		t.Fatalf("Request refused without rate")
+	}
+	if requests, tunnels := limiter.Refused(); requests != 0 || tunnels != 1 {
+		t.Fatalf("Wrong refusal count: %d requests, %d tunnels", requests, tunnels)
+	}
+}
+
+func TestReports(t *testing.T) {
+	limiter := NewLimiter(1, 1, 1)
+	limiter.Allow("192.0.2.1")
+	limiter.Open("192.0.2.1")
+	if result := limiter.Open("192.0.2.1"); result.Hits != 1 {
+		t.Fatalf("Tunnel refusal not reported: %+v", result)
+	}
+	// Each limit has its own report interval
+	if result := limiter.Allow("192.0.2.1"); result.Allowed || result.Hits != 1 {
+		t.Fatalf("Request refusal not reported: %+v", result)
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	var limiter *Limiter
+	if !limiter.Allow("192.0.2.1").Allowed || !limiter.Open("192.0.2.1").Allowed {
+		t.Fatalf("Nil limiter refused")
+	}
+	limiter.Close("192.0.2.1")
+}
@@ -0,0 +1,316 @@
+package resolver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EDNS0 payload size advertised to the upstream servers, larger answers are truncated and retried over TCP
+const udpSize = 1232
+
+var (
+	errNotFound  = errors.New("no such host")
+	errTruncated = errors.New("truncated answer")
+)
+
+// answer is the result of a query, ttl is the cache duration of the addresses or of the negative answer
+type answer struct {
+	addresses []net.IPAddr
+	ttl       time.Duration
+	err       error
+}
+
+// resolve queries the A and AAAA records of name in parallel.
+// errNotFound is returned with its cache duration if the name has no address.
+// An answer with a failed query is returned with a zero TTL, it must not be cached.
+func (r *Resolver) resolve(ctx context.Context, name string) ([]net.IPAddr, time.Duration, error) {
+	fqdn, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	var answers [2]answer
+	var wg sync.WaitGroup
+	for i, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		wg.Add(1)
+		go func(i int, qtype dnsmessage.Type) {
+			defer wg.Done()
+			answers[i] = r.query(ctx, fqdn, qtype)
+		}(i, qtype)
+	}
+	wg.Wait()
+	var addresses []net.IPAddr
+	var failure error
+	positive, negative := time.Duration(math.MaxInt64), time.Duration(math.MaxInt64)
+	for _, result := range answers {
+		switch {
+		case result.err != nil && result.err != errNotFound:
+			failure = result.err
+		case len(result.addresses) > 0:
+			addresses = append(addresses, result.addresses...)
+			if result.ttl < positive {
+				positive = result.ttl
+			}
+		default:
+			if result.ttl < negative {
+				negative = result.ttl
+			}
+		}
+	}
+	if len(addresses) > 0 {
+		if failure != nil {
+			return addresses, 0, nil
+		}
+		return addresses, positive, nil
+	}
+	if failure != nil {
+		return nil, 0, failure
+	}
+	return nil, negative, errNotFound
+}
+
+// query sends the question to the upstream servers in order until one of them answers
+func (r *Resolver) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) answer {
+	err := errors.New("no upstream server")
+	for _, server := range r.Config.Servers {
+		result := r.queryServer(ctx, server, name, qtype)
+		if result.err == nil || result.err == errNotFound {
+			return result
+		}
+		err = result.err
+		r.Log.WithField("server", server).Debugf("query %s %s failed: %s", qtype, name, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return answer{err: err}
+}
+
+func (r *Resolver) queryServer(ctx context.Context, server string, name dnsmessage.Name, qtype dnsmessage.Type) answer {
+	id, query, err := newQuery(name, qtype)
+	if err != nil {
+		return answer{err: err}
+	}
+	protocol := r.Config.Protocol
+	for {
+		response, err := r.exchange(ctx, protocol, server, id, query)
+		if err != nil {
+			return answer{err: err}
+		}
+		result := parseResponse(response, id, name, qtype)
+		if result.err == errTruncated && protocol == ProtocolUDP {
+			protocol = ProtocolTCP
+			continue
+		}
+		return result
+	}
+}
+
+// newQuery builds a recursive query with a random ID
+func newQuery(name dnsmessage.Name, qtype dnsmessage.Type) (uint16, []byte, error) {
+	var random [2]byte
+	if _, err := rand.Read(random[:]); err != nil {
+		return 0, nil, err
+	}
+	id := binary.BigEndian.Uint16(random[:])
+	builder := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return 0, nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return 0, nil, err
+	}
+	if err := builder.StartAdditionals(); err != nil {
+		return 0, nil, err
+	}
+	var header dnsmessage.ResourceHeader
+	if err := header.SetEDNS0(udpSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return 0, nil, err
+	}
+	if err := builder.OPTResource(header, dnsmessage.OPTResource{}); err != nil {
+		return 0, nil, err
+	}
+	query, err := builder.Finish()
+	return id, query, err
+}
+
+// exchange sends query to server and returns the response
+func (r *Resolver) exchange(ctx context.Context, protocol Protocol, server string, id uint16, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.Config.Timeout)
+	defer cancel()
+	network := "tcp"
+	if protocol == ProtocolUDP {
+		network = "udp"
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if protocol == ProtocolTLS {
+		serverName := r.Config.ServerName
+		if len(serverName) == 0 {
+			serverName, _, _ = net.SplitHostPort(server)
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName})
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if protocol == ProtocolUDP {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		response := make([]byte, udpSize)
+		for {
+			n, err := conn.Read(response)
+			if err != nil {
+				return nil, err
+			}
+			// Ignore the datagrams of other queries, they may be spoofed
+			if n >= 2 && binary.BigEndian.Uint16(response) == id {
+				return response[:n], nil
+			}
+		}
+	}
+	// TCP and TLS messages are prefixed by their length
+	message := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	copy(message[2:], query)
+	if _, err := conn.Write(message); err != nil {
+		return nil, err
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// parseResponse returns the addresses of name, following the CNAME chain of the answer section
+func parseResponse(response []byte, id uint16, name dnsmessage.Name, qtype dnsmessage.Type) answer {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return answer{err: err}
+	}
+	if header.ID != id || !header.Response {
+		return answer{err: errors.New("invalid DNS response")}
+	}
+	question, err := parser.Question()
+	if err != nil || question.Type != qtype || !strings.EqualFold(question.Name.String(), name.String()) {
+		return answer{err: errors.New("DNS response to another question")}
+	}
+	if header.Truncated {
+		return answer{err: errTruncated}
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return answer{err: err}
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return answer{ttl: negativeTTL(&parser), err: errNotFound}
+	default:
+		return answer{err: fmt.Errorf("DNS server error: %s", header.RCode)}
+	}
+	result := answer{ttl: time.Duration(math.MaxInt64)}
+	target := name.String()
+	for {
+		resource, err := parser.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return answer{err: err}
+		}
+		if resource.Class != dnsmessage.ClassINET || !strings.EqualFold(resource.Name.String(), target) {
+			if err := parser.SkipAnswer(); err != nil {
+				return answer{err: err}
+			}
+			continue
+		}
+		switch {
+		case resource.Type == dnsmessage.TypeCNAME:
+			cname, err := parser.CNAMEResource()
+			if err != nil {
+				return answer{err: err}
+			}
+			target = cname.CNAME.String()
+		case resource.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			a, err := parser.AResource()
+			if err != nil {
+				return answer{err: err}
+			}
+			result.addresses = append(result.addresses, net.IPAddr{IP: net.IP(append([]byte(nil), a.A[:]...))})
+		case resource.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			aaaa, err := parser.AAAAResource()
+			if err != nil {
+				return answer{err: err}
+			}
+			result.addresses = append(result.addresses, net.IPAddr{IP: net.IP(append([]byte(nil), aaaa.AAAA[:]...))})
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return answer{err: err}
+			}
+			continue
+		}
+		if ttl := time.Duration(resource.TTL) * time.Second; ttl < result.ttl {
+			result.ttl = ttl
+		}
+	}
+	if len(result.addresses) == 0 {
+		return answer{ttl: negativeTTL(&parser), err: errNotFound}
+	}
+	return result
+}
+
+// negativeTTL returns the cache duration of a negative answer from the SOA record of the authority section
+func negativeTTL(parser *dnsmessage.Parser) time.Duration {
+	if err := parser.SkipAllAnswers(); err != nil {
+		return 0
+	}
+	for {
+		resource, err := parser.AuthorityHeader()
+		if err != nil {
+			return 0
+		}
+		if resource.Type != dnsmessage.TypeSOA {
+			if err := parser.SkipAuthority(); err != nil {
+				return 0
+			}
+			continue
+		}
+		soa, err := parser.SOAResource()
+		if err != nil {
+			return 0
+		}
+		ttl := resource.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		return time.Duration(ttl) * time.Second
+	}
+}
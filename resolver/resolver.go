@@ -0,0 +1,313 @@
+package resolver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultTimeout        = 5 * time.Second
+	DefaultMinTTL         = 10 * time.Second
+	DefaultMaxTTL         = time.Hour
+	DefaultNegativeMinTTL = 5 * time.Second
+	DefaultNegativeMaxTTL = 5 * time.Minute
+	DefaultMaxEntries     = 10000
+)
+
+const cleanupInterval = time.Minute
+const statsInterval = 15 * time.Minute
+
+type Protocol string
+
+const (
+	ProtocolUDP Protocol = "udp"
+	ProtocolTCP Protocol = "tcp"
+	ProtocolTLS Protocol = "tls"
+)
+
+func ParseProtocol(protocol string) (Protocol, error) {
+	switch Protocol(strings.ToLower(protocol)) {
+	case "", ProtocolUDP:
+		return ProtocolUDP, nil
+	case ProtocolTCP:
+		return ProtocolTCP, nil
+	case ProtocolTLS, "dot":
+		return ProtocolTLS, nil
+	}
+	return ProtocolUDP, fmt.Errorf("unknown resolver protocol: %s", protocol)
+}
+
+// defaultPort returns the port of the upstream servers without explicit port
+func (p Protocol) defaultPort() string {
+	if p == ProtocolTLS {
+		return "853"
+	}
+	return "53"
+}
+
+type Config struct {
+	Servers        []string      // upstream servers tried in order, the name servers of /etc/resolv.conf if empty
+	Protocol       Protocol      // UDP (with TCP fallback for truncated answers), TCP or DNS over TLS
+	ServerName     string        // name verified in the certificate of DNS over TLS servers, the server address if empty
+	Timeout        time.Duration // timeout of a query to an upstream server
+	MinTTL         time.Duration // bounds of the cache duration of answers
+	MaxTTL         time.Duration
+	NegativeMinTTL time.Duration // bounds of the cache duration of unknown names
+	NegativeMaxTTL time.Duration
+	MaxEntries     int // size of the cache, DefaultMaxEntries if not set
+}
+
+// Stats are the cache counters since the resolver was created
+type Stats struct {
+	Hits         uint64 // answers served from the cache
+	NegativeHits uint64 // unknown names served from the cache
+	Misses       uint64 // names sent to the upstream servers
+	Errors       uint64 // failed resolutions, they are not cached
+	Evictions    uint64 // entries removed before their expiration to make room in a full cache
+	Entries      int
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d hits, %d negative hits, %d misses, %d errors, %d evictions, %d entries",
+		s.Hits, s.NegativeHits, s.Misses, s.Errors, s.Evictions, s.Entries)
+}
+
+// cacheEntry holds the addresses of a name, addresses is nil for unknown names
+type cacheEntry struct {
+	addresses []net.IPAddr
+	expires   time.Time
+}
+
+// Resolver resolves names with the configured upstream servers and caches the answers for their TTL
+type Resolver struct {
+	Config       Config
+	Log          *log.Entry
+	lock         sync.RWMutex
+	cache        map[string]cacheEntry
+	hits         uint64
+	negativeHits uint64
+	misses       uint64
+	errors       uint64
+	evictions    uint64
+	stop         chan struct{}
+	wg           sync.WaitGroup
+}
+
+func New(config Config, logger *log.Entry) *Resolver {
+	if len(config.Servers) == 0 {
+		config.Servers = SystemServers()
+	}
+	servers := make([]string, 0, len(config.Servers))
+	for _, server := range config.Servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), config.Protocol.defaultPort())
+		}
+		servers = append(servers, server)
+	}
+	config.Servers = servers
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultTimeout
+	}
+	if config.MaxTTL < config.MinTTL {
+		config.MaxTTL = config.MinTTL
+	}
+	if config.NegativeMaxTTL < config.NegativeMinTTL {
+		config.NegativeMaxTTL = config.NegativeMinTTL
+	}
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = DefaultMaxEntries
+	}
+	return &Resolver{
+		Config: config,
+		Log: logger.WithFields(log.Fields{
+			"component": "resolver",
+			"protocol":  config.Protocol,
+		}),
+		cache: map[string]cacheEntry{},
+		stop:  make(chan struct{}),
+	}
+}
+
+// SystemServers returns the name servers of /etc/resolv.conf
+func SystemServers() []string {
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	var servers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// Start removes the expired entries and logs the statistics in the background
+func (r *Resolver) Start() error {
+	r.Log.WithField("servers", strings.Join(r.Config.Servers, ",")).Debug("starting resolver")
+	r.wg.Add(1)
+	go r.run()
+	return nil
+}
+
+func (r *Resolver) Stop() error {
+	r.Log.Debug("stopping resolver")
+	close(r.stop)
+	r.wg.Wait()
+	r.logStats()
+	return nil
+}
+
+func (r *Resolver) run() {
+	defer r.wg.Done()
+	cleanup := time.NewTicker(cleanupInterval)
+	defer cleanup.Stop()
+	stats := time.NewTicker(statsInterval)
+	defer stats.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-cleanup.C:
+			r.expire(time.Now())
+		case <-stats.C:
+			r.logStats()
+		}
+	}
+}
+
+func (r *Resolver) logStats() {
+	stats := r.Stats()
+	r.Log.WithFields(log.Fields{
+		"hits":          stats.Hits,
+		"negative_hits": stats.NegativeHits,
+		"misses":        stats.Misses,
+		"errors":        stats.Errors,
+		"evictions":     stats.Evictions,
+		"entries":       stats.Entries,
+	}).Infof("resolver cache: %s", stats)
+}
+
+func (r *Resolver) Stats() Stats {
+	r.lock.RLock()
+	entries := len(r.cache)
+	r.lock.RUnlock()
+	return Stats{
+		Hits:         atomic.LoadUint64(&r.hits),
+		NegativeHits: atomic.LoadUint64(&r.negativeHits),
+		Misses:       atomic.LoadUint64(&r.misses),
+		Errors:       atomic.LoadUint64(&r.errors),
+		Evictions:    atomic.LoadUint64(&r.evictions),
+		Entries:      entries,
+	}
+}
+
+// expire removes the entries expired at now
+func (r *Resolver) expire(now time.Time) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for name, entry := range r.cache {
+		if !now.Before(entry.expires) {
+			delete(r.cache, name)
+		}
+	}
+}
+
+func (r *Resolver) cached(name string) (cacheEntry, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	entry, ok := r.cache[name]
+	if !ok || !time.Now().Before(entry.expires) {
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (r *Resolver) store(name string, addresses []net.IPAddr, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.cache[name]; !ok && len(r.cache) >= r.Config.MaxEntries {
+		r.evict()
+	}
+	r.cache[name] = cacheEntry{addresses: addresses, expires: time.Now().Add(ttl)}
+}
+
+// evict removes an entry of the full cache, a client resolving random names cannot grow it without bound.
+// The map iteration order is random: the entries of the flooding names are the most likely to be removed.
+func (r *Resolver) evict() {
+	for name := range r.cache {
+		delete(r.cache, name)
+		atomic.AddUint64(&r.evictions, 1)
+		return
+	}
+}
+
+// Flush empties the cache
+func (r *Resolver) Flush() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cache = map[string]cacheEntry{}
+}
+
+func notFound(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func clampTTL(ttl time.Duration, min time.Duration, max time.Duration) time.Duration {
+	if ttl < min {
+		return min
+	}
+	if ttl > max {
+		return max
+	}
+	return ttl
+}
+
+// LookupIPAddr returns the IPv4 addresses of host followed by its IPv6 addresses,
+// it has the same signature as the method of net.Resolver
+func (r *Resolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	if len(name) == 0 {
+		return nil, notFound(host)
+	}
+	if entry, ok := r.cached(name); ok {
+		if entry.addresses == nil {
+			atomic.AddUint64(&r.negativeHits, 1)
+			return nil, notFound(host)
+		}
+		atomic.AddUint64(&r.hits, 1)
+		return entry.addresses, nil
+	}
+	atomic.AddUint64(&r.misses, 1)
+	addresses, ttl, err := r.resolve(ctx, name)
+	if err == errNotFound {
+		r.store(name, nil, clampTTL(ttl, r.Config.NegativeMinTTL, r.Config.NegativeMaxTTL))
+		return nil, notFound(host)
+	}
+	if err != nil {
+		atomic.AddUint64(&r.errors, 1)
+		return nil, &net.DNSError{Err: err.Error(), Name: host}
+	}
+	r.store(name, addresses, clampTTL(ttl, r.Config.MinTTL, r.Config.MaxTTL))
+	return addresses, nil
+}
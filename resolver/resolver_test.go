@@ -0,0 +1,363 @@
+package resolver
+
+import (
+	"context"
+	"encoding/binary"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubServer answers the queries over UDP and TCP on the same port from a static zone
+type stubServer struct {
+	t        *testing.T
+	udp      net.PacketConn
+	tcp      net.Listener
+	zone     map[string][]dnsmessage.Resource // answers by lower case name and type
+	truncate bool                             // truncate the UDP answers
+	queries  int32
+}
+
+func newStubServer(t *testing.T) *stubServer {
+	for i := 0; i < 10; i++ {
+		udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Cannot listen: %s", err)
+		}
+		tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+		if err != nil {
+			_ = udp.Close()
+			continue
+		}
+		s := &stubServer{t: t, udp: udp, tcp: tcp, zone: map[string][]dnsmessage.Resource{}}
+		go s.serveUDP()
+		go s.serveTCP()
+		t.Cleanup(func() {
+			_ = udp.Close()
+			_ = tcp.Close()
+		})
+		return s
+	}
+	t.Fatalf("Cannot listen on the same UDP and TCP port")
+	return nil
+}
+
+func (s *stubServer) address() string {
+	return s.udp.LocalAddr().String()
+}
+
+func zoneKey(name string, qtype dnsmessage.Type) string {
+	return strings.ToLower(name) + " " + qtype.String()
+}
+
+func (s *stubServer) add(name string, ttl uint32, body dnsmessage.ResourceBody) {
+	fqdn := dnsmessage.MustNewName(name)
+	resource := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: fqdn, Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   body,
+	}
+	qtype := dnsmessage.TypeA
+	if _, ok := body.(*dnsmessage.AAAAResource); ok {
+		qtype = dnsmessage.TypeAAAA
+	}
+	if _, ok := body.(*dnsmessage.CNAMEResource); ok {
+		// The stub only handles CNAME records pointing to A records
+		s.zone[zoneKey(name, dnsmessage.TypeA)] = append(s.zone[zoneKey(name, dnsmessage.TypeA)], resource)
+		return
+	}
+	s.zone[zoneKey(name, qtype)] = append(s.zone[zoneKey(name, qtype)], resource)
+}
+
+func (s *stubServer) answer(query []byte, udp bool) []byte {
+	atomic.AddInt32(&s.queries, 1)
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+	response := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: header.ID, Response: true, RecursionAvailable: true},
+		Questions: []dnsmessage.Question{question},
+	}
+	if udp && s.truncate {
+		response.Header.Truncated = true
+	} else if answers, ok := s.zone[zoneKey(question.Name.String(), question.Type)]; ok {
+		response.Answers = answers
+		// Follow the CNAME records
+		for _, answer := range answers {
+			if cname, ok := answer.Body.(*dnsmessage.CNAMEResource); ok {
+				response.Answers = append(response.Answers, s.zone[zoneKey(cname.CNAME.String(), question.Type)]...)
+			}
+		}
+	} else {
+		if _, exists := s.zone[zoneKey(question.Name.String(), dnsmessage.TypeA)]; !exists {
+			response.Header.RCode = dnsmessage.RCodeNameError
+		}
+		response.Authorities = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Class: dnsmessage.ClassINET, TTL: 3600},
+			Body: &dnsmessage.SOAResource{
+				NS:     dnsmessage.MustNewName("ns.example.com."),
+				MBox:   dnsmessage.MustNewName("hostmaster.example.com."),
+				MinTTL: 60,
+			},
+		}}
+	}
+	packed, err := response.Pack()
+	if err != nil {
+		s.t.Errorf("Cannot pack response: %s", err)
+	}
+	return packed
+}
+
+func (s *stubServer) serveUDP() {
+	buffer := make([]byte, 65535)
+	for {
+		n, addr, err := s.udp.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if response := s.answer(buffer[:n], true); response != nil {
+			_, _ = s.udp.WriteTo(response, addr)
+		}
+	}
+}
+
+func (s *stubServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer func() {
+				_ = conn.Close()
+			}()
+			var length [2]byte
+			if _, err := io.ReadFull(conn, length[:]); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			response := s.answer(query, false)
+			message := make([]byte, 2+len(response))
+			binary.BigEndian.PutUint16(message, uint16(len(response)))
+			copy(message[2:], response)
+			_, _ = conn.Write(message)
+		}(conn)
+	}
+}
+
+func newTestResolver(config Config) *Resolver {
+	logger := log.NewEntry(log.New())
+	logger.Logger.SetOutput(ioutil.Discard)
+	if config.Timeout == 0 {
+		config.Timeout = time.Second
+	}
+	return New(config, logger)
+}
+
+func a(ip string) *dnsmessage.AResource {
+	resource := &dnsmessage.AResource{}
+	copy(resource.A[:], net.ParseIP(ip).To4())
+	return resource
+}
+
+func aaaa(ip string) *dnsmessage.AAAAResource {
+	resource := &dnsmessage.AAAAResource{}
+	copy(resource.AAAA[:], net.ParseIP(ip))
+	return resource
+}
+
+func addressStrings(addresses []net.IPAddr) string {
+	var result []string
+	for _, address := range addresses {
+		result = append(result, address.IP.String())
+	}
+	return strings.Join(result, ",")
+}
+
+func TestLookupCache(t *testing.T) {
+	server := newStubServer(t)
+	server.add("www.example.com.", 300, a("192.0.2.1"))
+	server.add("www.example.com.", 300, aaaa("2001:db8::1"))
+	resolver := newTestResolver(Config{Servers: []string{server.address()}, MinTTL: time.Second, MaxTTL: time.Hour})
+	for i := 0; i < 2; i++ {
+		addresses, err := resolver.LookupIPAddr(context.Background(), "WWW.example.com.")
+		if err != nil {
+			t.Fatalf("Cannot resolve: %s", err)
+		}
+		if result := addressStrings(addresses); result != "192.0.2.1,2001:db8::1" {
+			t.Fatalf("Wrong addresses %s", result)
+		}
+	}
+	if queries := atomic.LoadInt32(&server.queries); queries != 2 {
+		t.Fatalf("Expected 2 queries (A and AAAA), got %d", queries)
+	}
+	stats := resolver.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Fatalf("Wrong statistics: %s", stats)
+	}
+	if addresses, err := resolver.LookupIPAddr(context.Background(), "198.51.100.1"); err != nil || addressStrings(addresses) != "198.51.100.1" {
+		t.Fatalf("IP addresses should not be resolved: %v %s", addresses, err)
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	server := newStubServer(t)
+	server.add("ipv4.example.com.", 300, a("192.0.2.1"))
+	resolver := newTestResolver(Config{Servers: []string{server.address()}, NegativeMinTTL: time.Second, NegativeMaxTTL: 30 * time.Second})
+	for i := 0; i < 2; i++ {
+		_, err := resolver.LookupIPAddr(context.Background(), "unknown.example.com")
+		if dnsError, ok := err.(*net.DNSError); !ok || !dnsError.IsNotFound {
+			t.Fatalf("Expected a not found error, got %v", err)
+		}
+	}
+	stats := resolver.Stats()
+	if stats.NegativeHits != 1 || stats.Misses != 1 {
+		t.Fatalf("Wrong statistics: %s", stats)
+	}
+	entry, ok := resolver.cached("unknown.example.com")
+	if !ok || entry.addresses != nil || time.Until(entry.expires) > 30*time.Second {
+		t.Fatalf("Negative answer should be cached for at most 30s: %+v", entry)
+	}
+	// No AAAA record, the A records are returned and cached
+	addresses, err := resolver.LookupIPAddr(context.Background(), "ipv4.example.com")
+	if err != nil || addressStrings(addresses) != "192.0.2.1" {
+		t.Fatalf("Wrong addresses %v: %s", addresses, err)
+	}
+}
+
+func TestCacheSize(t *testing.T) {
+	server := newStubServer(t)
+	server.add("www.example.com.", 300, a("192.0.2.1"))
+	resolver := newTestResolver(Config{Servers: []string{server.address()}, MaxEntries: 2, MinTTL: time.Minute, NegativeMinTTL: time.Minute})
+	for _, name := range []string{"www.example.com", "random1.example.com", "random2.example.com", "random3.example.com"} {
+		_, _ = resolver.LookupIPAddr(context.Background(), name)
+	}
+	if stats := resolver.Stats(); stats.Entries != 2 || stats.Evictions != 2 {
+		t.Fatalf("Wrong statistics: %s", stats)
+	}
+	// Storing a cached name again does not evict another entry
+	resolver.lock.RLock()
+	var cached string
+	for name := range resolver.cache {
+		cached = name
+	}
+	resolver.lock.RUnlock()
+	resolver.store(cached, nil, time.Minute)
+	if stats := resolver.Stats(); stats.Entries != 2 || stats.Evictions != 2 {
+		t.Fatalf("Entry evicted to refresh a cached name: %s", stats)
+	}
+	if resolver := newTestResolver(Config{Servers: []string{server.address()}}); resolver.Config.MaxEntries != DefaultMaxEntries {
+		t.Fatalf("Wrong default cache size %d", resolver.Config.MaxEntries)
+	}
+}
+
+func TestTTLBounds(t *testing.T) {
+	server := newStubServer(t)
+	server.add("short.example.com.", 1, a("192.0.2.1"))
+	server.add("long.example.com.", 86400, a("192.0.2.2"))
+	server.add("zero.example.com.", 0, a("192.0.2.3"))
+	resolver := newTestResolver(Config{Servers: []string{server.address()}, MinTTL: time.Minute, MaxTTL: 10 * time.Minute})
+	for _, name := range []string{"short.example.com", "long.example.com"} {
+		if _, err := resolver.LookupIPAddr(context.Background(), name); err != nil {
+			t.Fatalf("Cannot resolve %s: %s", name, err)
+		}
+		entry, ok := resolver.cached(name)
+		if !ok || time.Until(entry.expires) < 59*time.Second || time.Until(entry.expires) > 10*time.Minute {
+			t.Fatalf("Wrong cache duration for %s: %s", name, time.Until(entry.expires))
+		}
+	}
+	resolver = newTestResolver(Config{Servers: []string{server.address()}})
+	if _, err := resolver.LookupIPAddr(context.Background(), "zero.example.com"); err != nil {
+		t.Fatalf("Cannot resolve: %s", err)
+	}
+	if _, ok := resolver.cached("zero.example.com"); ok {
+		t.Fatalf("Answers with a zero TTL should not be cached without minimum")
+	}
+}
+
+func TestCNAME(t *testing.T) {
+	server := newStubServer(t)
+	server.add("alias.example.com.", 300, &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName("target.example.com.")})
+	server.add("target.example.com.", 300, a("192.0.2.10"))
+	// Records outside of the CNAME chain are ignored
+	server.zone[zoneKey("alias.example.com.", dnsmessage.TypeA)] = append(server.zone[zoneKey("alias.example.com.", dnsmessage.TypeA)], dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("other.example.net."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 300},
+		Body:   a("10.0.0.1"),
+	})
+	resolver := newTestResolver(Config{Servers: []string{server.address()}})
+	addresses, err := resolver.LookupIPAddr(context.Background(), "alias.example.com")
+	if err != nil {
+		t.Fatalf("Cannot resolve: %s", err)
+	}
+	if result := addressStrings(addresses); result != "192.0.2.10" {
+		t.Fatalf("Wrong addresses %s", result)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	server := newStubServer(t)
+	server.add("www.example.com.", 300, a("192.0.2.1"))
+	server.truncate = true
+	resolver := newTestResolver(Config{Servers: []string{server.address()}})
+	addresses, err := resolver.LookupIPAddr(context.Background(), "www.example.com")
+	if err != nil || addressStrings(addresses) != "192.0.2.1" {
+		t.Fatalf("Truncated answer should be retried over TCP: %v %s", addresses, err)
+	}
+	resolver = newTestResolver(Config{Servers: []string{server.address()}, Protocol: ProtocolTCP})
+	addresses, err = resolver.LookupIPAddr(context.Background(), "www.example.com")
+	if err != nil || addressStrings(addresses) != "192.0.2.1" {
+		t.Fatalf("Cannot resolve over TCP: %v %s", addresses, err)
+	}
+}
+
+func TestServerFailover(t *testing.T) {
+	server := newStubServer(t)
+	server.add("www.example.com.", 300, a("192.0.2.1"))
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %s", err)
+	}
+	unused := closed.Addr().String()
+	_ = closed.Close()
+	resolver := newTestResolver(Config{Servers: []string{unused, server.address()}, Protocol: ProtocolTCP})
+	addresses, err := resolver.LookupIPAddr(context.Background(), "www.example.com")
+	if err != nil || addressStrings(addresses) != "192.0.2.1" {
+		t.Fatalf("Second server should answer: %v %s", addresses, err)
+	}
+	resolver = newTestResolver(Config{Servers: []string{unused}, Protocol: ProtocolTCP})
+	if _, err := resolver.LookupIPAddr(context.Background(), "www.example.com"); err == nil {
+		t.Fatalf("Lookup without server should fail")
+	}
+	if stats := resolver.Stats(); stats.Errors != 1 || stats.Entries != 0 {
+		t.Fatalf("Failures should not be cached: %s", stats)
+	}
+}
+
+func TestParseProtocol(t *testing.T) {
+	for input, expected := range map[string]Protocol{"": ProtocolUDP, "TCP": ProtocolTCP, "dot": ProtocolTLS, "tls": ProtocolTLS} {
+		if protocol, err := ParseProtocol(input); err != nil || protocol != expected {
+			t.Fatalf("Wrong protocol for %q: %s %v", input, protocol, err)
+		}
+	}
+	if _, err := ParseProtocol("https"); err == nil {
+		t.Fatalf("Unknown protocol accepted")
+	}
+	resolver := newTestResolver(Config{Servers: []string{"192.0.2.53", "[2001:db8::53]", "192.0.2.54:5353"}, Protocol: ProtocolTLS})
+	if servers := strings.Join(resolver.Config.Servers, ","); servers != "192.0.2.53:853,[2001:db8::53]:853,192.0.2.54:5353" {
+		t.Fatalf("Wrong servers %s", servers)
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/COSAE-FR/riproxy/acl"
+	"github.com/COSAE-FR/riproxy/configuration"
+	"github.com/elazarl/goproxy"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// BlockPageTemplate is used by the reasons without configured template
+const BlockPageTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{ .Status }} {{ .StatusText }}</title>
+</head>
+<body>
+<h1>{{ .StatusText }}</h1>
+<p>{{ .Message }}</p>
+<ul>
+<li>URL: {{ .URL }}</li>
+{{- if .Rule }}
+<li>Rule: {{ .Rule }}</li>
+{{- end }}
+{{- if .Category }}
+<li>Category: {{ .Category }}</li>
+{{- end }}
+<li>Client: {{ .ClientIP }}{{ if .ClientMAC }} ({{ .ClientMAC }}){{ end }}</li>
+</ul>
+{{- if .Contact }}
+<p>If you believe this is an error, contact {{ .Contact }}.</p>
+{{- end }}
+</body>
+</html>
+`
+
+var blockPageTemplate = template.Must(template.New("block").Parse(BlockPageTemplate))
+
+// BlockPage is the data of the block page templates and of the JSON block responses
+type BlockPage struct {
+	Reason     string `json:"reason"`
+	Status     int    `json:"status"`
+	StatusText string `json:"-"`
+	Message    string `json:"message"`
+	Rule       string `json:"rule,omitempty"`
+	Category   string `json:"category,omitempty"`
+	URL        string `json:"url"`
+	ClientIP   string `json:"client_ip"`
+	ClientMAC  string `json:"client_mac,omitempty"`
+	User       string `json:"user,omitempty"`
+	Contact    string `json:"contact,omitempty"`
+}
+
+// denied sets the reason, the rule and the category of a request denied by match
+func (p BlockPage) denied(match acl.Match) BlockPage {
+	p.Reason = configuration.BlockReasonPolicy
+	if match.Rule == nil {
+		return p
+	}
+	p.Rule = match.Rule.Name
+	p.Category = match.Rule.Category
+	if match.Entry != nil && len(match.Entry.Category) > 0 {
+		p.Category = match.Entry.Category
+	}
+	if len(p.Category) > 0 {
+		p.Reason = configuration.BlockReasonCategory
+	}
+	return p
+}
+
+const (
+	formatText = iota
+	formatHTML
+	formatJSON
+)
+
+var mediaFormats = map[string]int{
+	"text/plain":            formatText,
+	"text/html":             formatHTML,
+	"application/xhtml+xml": formatHTML,
+	"application/json":      formatJSON,
+}
+
+// negotiateFormat returns the format preferred by the Accept header, the first one listed wins on equal quality.
+// Clients without preference, like the API clients sending */*, get text.
+func negotiateFormat(accept string) int {
+	format, quality := formatText, 0.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		params := strings.Split(mediaRange, ";")
+		candidate, ok := mediaFormats[strings.ToLower(strings.TrimSpace(params[0]))]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if value, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = value
+				}
+			}
+		}
+		if q > quality {
+			format, quality = candidate, q
+		}
+	}
+	return format
+}
+
+// blockResponse answers a refused request with a block page in the format accepted by the client
+func blockResponse(req *http.Request, pages *configuration.BlockPageConfig, page BlockPage, logger *log.Entry) *http.Response {
+	page.StatusText = http.StatusText(page.Status)
+	page.Contact = pages.SupportContact()
+	contentType, body := goproxy.ContentTypeText, page.Message
+	switch negotiateFormat(req.Header.Get("Accept")) {
+	case formatHTML:
+		tmpl := pages.Template(page.Reason)
+		if tmpl == nil {
+			tmpl = blockPageTemplate
+		}
+		buf := new(bytes.Buffer)
+		if err := tmpl.Execute(buf, page); err != nil {
+			logger.Errorf("cannot execute block page template: %s", err)
+			break
+		}
+		contentType, body = goproxy.ContentTypeHtml, buf.String()
+	case formatJSON:
+		content, err := json.Marshal(page)
+		if err != nil {
+			logger.Errorf("cannot encode block page: %s", err)
+			break
+		}
+		contentType, body = "application/json", string(content)
+	}
+	errorType, details := proxyErrorDenied, page.Rule
+	switch page.Reason {
+	case configuration.BlockReasonError:
+		errorType = proxyErrorDNS
+	case configuration.BlockReasonAuth:
+		details = "authentication"
+	case configuration.BlockReasonLimit:
+		details = "rate_limit"
+	}
+	resp := goproxy.NewResponse(req, contentType, page.Status, body)
+	if page.Reason == configuration.BlockReasonLimit {
+		resp.Header.Set("Retry-After", "1")
+	}
+	resp.Header.Set("Proxy-Status", proxyStatus(errorType, details))
+	resp.Header.Set("Vary", "Accept")
+	resp.Header.Set("Cache-Control", "no-store")
+	return resp
+}
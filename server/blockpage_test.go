@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/COSAE-FR/riproxy/configuration"
+	log "github.com/sirupsen/logrus"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func testLogger() *log.Entry {
+	logger := log.New()
+	logger.SetOutput(ioutil.Discard)
+	return log.NewEntry(logger)
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	for accept, expected := range map[string]int{
+		"":    formatText,
+		"*/*": formatText,
+		"text/html,application/xhtml+xml,*/*;q=0.8": formatHTML,
+		"application/json":                          formatJSON,
+		"application/json;q=0.5, text/html":         formatHTML,
+		"text/html;q=0.2, application/json;q=0.9":   formatJSON,
+		"text/html, application/json":               formatHTML, // first listed wins on equal quality
+		"TEXT/HTML":                                 formatHTML,
+		"image/png, text/plain;q=0.1":               formatText,
+		"text/html;q=0":                             formatText,
+	} {
+		if format := negotiateFormat(accept); format != expected {
+			t.Errorf("Accept %q: format %d, expected %d", accept, format, expected)
+		}
+	}
+}
+
+// blockBody returns the content type and the body of the block response to a request accepting accept
+func blockBody(t *testing.T, accept string, pages *configuration.BlockPageConfig, page BlockPage) (string, string) {
+	req, _ := http.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	req.Header.Set("Accept", accept)
+	resp := blockResponse(req, pages, page, testLogger())
+	if resp.StatusCode != page.Status || resp.Header.Get("Vary") != "Accept" || len(resp.Header.Get("Proxy-Status")) == 0 {
+		t.Fatalf("Wrong block response: %d %v", resp.StatusCode, resp.Header)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Cannot read block page: %s", err)
+	}
+	return resp.Header.Get("Content-Type"), string(body)
+}
+
+func TestBlockResponse(t *testing.T) {
+	page := BlockPage{Reason: configuration.BlockReasonCategory, Status: http.StatusForbidden, Message: "Blocked <ads>",
+		Rule: "ads", Category: "ads", URL: "http://www.example.com/", ClientIP: "192.0.2.1"}
+
+	contentType, body := blockBody(t, "*/*", nil, page)
+	if !strings.HasPrefix(contentType, "text/plain") || body != page.Message {
+		t.Errorf("Wrong text block page: %s %q", contentType, body)
+	}
+	contentType, body = blockBody(t, "text/html", nil, page)
+	if !strings.HasPrefix(contentType, "text/html") || !strings.Contains(body, "Blocked &lt;ads&gt;") || !strings.Contains(body, "<h1>Forbidden</h1>") {
+		t.Errorf("Wrong built-in block page: %s %q", contentType, body)
+	}
+	contentType, body = blockBody(t, "application/json", nil, page)
+	var decoded BlockPage
+	if err := json.Unmarshal([]byte(body), &decoded); err != nil || contentType != "application/json" {
+		t.Fatalf("Wrong JSON block page: %s %q %v", contentType, body, err)
+	}
+	if decoded.Reason != page.Reason || decoded.Status != page.Status || decoded.Category != "ads" || decoded.ClientIP != page.ClientIP {
+		t.Errorf("Wrong JSON block page content: %+v", decoded)
+	}
+
+	// The template of the reason wins over the default template and the built-in page
+	pages := &configuration.BlockPageConfig{Contact: "helpdesk@example.com", Templates: map[string]*template.Template{
+		configuration.BlockReasonDefault:  template.Must(template.New("default").Parse("default {{ .Reason }}")),
+		configuration.BlockReasonCategory: template.Must(template.New("category").Parse("category {{ .Category }} {{ .Contact }}")),
+	}}
+	if _, body = blockBody(t, "text/html", pages, page); body != "category ads helpdesk@example.com" {
+		t.Errorf("Category template not used: %q", body)
+	}
+	page.Reason, page.Category = configuration.BlockReasonPolicy, ""
+	if _, body = blockBody(t, "text/html", pages, page); body != "default policy" {
+		t.Errorf("Default template not used: %q", body)
+	}
+}
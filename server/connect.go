@@ -0,0 +1,83 @@
+package server
+
+import (
+	"github.com/COSAE-FR/riproxy/utils"
+	"github.com/elazarl/goproxy"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Error types of the Proxy-Status header (RFC 9209)
+const (
+	proxyErrorDenied          = "http_request_denied"
+	proxyErrorDNS             = "dns_error"
+	proxyErrorConnectionLimit = "connection_limit_reached"
+)
+
+// proxyStatus formats a Proxy-Status header with the error type and the details,
+// the details are restricted to the printable ASCII characters of a structured field string
+func proxyStatus(errorType string, details string) string {
+	value := utils.Name + "; error=" + errorType
+	if len(details) == 0 {
+		return value
+	}
+	var quoted strings.Builder
+	quoted.WriteByte('"')
+	for _, char := range details {
+		switch {
+		case char == '"' || char == '\\':
+			quoted.WriteByte('\\')
+			quoted.WriteRune(char)
+		case char < 0x20 || char > 0x7e:
+			quoted.WriteByte('?')
+		default:
+			quoted.WriteRune(char)
+		}
+	}
+	quoted.WriteByte('"')
+	return value + "; details=" + quoted.String()
+}
+
+// rejectConnect answers a refused CONNECT request with status, a short text body and a Proxy-Status header
+func rejectConnect(ctx *goproxy.ProxyCtx, status int, errorType string, details string, message string) *goproxy.ConnectAction {
+	resp := goproxy.NewResponse(ctx.Req, goproxy.ContentTypeText, status, message+"\n")
+	resp.ProtoMajor, resp.ProtoMinor = 1, 1
+	resp.Header.Set("Proxy-Status", proxyStatus(errorType, details))
+	resp.Close = true
+	ctx.Resp = resp
+	return goproxy.RejectConnect
+}
+
+// responseStatus returns the status of an HTTP status line, 0 if it cannot be parsed
+func responseStatus(statusLine []byte) int {
+	if len(statusLine) < 12 || string(statusLine[:5]) != "HTTP/" {
+		return 0
+	}
+	status, err := strconv.Atoi(string(statusLine[9:12]))
+	if err != nil {
+		return 0
+	}
+	return status
+}
+
+// TLS alerts sent to the transparent TLS clients instead of the CONNECT responses
+const (
+	tlsAlertAccessDenied  = 49
+	tlsAlertInternalError = 80
+)
+
+// writeTLSAlert writes a fatal TLS alert record
+func writeTLSAlert(c net.Conn, description byte) error {
+	_, err := c.Write([]byte{21, 3, 1, 0, 2, 2, description})
+	return err
+}
+
+// tlsAlert translates the status of a refused CONNECT request to a TLS alert
+func tlsAlert(status int) byte {
+	if status == http.StatusBadGateway || status == 0 {
+		return tlsAlertInternalError
+	}
+	return tlsAlertAccessDenied
+}
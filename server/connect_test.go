@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestProxyStatus(t *testing.T) {
+	tests := []struct {
+		errorType string
+		details   string
+		expected  string
+	}{
+		{proxyErrorDNS, "", `riproxy; error=dns_error`},
+		{proxyErrorDenied, "block", `riproxy; error=http_request_denied; details="block"`},
+		{proxyErrorDenied, `say "no"`, `riproxy; error=http_request_denied; details="say \"no\""`},
+		{proxyErrorDenied, `C:\rules`, `riproxy; error=http_request_denied; details="C:\\rules"`},
+		{proxyErrorDenied, "catégorie\n", `riproxy; error=http_request_denied; details="cat?gorie?"`},
+	}
+	for _, test := range tests {
+		if value := proxyStatus(test.errorType, test.details); value != test.expected {
+			t.Errorf("Wrong Proxy-Status %s, expected %s", value, test.expected)
+		}
+	}
+}
+
+func TestResponseStatus(t *testing.T) {
+	for line, expected := range map[string]int{
+		"HTTP/1.0 200 Connection established\r\n": http.StatusOK,
+		"HTTP/1.1 403 Forbidden\r\n":              http.StatusForbidden,
+		"HTTP/1.1 502 Bad Gateway":                http.StatusBadGateway,
+		"HTTP/1.1 20":                             0,
+		"SSH-2.0-OpenSSH_8.4\r\n":                 0,
+		"HTTP/1.1 abc Wrong\r\n":                  0,
+	} {
+		if status := responseStatus([]byte(line)); status != expected {
+			t.Errorf("%q: status %d, expected %d", line, status, expected)
+		}
+	}
+}
+
+func TestTLSAlert(t *testing.T) {
+	for status, expected := range map[int]byte{
+		http.StatusForbidden:         tlsAlertAccessDenied,
+		http.StatusProxyAuthRequired: tlsAlertAccessDenied,
+		http.StatusTooManyRequests:   tlsAlertAccessDenied,
+		http.StatusBadGateway:        tlsAlertInternalError,
+		0:                            tlsAlertInternalError,
+	} {
+		if alert := tlsAlert(status); alert != expected {
+			t.Errorf("Status %d: alert %d, expected %d", status, alert, expected)
+		}
+	}
+}
+
+func TestTransparentConn(t *testing.T) {
+	// A refused faux CONNECT request is answered with a single alert record
+	record := &recordConn{}
+	conn := &transparentConn{Conn: record}
+	for _, data := range []string{"HTTP/1.1 403 Forbidden\r\nProxy-Status: riproxy\r\n\r\n", "Blocked\n"} {
+		if n, err := conn.Write([]byte(data)); err != nil || n != len(data) {
+			t.Fatalf("Cannot write the response: %d %v", n, err)
+		}
+	}
+	if expected := []byte{21, 3, 1, 0, 2, 2, tlsAlertAccessDenied}; !bytes.Equal(record.written.Bytes(), expected) {
+		t.Errorf("Wrong alert %v, expected %v", record.written.Bytes(), expected)
+	}
+
+	// The response of an accepted request is hidden, the tunnel data is not modified
+	record = &recordConn{}
+	conn = &transparentConn{Conn: record}
+	_, _ = conn.Write([]byte("HTTP/1.0 200 Connection established\r\n\r\n"))
+	_, _ = conn.Write([]byte("server hello"))
+	if record.written.String() != "server hello" {
+		t.Errorf("Wrong tunnel data %q", record.written.String())
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/COSAE-FR/riproxy/ratelimit"
+	"github.com/COSAE-FR/riputils/arp"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// limitKeys returns the keys of a client in the rate limiter: its address and its MAC address if it is logged
+func limitKeys(ip net.IP, logMacAddress bool) []string {
+	keys := []string{ip.String()}
+	if logMacAddress {
+		if mac := arp.Search(keys[0]); len(mac.MacAddress) > 0 {
+			keys = append(keys, mac.MacAddress)
+		}
+	}
+	return keys
+}
+
+// logLimit logs a refusal of the limiter, the refusals of a client are reported once per ratelimit.ReportInterval
+func logLimit(logger *log.Entry, limiter *ratelimit.Limiter, limit string, result ratelimit.Result) {
+	if result.Hits == 0 {
+		return
+	}
+	requests, tunnels := limiter.Refused()
+	logger.WithFields(log.Fields{
+		"action":         "block",
+		"limit":          limit,
+		"limit_hits":     result.Hits,
+		"limit_requests": requests,
+		"limit_tunnels":  tunnels,
+	}).Warn("Client limit reached")
+}
+
+// mitmHandshakeTimeout is the time given to a client to complete the TLS handshake of an intercepted tunnel
+const mitmHandshakeTimeout = 10 * time.Second
+
+// tunnel holds the tunnel slot of a CONNECT request until its client connection is closed
+type tunnel struct {
+	lock        sync.Mutex
+	conn        net.Conn
+	live        bool
+	release     func()
+	readClosed  bool
+	writeClosed bool
+	handshake   *time.Timer
+}
+
+type tunnelKey struct{}
+
+// hold marks the tunnel as accepted, release, if any, is called once the client connection is closed
+func (t *tunnel) hold(release func()) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.live = true
+	t.release = release
+}
+
+func (t *tunnel) done() {
+	t.lock.Lock()
+	release := t.release
+	t.release = nil
+	if t.handshake != nil {
+		t.handshake.Stop()
+	}
+	t.lock.Unlock()
+	if release != nil {
+		release()
+	}
+}
+
+// close closes the hijacked client connection, if any, and releases the slot
+func (t *tunnel) close() {
+	t.lock.Lock()
+	conn := t.conn
+	t.lock.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+		return
+	}
+	t.done()
+}
+
+// finish closes the client connection of a CONNECT request that was not accepted by the handler
+func (t *tunnel) finish() {
+	t.lock.Lock()
+	live := t.live
+	t.lock.Unlock()
+	if !live {
+		t.close()
+	}
+}
+
+// intercept closes the client connection if the TLS handshake of the intercepted tunnel does not succeed within
+// timeout, goproxy does not close it when the handshake fails. The returned function is the VerifyConnection
+// callback of the TLS server, called once the handshake succeeded.
+func (t *tunnel) intercept(timeout time.Duration) func(tls.ConnectionState) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	timer := time.AfterFunc(timeout, t.close)
+	t.handshake = timer
+	return func(tls.ConnectionState) error {
+		timer.Stop()
+		return nil
+	}
+}
+
+// intercepted returns true if the client connection carries an intercepted TLS tunnel
+func (t *tunnel) intercepted() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.handshake != nil
+}
+
+// closeHalf marks a direction as closed, goproxy closes both directions of a TCP tunnel instead of the connection
+func (t *tunnel) closeHalf(read bool) {
+	t.lock.Lock()
+	if read {
+		t.readClosed = true
+	} else {
+		t.writeClosed = true
+	}
+	closed := t.readClosed && t.writeClosed
+	t.lock.Unlock()
+	if closed {
+		t.done()
+	}
+}
+
+type tunnelConn struct {
+	net.Conn
+	tunnel *tunnel
+}
+
+// Read closes the connection of an intercepted tunnel on error, goproxy stops reading it without closing it
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil && c.tunnel.intercepted() {
+		_ = c.Close()
+	}
+	return n, err
+}
+
+func (c *tunnelConn) Close() error {
+	c.tunnel.done()
+	return c.Conn.Close()
+}
+
+type halfCloser interface {
+	CloseRead() error
+	CloseWrite() error
+}
+
+// halfTunnelConn keeps the half close of the TCP client connections
+type halfTunnelConn struct {
+	*tunnelConn
+	halves halfCloser
+}
+
+func (c halfTunnelConn) CloseRead() error {
+	err := c.halves.CloseRead()
+	c.tunnel.closeHalf(true)
+	return err
+}
+
+func (c halfTunnelConn) CloseWrite() error {
+	err := c.halves.CloseWrite()
+	c.tunnel.closeHalf(false)
+	return err
+}
+
+// tunnelWriter ties the client connection hijacked by goproxy to the tunnel of the request
+type tunnelWriter struct {
+	http.ResponseWriter
+	tunnel *tunnel
+}
+
+func (w tunnelWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection cannot be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return conn, rw, err
+	}
+	tracked := &tunnelConn{Conn: conn, tunnel: w.tunnel}
+	w.tunnel.lock.Lock()
+	w.tunnel.conn = tracked
+	w.tunnel.lock.Unlock()
+	if halves, ok := conn.(halfCloser); ok {
+		return halfTunnelConn{tunnelConn: tracked, halves: halves}, rw, nil
+	}
+	return tracked, rw, nil
+}
+
+// trackTunnels attaches a tunnel to the CONNECT requests served by handler, the CONNECT handler holds its slot with it.
+// The client connection of a tunnel not accepted by the handler is closed when the handler returns.
+func trackTunnels(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		t := &tunnel{}
+		handler.ServeHTTP(tunnelWriter{ResponseWriter: w, tunnel: t}, req.WithContext(context.WithValue(req.Context(), tunnelKey{}, t)))
+		// goproxy serves the accepted tunnels in the background
+		t.finish()
+	})
+}
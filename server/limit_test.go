@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"github.com/COSAE-FR/riproxy/ratelimit"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// hijackWriter hands conn to the handler hijacking it
+type hijackWriter struct {
+	http.ResponseWriter
+	conn net.Conn
+}
+
+func (w hijackWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, nil, nil
+}
+
+// halfConn is a client connection closed by halves, like a TCP connection
+type halfConn struct {
+	recordConn
+}
+
+func (c *halfConn) CloseRead() error {
+	return nil
+}
+
+func (c *halfConn) CloseWrite() error {
+	return nil
+}
+
+// failingConn fails every read
+type failingConn struct {
+	recordConn
+}
+
+func (c *failingConn) Read([]byte) (int, error) {
+	return 0, errors.New("handshake failure")
+}
+
+// serveTunnel serves a CONNECT request with a handler hijacking conn, the handler holds a slot of limiter if accept
+// is true and returns the hijacked connection and the tunnel of the request
+func serveTunnel(t *testing.T, limiter *ratelimit.Limiter, conn net.Conn, accept bool) (net.Conn, *tunnel) {
+	var hijacked net.Conn
+	var held *tunnel
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var err error
+		if hijacked, _, err = w.(http.Hijacker).Hijack(); err != nil {
+			t.Fatalf("Cannot hijack connection: %s", err)
+		}
+		held = req.Context().Value(tunnelKey{}).(*tunnel)
+		if accept {
+			if !limiter.Open("192.0.2.1").Allowed {
+				t.Fatalf("Tunnel refused")
+			}
+			held.hold(func() {
+				limiter.Close("192.0.2.1")
+			})
+		}
+	})
+	req, _ := http.NewRequest(http.MethodConnect, "http://www.example.com:443", nil)
+	trackTunnels(handler).ServeHTTP(hijackWriter{conn: conn}, req)
+	return hijacked, held
+}
+
+// checkSlot checks if the only tunnel slot of limiter is used
+func checkSlot(t *testing.T, limiter *ratelimit.Limiter, used bool, context string) {
+	if result := limiter.Open("192.0.2.1"); result.Allowed == used {
+		t.Fatalf("%s: slot used %v, expected %v", context, !result.Allowed, used)
+	} else if result.Allowed {
+		limiter.Close("192.0.2.1")
+	}
+}
+
+func TestTunnelSlots(t *testing.T) {
+	limiter := ratelimit.NewLimiter(1000, 1000, 1)
+
+	record := &recordConn{}
+	conn, _ := serveTunnel(t, limiter, record, true)
+	checkSlot(t, limiter, true, "open tunnel")
+	_ = conn.Close()
+	_ = conn.Close()
+	checkSlot(t, limiter, false, "closed tunnel")
+	if !record.closed {
+		t.Fatalf("Client connection not closed")
+	}
+
+	// goproxy closes both directions of the TCP tunnels
+	conn, _ = serveTunnel(t, limiter, &halfConn{}, true)
+	_ = conn.(halfCloser).CloseRead()
+	checkSlot(t, limiter, true, "half closed tunnel")
+	_ = conn.(halfCloser).CloseWrite()
+	checkSlot(t, limiter, false, "closed directions")
+
+	// A tunnel not accepted by the handler is closed when the handler returns
+	record = &recordConn{}
+	serveTunnel(t, limiter, record, false)
+	if !record.closed {
+		t.Fatalf("Refused tunnel not closed")
+	}
+}
+
+func TestInterceptedTunnelSlots(t *testing.T) {
+	limiter := ratelimit.NewLimiter(1000, 1000, 1)
+
+	// The client does not complete the handshake
+	server, client := net.Pipe()
+	_, held := serveTunnel(t, limiter, server, true)
+	held.intercept(20 * time.Millisecond)
+	checkSlot(t, limiter, true, "handshake in progress")
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Client connection not closed after the handshake timeout: %v", err)
+	}
+	checkSlot(t, limiter, false, "handshake timeout")
+
+	// The handshake fails on a read error
+	failing := &failingConn{}
+	conn, held := serveTunnel(t, limiter, failing, true)
+	held.intercept(time.Minute)
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Read succeeded")
+	}
+	checkSlot(t, limiter, false, "failed handshake")
+	if !failing.closed {
+		t.Fatalf("Client connection not closed after the failed handshake")
+	}
+
+	// The handshake succeeds, the tunnel stays open
+	record := &recordConn{}
+	conn, held = serveTunnel(t, limiter, record, true)
+	verified := held.intercept(20 * time.Millisecond)
+	if err := verified(tls.ConnectionState{}); err != nil {
+		t.Fatalf("Handshake refused: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	checkSlot(t, limiter, true, "intercepted tunnel")
+	_ = conn.Close()
+	checkSlot(t, limiter, false, "closed intercepted tunnel")
+}
@@ -2,9 +2,12 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"github.com/COSAE-FR/riproxy/acl"
+	"github.com/COSAE-FR/riproxy/auth"
 	"github.com/COSAE-FR/riproxy/configuration"
-	"github.com/COSAE-FR/riproxy/domains"
+	"github.com/COSAE-FR/riproxy/upstream"
 	"github.com/COSAE-FR/riproxy/utils"
 	"github.com/COSAE-FR/riputils/arp"
 	"github.com/elazarl/goproxy"
@@ -16,110 +19,123 @@ import (
 	"time"
 )
 
-func DstHostIsIP() goproxy.ReqConditionFunc {
-	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
-		hostParts := strings.Split(ctx.Req.Host, ":")
-		destHost := ctx.Req.Host
-		if len(hostParts) == 2 {
-			destHost = hostParts[0]
-		}
-		return net.ParseIP(destHost) != nil
+// requestFromContext prepares the ACL request for a plain HTTP request
+func requestFromContext(ctx *goproxy.ProxyCtx, resolver acl.Resolver) *acl.Request {
+	ip, _ := utils.GetConnection(ctx.Req.RemoteAddr)
+	host := ctx.Req.URL.Host
+	if len(host) == 0 {
+		host = ctx.Req.Host
+	}
+	scheme := ctx.Req.URL.Scheme
+	if len(scheme) == 0 {
+		scheme = "http"
 	}
+	var defaultPort uint16 = 80
+	if scheme == "https" {
+		defaultPort = 443
+	}
+	req := acl.NewRequest(ip, host, defaultPort, ctx.Req.Method, scheme)
+	req.Path = ctx.Req.URL.Path
+	req.Resolver = resolver
+	return req
 }
 
-func DstPortIsblocked(configuration configuration.ProxyConfig) goproxy.ReqConditionFunc {
-	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
-		hostParts := strings.Split(ctx.Req.Host, ":")
-		destPort := "80"
-		if len(hostParts) == 2 {
-			destPort = hostParts[1]
-		}
-		if destPort == "80" { // Always allow port 80
-			return false
-		}
-		port, err := strconv.ParseUint(destPort, 10, 16)
-		if err != nil { // Block if cannot parse port
-			return true
-		}
-		if port == 80 { // Always allow port 80
-			return false
-		}
-		if !configuration.AllowHighPorts && port > 1024 {
-			return true
-		}
-		if !configuration.AllowLowPorts && port <= 1024 {
-			return true
-		}
-		return false
-	}
+// requestData is attached to the goproxy context of each request
+type requestData struct {
+	Match       acl.Match
+	Destination net.IP // address vetted by the rules and dialed by the proxy
+	User        string // authenticated user
+	Upstream    string // parent proxy or DIRECT, empty if no upstream route matched
+	Intercepted bool   // request read from an intercepted TLS connection
 }
 
-func MethodIsBlocked(allowed map[string]bool) goproxy.ReqConditionFunc {
-	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
-		return !allowed[ctx.Req.Method]
-	}
+// interceptedSession is the user data of the intercepted CONNECT requests,
+// the requests read from the TLS connection are authenticated by the CONNECT request
+type interceptedSession struct {
+	user string
 }
 
-func IpIsBlocked(blockList []net.IP, blockNetList []net.IPNet) goproxy.ReqConditionFunc {
-	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
-		hostParts := strings.Split(ctx.Req.Host, ":")
-		destIP, err := net.ResolveIPAddr("ip", hostParts[0])
-		if err == nil {
-			if connectTestDestIp(destIP.IP, blockList) {
-				return true
-			}
-			return connectTestDestSubnet(destIP.IP, blockNetList)
-		}
-		return false
-	}
+// pinnedAddress is attached to the context of plain HTTP requests, the transport dials address instead of resolving host again
+type pinnedAddress struct {
+	host    string
+	address net.IP
 }
 
-func addBlockList(proxy *goproxy.ProxyHttpServer, message string, list domains.DomainTree, logMacAddress bool, logger *log.Entry) *goproxy.ProxyHttpServer {
-	proxy.OnRequest(domains.DstHostIsIn(list)).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		prepareRequestLogger(logger, ctx, true, logMacAddress).Error(message)
-		return req, goproxy.NewResponse(req,
-			goproxy.ContentTypeText, http.StatusForbidden,
-			message)
-	})
-	return proxy
+type pinnedAddressKey struct{}
+
+// connectRoute is attached to CONNECT requests matching an upstream route
+type connectRoute struct {
+	route    *upstream.Route
+	upstream string // logged upstream, the first candidate
+	direct   string // pinned address dialed if no parent is available
+	logger   *log.Entry
 }
 
-func connectTestPort(portString string, configuration configuration.ProxyConfig) bool {
-	if portString == "443" { // Always allow port 443 for CONNECT
-		return true
-	}
-	port, err := strconv.ParseUint(portString, 10, 16)
-	if err != nil { // Block if cannot parse port
-		return false
-	}
-	if port == 443 { // Always allow port 443 for CONNECT
-		return true
-	}
-	if !configuration.AllowHighPorts && port > 1024 {
-		return false
+type connectRouteKey struct{}
+
+// pinnedDialer dials the pinned address of the request, the other hosts (like a parent proxy) are resolved with resolver
+func pinnedDialer(resolver acl.Resolver) func(ctx context.Context, network string, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if pinned, ok := ctx.Value(pinnedAddressKey{}).(pinnedAddress); ok && strings.EqualFold(host, pinned.host) {
+			return dialer.DialContext(ctx, network, net.JoinHostPort(pinned.address.String(), port))
+		}
+		if resolver != nil && net.ParseIP(host) == nil {
+			addresses, err := resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			if len(addresses) == 0 {
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+			addr = net.JoinHostPort(addresses[0].IP.String(), port)
+		}
+		return dialer.DialContext(ctx, network, addr)
 	}
-	if !configuration.AllowLowPorts && port <= 1024 {
-		return false
+}
+
+func getRequestData(ctx *goproxy.ProxyCtx) *requestData {
+	data, ok := ctx.UserData.(*requestData)
+	if !ok {
+		data = &requestData{}
+		ctx.UserData = data
 	}
-	return true
+	return data
 }
 
-func connectTestDestIp(destIp net.IP, blockList []net.IP) bool {
-	for _, blocked := range blockList {
-		if destIp.Equal(blocked) {
-			return true
+// withMatch adds the rule and the domain list entry that matched the request
+func withMatch(logger *log.Entry, match acl.Match) *log.Entry {
+	if match.Rule == nil {
+		return logger
+	}
+	logger = logger.WithField("acl", match.Rule.Name)
+	if match.Entry != nil {
+		logger = logger.WithFields(log.Fields{
+			"rule":        match.Entry.Pattern,
+			"rule_source": match.Entry.Source,
+		})
+		if len(match.Entry.Category) > 0 {
+			return logger.WithField("category", match.Entry.Category)
 		}
 	}
-	return false
+	if len(match.Rule.Category) > 0 {
+		logger = logger.WithField("category", match.Rule.Category)
+	}
+	return logger
 }
 
-func connectTestDestSubnet(destIp net.IP, blockList []net.IPNet) bool {
-	for _, blocked := range blockList {
-		if blocked.Contains(destIp) {
-			return true
+func logRuleMatches(logger *log.Entry, decision acl.Decision) {
+	for _, match := range decision.Logged {
+		message := match.Rule.Message
+		if len(message) == 0 {
+			message = "Matched by log rule"
 		}
+		withMatch(logger, match).Warn(message)
 	}
-	return false
 }
 
 var logHeaders = map[string]string{
@@ -147,6 +163,21 @@ func prepareRequestLogger(logger *log.Entry, ctx *goproxy.ProxyCtx, block bool,
 			requestLogger = requestLogger.WithField("src_mac", mac.MacAddress)
 		}
 	}
+	if data, ok := ctx.UserData.(*requestData); ok {
+		requestLogger = withMatch(requestLogger, data.Match)
+		if data.Destination != nil {
+			requestLogger = requestLogger.WithField("dest_ip", data.Destination.String())
+		}
+		if len(data.User) > 0 {
+			requestLogger = requestLogger.WithField("user", data.User)
+		}
+		if len(data.Upstream) > 0 {
+			requestLogger = requestLogger.WithField("upstream", data.Upstream)
+		}
+		if data.Intercepted {
+			requestLogger = requestLogger.WithField("intercepted", true)
+		}
+	}
 	for header, logField := range logHeaders {
 		field := ctx.Req.Header.Get(header)
 		if len(field) > 0 {
@@ -162,10 +193,72 @@ func prepareRequestLogger(logger *log.Entry, ctx *goproxy.ProxyCtx, block bool,
 	return requestLogger
 }
 
+// newBlockPage describes a refused plain HTTP or intercepted request
+func newBlockPage(ctx *goproxy.ProxyCtx, request *acl.Request, logMacAddress bool) BlockPage {
+	page := BlockPage{
+		URL:      ctx.Req.URL.String(),
+		ClientIP: request.Source.String(),
+		User:     request.User,
+	}
+	if logMacAddress {
+		page.ClientMAC = arp.Search(page.ClientIP).MacAddress
+	}
+	return page
+}
+
+// authenticate checks the proxy credentials of req sent from source, the user name is returned even if they are invalid
+func authenticate(config *configuration.AuthConfig, req *http.Request, source net.IP) (string, auth.Result, error) {
+	// The SOCKS proxy checks the credentials during its negotiation
+	if user, ok := req.Context().Value(authenticatedUserKey{}).(string); ok {
+		return user, auth.Accepted, nil
+	}
+	user, password, ok := auth.BasicCredentials(req.Header.Get("Proxy-Authorization"))
+	if !ok {
+		return "", auth.Rejected, nil
+	}
+	result, err := config.Authenticate(req.Context(), source.String(), user, password)
+	return user, result, err
+}
+
+// logAuthFailure logs a request without credentials at info level, invalid credentials are a warning
+func logAuthFailure(logger *log.Entry, user string, result auth.Result, err error) {
+	if len(user) > 0 {
+		logger = logger.WithField("auth_user", user)
+	}
+	switch {
+	case err != nil:
+		logger.Errorf("Proxy authentication backend error: %s", err)
+	case result == auth.Limited:
+		logger.Warn("Proxy authentication refused: too many failures")
+	case len(user) == 0:
+		logger.Info("Proxy authentication required")
+	default:
+		logger.Warn("Proxy authentication failed")
+	}
+}
+
+// authStatus returns the status of a response to a request without valid credentials
+func authStatus(result auth.Result) int {
+	if result == auth.Limited {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusProxyAuthRequired
+}
+
+// challengeConnect answers a CONNECT request without valid credentials
+func challengeConnect(ctx *goproxy.ProxyCtx, realm string, result auth.Result) *goproxy.ConnectAction {
+	if result == auth.Limited {
+		return rejectConnect(ctx, http.StatusTooManyRequests, proxyErrorDenied, "authentication", "Too many authentication failures")
+	}
+	action := rejectConnect(ctx, http.StatusProxyAuthRequired, proxyErrorDenied, "authentication", "Proxy authentication required")
+	ctx.Resp.Header.Set("Proxy-Authenticate", auth.Challenge(realm))
+	return action
+}
+
 type ProxyServer struct {
 	Interface configuration.InterfaceConfig
 	Global    *configuration.DefaultConfig
-	Listener  *net.TCPListener
+	Listeners []net.Listener
 	Http      *http.Server
 	Log       *log.Entry
 	Proxy     *goproxy.ProxyHttpServer
@@ -173,12 +266,14 @@ type ProxyServer struct {
 
 func (p ProxyServer) Start() error {
 	p.Log.Debug("starting Proxy daemon")
-	go func() {
-		err := p.Http.Serve(p.Listener)
-		if err != http.ErrServerClosed {
-			p.Log.Debugf("proxy server stopped with error: %s", err)
-		}
-	}()
+	for _, listener := range p.Listeners {
+		go func(listener net.Listener) {
+			err := p.Http.Serve(listener)
+			if err != http.ErrServerClosed {
+				p.Log.Debugf("proxy server stopped with error: %s", err)
+			}
+		}(listener)
+	}
 	return nil
 }
 
@@ -200,7 +295,56 @@ func NewProxy(iface configuration.InterfaceConfig, global *configuration.Default
 		"ip":        iface.Ip.String(),
 		"port":      iface.Proxy.Port,
 	})
+	// The configured resolver is used by the rules and for the outbound connections
+	var resolver acl.Resolver
+	if configured := global.LookupResolver(); configured != nil {
+		resolver = configured
+	}
 	proxy := goproxy.NewProxyHttpServer()
+	// Dial the address checked by the rules, the host is never resolved twice
+	dialer := pinnedDialer(resolver)
+	proxy.Tr.DialContext = dialer
+	router := global.UpstreamRouter()
+	limiter := iface.Proxy.RateLimit.ClientLimiter()
+	var parents *upstream.Transport
+	if router != nil {
+		// The plain HTTP requests of a route are sent by the rules handler through the parents
+		parents = upstream.NewTransport(router, proxy.Tr)
+		proxy.Tr.Proxy = nil
+		proxy.ConnectDialWithReq = func(req *http.Request, network string, addr string) (net.Conn, error) {
+			selected, ok := req.Context().Value(connectRouteKey{}).(connectRoute)
+			if !ok {
+				return dialer(req.Context(), network, addr)
+			}
+			conn, name, err := router.DialRoute(req.Context(), selected.route, addr, func() (net.Conn, error) {
+				if len(selected.direct) == 0 {
+					return nil, fmt.Errorf("cannot resolve destination host")
+				}
+				return dialer(req.Context(), network, selected.direct)
+			})
+			if err != nil {
+				selected.logger.WithField("action", "error").Errorf("Cannot connect through upstream: %s", err)
+			} else if name != selected.upstream {
+				selected.logger.WithField("upstream", name).Warn("Connect request sent to a fallback upstream")
+			}
+			return conn, err
+		}
+	}
+
+	// TLS interception of the selected domains, the intercepted servers are verified with the trust store
+	var mitmConnect *goproxy.ConnectAction
+	if global.Mitm != nil {
+		proxy.CertStore = global.Mitm.Certificates
+		proxy.Tr.TLSClientConfig = &tls.Config{RootCAs: global.Mitm.RootCAs}
+		tlsConfig := goproxy.TLSConfigFromCA(global.Mitm.CA)
+		mitmConnect = &goproxy.ConnectAction{Action: goproxy.ConnectMitm, TLSConfig: func(host string, ctx *goproxy.ProxyCtx) (*tls.Config, error) {
+			config, err := tlsConfig(host, ctx)
+			if t, ok := ctx.Req.Context().Value(tunnelKey{}).(*tunnel); ok && err == nil {
+				config.VerifyConnection = t.intercept(mitmHandshakeTimeout)
+			}
+			return config, err
+		}}
+	}
 
 	// Transparent HTTP proxy
 	if iface.Proxy.HttpTransparent {
@@ -217,57 +361,89 @@ func NewProxy(iface configuration.InterfaceConfig, global *configuration.Default
 		})
 	}
 
-	var blockedIps []net.IP
-
-	// Block if destination is a local service
-	if iface.Proxy.BlockLocalServices {
-		blockedIps = iface.Proxy.LocalIps
-	}
-	proxy.OnRequest(IpIsBlocked(blockedIps, iface.Direct.Networks)).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		prepareRequestLogger(logger, ctx, true, logMacAddress).Error("Blocked: destination is not allowed: local destination")
-		return req, goproxy.NewResponse(req,
-			goproxy.ContentTypeText, http.StatusForbidden,
-			"Blocked: destination is not allowed")
-	})
-
-	// Block if method is not allowed
-	allowedMethods := make(map[string]bool, len(iface.Proxy.AllowedMethods))
-	for _, method := range iface.Proxy.AllowedMethods {
-		allowedMethods[method] = true
-	}
-	proxy.OnRequest(MethodIsBlocked(allowedMethods)).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		prepareRequestLogger(logger, ctx, true, logMacAddress).Errorf("Blocked: method not allowed: %+v %+v", allowedMethods[ctx.Req.Method], allowedMethods)
-		return req, goproxy.NewResponse(req,
-			goproxy.ContentTypeText, http.StatusForbidden,
-			fmt.Sprintf("Blocked: method %s not allowed", ctx.Req.Method))
-	})
-
-	// Block if dest port is not allowed
-	proxy.OnRequest(DstPortIsblocked(iface.Proxy)).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-		prepareRequestLogger(logger, ctx, true, logMacAddress).Error("Blocked by host port policy")
-		return req, goproxy.NewResponse(req,
-			goproxy.ContentTypeText, http.StatusForbidden,
-			"Blocked by host port policy")
+	// Evaluate the interface rules, first match wins
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		request := requestFromContext(ctx, resolver)
+		if limiter != nil {
+			if result := limiter.Allow(limitKeys(request.Source, logMacAddress)...); !result.Allowed {
+				logLimit(prepareRequestLogger(proxyLogger, ctx, true, logMacAddress), limiter, "requests", result)
+				page := newBlockPage(ctx, request, logMacAddress)
+				page.Reason, page.Status, page.Message = configuration.BlockReasonLimit, http.StatusTooManyRequests, "Too many requests"
+				return req, blockResponse(req, global.BlockPages, page, proxyLogger)
+			}
+		}
+		session, intercepted := ctx.UserData.(interceptedSession)
+		data := getRequestData(ctx)
+		data.Intercepted = intercepted
+		if intercepted {
+			if iface.Proxy.Auth != nil && len(session.user) > 0 {
+				data.User = session.user
+				request.User, request.Groups = session.user, iface.Proxy.Auth.UserGroups(session.user)
+			}
+		} else if iface.Proxy.Auth != nil {
+			user, result, err := authenticate(iface.Proxy.Auth, req, request.Source)
+			if result != auth.Accepted {
+				logAuthFailure(prepareRequestLogger(proxyLogger, ctx, true, logMacAddress), user, result, err)
+				page := newBlockPage(ctx, request, logMacAddress)
+				page.Reason, page.Status, page.User = configuration.BlockReasonAuth, authStatus(result), user
+				if result == auth.Limited {
+					page.Message = "Too many authentication failures"
+					return req, blockResponse(req, global.BlockPages, page, proxyLogger)
+				}
+				page.Message = "Proxy authentication required"
+				resp := blockResponse(req, global.BlockPages, page, proxyLogger)
+				resp.Header.Set("Proxy-Authenticate", auth.Challenge(iface.Proxy.Auth.Realm))
+				return req, resp
+			}
+			data.User = user
+			request.User, request.Groups = user, iface.Proxy.Auth.UserGroups(user)
+		}
+		decision := iface.Proxy.Rules.Evaluate(request)
+		if len(decision.Logged) > 0 {
+			logRuleMatches(prepareRequestLogger(proxyLogger, ctx, false, logMacAddress), decision)
+		}
+		data.Match = decision.Match
+		if decision.Allowed() {
+			// The parent proxy resolves the host, the pinned address is only used for direct connections
+			if route := router.Route(request); route != nil {
+				if candidates := route.Candidates(); len(candidates) > 0 {
+					data.Upstream = candidates[0].Name
+					ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+						resp, name, err := parents.RoundTrip(req, route, func(req *http.Request) (*http.Response, error) {
+							data.Destination = request.Pinned()
+							if data.Destination == nil {
+								return nil, fmt.Errorf("cannot resolve destination host")
+							}
+							pinned := pinnedAddress{host: request.Host, address: data.Destination}
+							return proxy.Tr.RoundTrip(req.WithContext(context.WithValue(req.Context(), pinnedAddressKey{}, pinned)))
+						})
+						if len(name) > 0 {
+							data.Upstream = name
+						}
+						return resp, err
+					})
+					return req, nil
+				}
+				data.Upstream = upstream.Direct
+			}
+			data.Destination = request.Pinned()
+			if data.Destination == nil {
+				prepareRequestLogger(proxyLogger, ctx, true, logMacAddress).Error("Cannot resolve destination host")
+				page := newBlockPage(ctx, request, logMacAddress)
+				page.Reason, page.Status, page.Message = configuration.BlockReasonError, http.StatusBadGateway, "Cannot resolve destination host"
+				return req, blockResponse(req, global.BlockPages, page, proxyLogger)
+			}
+			pinned := pinnedAddress{host: request.Host, address: data.Destination}
+			return req.WithContext(context.WithValue(req.Context(), pinnedAddressKey{}, pinned)), nil
+		}
+		prepareRequestLogger(proxyLogger, ctx, true, logMacAddress).Error(decision.Rule.Message)
+		page := newBlockPage(ctx, request, logMacAddress).denied(decision.Match)
+		page.Status, page.Message = decision.Rule.Status, decision.Rule.Message
+		if page.Status == 0 {
+			page.Status = http.StatusForbidden
+		}
+		return req, blockResponse(req, global.BlockPages, page, proxyLogger)
 	})
-	// Block host IPs if configured
-	if iface.Proxy.BlockIPs {
-		proxy.OnRequest(DstHostIsIP()).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-			prepareRequestLogger(logger, ctx, true, logMacAddress).Error("Blocked by host policy")
-			return req, goproxy.NewResponse(req,
-				goproxy.ContentTypeText, http.StatusForbidden,
-				"Blocked by host policy")
-		})
-	}
-
-	// Add interface domain block list
-	if iface.Proxy.BlockList != nil {
-		proxy = addBlockList(proxy, "Blocked by interface policy", iface.Proxy.BlockList, logMacAddress, proxyLogger)
-	}
-
-	// Add global domain block list
-	if global != nil && global.Proxy.BlockList != nil {
-		proxy = addBlockList(proxy, "Blocked by global policy", global.Proxy.BlockList, logMacAddress, proxyLogger)
-	}
 	proxy.OnResponse().DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
 		requestLogger := prepareRequestLogger(proxyLogger, ctx, false, logMacAddress)
 		if ctx.Resp == nil {
@@ -279,15 +455,14 @@ func NewProxy(iface configuration.InterfaceConfig, global *configuration.Default
 	})
 	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
 		ip, port := utils.GetConnection(ctx.Req.RemoteAddr)
-		hostParts := strings.Split(host, ":")
 		destPort := "443"
 		destHost := host
-		if len(hostParts) == 2 {
-			destHost = hostParts[0]
-			destPort = hostParts[1]
+		if hostname, port, err := net.SplitHostPort(host); err == nil {
+			destHost = hostname
+			destPort = port
 		}
 		url := ctx.Req.URL.String()
-		if len(url) > 0 && !strings.HasPrefix(url, "https") {
+		if len(url) > 0 && len(ctx.Req.URL.Scheme) == 0 && !strings.HasPrefix(url, "https") {
 			url = fmt.Sprintf("https:%s", url)
 		}
 		requestLogger := proxyLogger.WithFields(log.Fields{
@@ -306,43 +481,82 @@ func NewProxy(iface configuration.InterfaceConfig, global *configuration.Default
 				requestLogger = requestLogger.WithField("src_mac", mac.MacAddress)
 			}
 		}
-		destIP, err := net.ResolveIPAddr("ip", destHost)
-		if err == nil {
-			if iface.Proxy.BlockLocalServices {
-				if connectTestDestIp(destIP.IP, iface.Proxy.LocalIps) {
-					requestLogger.WithField("action", "block").Error("Blocked: destination is not allowed: local service")
-					return goproxy.RejectConnect, host
-				}
+		var keys []string
+		if limiter != nil {
+			keys = limitKeys(ip, logMacAddress)
+			if result := limiter.Allow(keys...); !result.Allowed {
+				logLimit(requestLogger, limiter, "requests", result)
+				action := rejectConnect(ctx, http.StatusTooManyRequests, proxyErrorDenied, "rate_limit", "Too many requests")
+				ctx.Resp.Header.Set("Retry-After", "1")
+				return action, host
+			}
+		}
+		request := acl.NewRequest(ip, host, 443, ctx.Req.Method, "https")
+		request.Resolver = resolver
+		if iface.Proxy.Auth != nil {
+			user, result, err := authenticate(iface.Proxy.Auth, ctx.Req, ip)
+			if result != auth.Accepted {
+				logAuthFailure(requestLogger.WithField("action", "block"), user, result, err)
+				return challengeConnect(ctx, iface.Proxy.Auth.Realm, result), host
 			}
-			if connectTestDestSubnet(destIP.IP, iface.Direct.Networks) {
-				requestLogger.WithField("action", "block").Error("Blocked: destination is not allowed: local subnet")
-				return goproxy.RejectConnect, host
+			requestLogger = requestLogger.WithField("user", user)
+			request.User, request.Groups = user, iface.Proxy.Auth.UserGroups(user)
+		}
+		decision := iface.Proxy.Rules.Evaluate(request)
+		logRuleMatches(requestLogger, decision)
+		requestLogger = withMatch(requestLogger, decision.Match)
+		if !decision.Allowed() {
+			requestLogger.WithField("action", "block").Error(decision.Rule.Message)
+			status := decision.Rule.Status
+			if status == 0 {
+				status = http.StatusForbidden
+			}
+			return rejectConnect(ctx, status, proxyErrorDenied, decision.Rule.Name, decision.Rule.Message), host
+		}
+		// The tunnel slot is released when the client connection is closed
+		if t, ok := ctx.Req.Context().Value(tunnelKey{}).(*tunnel); ok {
+			var release func()
+			if limiter != nil {
+				if result := limiter.Open(keys...); !result.Allowed {
+					logLimit(requestLogger, limiter, "tunnels", result)
+					return rejectConnect(ctx, http.StatusTooManyRequests, proxyErrorConnectionLimit, "", "Too many open tunnels"), host
+				}
+				release = func() {
+					limiter.Close(keys...)
+				}
 			}
+			t.hold(release)
 		}
-		if !allowedMethods[ctx.Req.Method] {
-			requestLogger.WithField("action", "block").Error("Connect method blocked by policy")
-			return goproxy.RejectConnect, host
+		// The requests read from the TLS connection are checked like plain HTTP requests
+		if global.Mitm.Intercepts(request) {
+			ctx.UserData = interceptedSession{user: request.User}
+			requestLogger.WithField("action", "intercept").Info("Connect request")
+			return mitmConnect, host
 		}
-		if iface.Proxy.BlockIPs {
-			if net.ParseIP(destHost) != nil {
-				requestLogger.WithField("action", "block").Errorf("Connect to IP host %s not allowed", destHost)
-				return goproxy.RejectConnect, host
+		// Tunnel through the parents of the route, the pinned address is only used for direct connections
+		if route := router.Route(request); route != nil {
+			if candidates := route.Candidates(); len(candidates) > 0 {
+				selected := connectRoute{route: route, upstream: candidates[0].Name, logger: requestLogger}
+				if pinned := request.Pinned(); pinned != nil {
+					selected.direct = net.JoinHostPort(pinned.String(), strconv.Itoa(int(request.Port)))
+				}
+				ctx.Req = ctx.Req.WithContext(context.WithValue(ctx.Req.Context(), connectRouteKey{}, selected))
+				requestLogger.WithField("upstream", selected.upstream).Info("Connect request")
+				return goproxy.OkConnect, net.JoinHostPort(request.Host, strconv.Itoa(int(request.Port)))
 			}
+			requestLogger = requestLogger.WithField("upstream", upstream.Direct)
 		}
-		if !connectTestPort(destPort, iface.Proxy) {
-			requestLogger.WithField("action", "block").Errorf("Connect port %s not allowed", destPort)
-			return goproxy.RejectConnect, host
+		// Tunnel to the address checked by the rules, goproxy would resolve the host again
+		pinned := request.Pinned()
+		if pinned == nil {
+			requestLogger.WithField("action", "block").Error("Cannot resolve destination host")
+			return rejectConnect(ctx, http.StatusBadGateway, proxyErrorDNS, "", "Cannot resolve destination host"), host
 		}
-		requestLogger.Info("Connect request")
-		return goproxy.OkConnect, host
+		requestLogger.WithField("dest_ip", pinned.String()).Info("Connect request")
+		return goproxy.OkConnect, net.JoinHostPort(pinned.String(), strconv.Itoa(int(request.Port)))
 	})
 	proxy.Logger = proxyLogger
-	la, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", iface.Ip, iface.Proxy.Port))
-	if err != nil {
-		proxyLogger.Errorf("cannot parse proxy bind address for %s", iface.Name)
-		return nil, err
-	}
-	listener, err := net.ListenTCP("tcp4", la)
+	listeners, err := listen(iface.Ips, iface.Proxy.Port)
 	if err != nil {
 		proxyLogger.Errorf("cannot bind proxy address for %s", iface.Name)
 		return nil, err
@@ -352,8 +566,8 @@ func NewProxy(iface configuration.InterfaceConfig, global *configuration.Default
 		Global:    global,
 		Log:       proxyLogger,
 		Proxy:     proxy,
-		Listener:  listener,
-		Http:      &http.Server{Handler: proxy},
+		Listeners: listeners,
+		Http:      &http.Server{Handler: trackTunnels(proxy)},
 	}
 	return &proxyServer, nil
 }
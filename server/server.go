@@ -13,7 +13,7 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"strings"
+	"strconv"
 	"time"
 )
 
@@ -24,16 +24,38 @@ type reverseProxy struct {
 
 type Server struct {
 	Interface      configuration.InterfaceConfig
-	Listener       *net.TCPListener
+	Listeners      []net.Listener
 	Http           *http.Server
 	Log            *log.Entry
 	WpadFile       string
+	CACertificate  []byte // CA certificate of the TLS interception, served by the WPAD service
 	ReverseProxies map[string]reverseProxy
 	Proxy          *ProxyServer
 	TransparentTls *TransparentTlsProxy
+	Socks          *SocksProxy
 	LogMacAddress  bool
 }
 
+// listen opens a listener on port for every address, IPv4 and IPv6 addresses use their own listener
+func listen(ips []net.IP, port uint16) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, ip := range ips {
+		network := "tcp4"
+		if ip.To4() == nil {
+			network = "tcp6"
+		}
+		listener, err := net.Listen(network, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+		if err != nil {
+			for _, opened := range listeners {
+				_ = opened.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
 func (d Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ip, port := utils.GetConnection(r.RemoteAddr)
 	logger := d.Log.WithFields(log.Fields{
@@ -51,9 +73,8 @@ func (d Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	host := r.Host
-	hostParts := strings.Split(r.Host, ":")
-	if len(hostParts) > 1 {
-		host = hostParts[0]
+	if hostname, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = hostname
 	}
 	proxy, ok := d.ReverseProxies[host]
 	if ok {
@@ -84,6 +105,13 @@ func (d Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				}).Infof("WPAD request %s", r.URL.Path)
 				w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
 				_, _ = fmt.Fprint(w, d.WpadFile)
+			} else if r.URL.Path == CACertificatePath && len(d.CACertificate) > 0 {
+				logger.WithFields(log.Fields{
+					"component": "wpad",
+					"status":    200,
+				}).Info("CA certificate request")
+				w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+				_, _ = w.Write(d.CACertificate)
 			} else {
 				logger.WithFields(log.Fields{
 					"type":   "wpad",
@@ -112,23 +140,28 @@ func (d Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (d *Server) Start() error {
 	if d.Interface.ShouldStartHttp() && d.Http != nil {
-		if d.Listener == nil {
+		if len(d.Listeners) == 0 {
 			d.Log.Error("Mandatory listener not ready")
 			return errors.New("missing listener")
 		}
-		go func() {
-			d.Log.Debug("starting HTTP daemon")
-			err := d.Http.Serve(d.Listener)
-			if err != http.ErrServerClosed {
-				d.Log.Debugf("HTTP server stopped with error: %s", err)
-			}
-		}()
+		d.Log.Debug("starting HTTP daemon")
+		for _, listener := range d.Listeners {
+			go func(listener net.Listener) {
+				err := d.Http.Serve(listener)
+				if err != http.ErrServerClosed {
+					d.Log.Debugf("HTTP server stopped with error: %s", err)
+				}
+			}(listener)
+		}
 	}
 	if d.Interface.EnableProxy && d.Proxy != nil {
 		_ = d.Proxy.Start()
 		if d.Interface.Proxy.HttpsTransparentPort > 0 && d.TransparentTls != nil {
 			_ = d.TransparentTls.Start()
 		}
+		if d.Interface.Proxy.SocksPort > 0 && d.Socks != nil {
+			_ = d.Socks.Start()
+		}
 	}
 	return nil
 }
@@ -156,6 +189,12 @@ func (d Server) Stop() error {
 				d.Log.Errorf("transparent HTTPS proxy server shutdown error: %s", err)
 			}
 		}
+		if d.Interface.Proxy.SocksPort > 0 && d.Socks != nil {
+			err = d.Socks.Stop()
+			if err != nil {
+				d.Log.Errorf("SOCKS proxy server shutdown error: %s", err)
+			}
+		}
 	}
 	return err
 }
@@ -173,12 +212,7 @@ func New(iface configuration.InterfaceConfig, global *configuration.DefaultConfi
 	if iface.ShouldStartHttp() {
 		logger.Debug("Creating handler HTTP")
 		svr.Http = &http.Server{Handler: &svr}
-		la, err := net.ResolveTCPAddr("tcp4", fmt.Sprintf("%s:%d", iface.Ip.String(), configuration.DefaultBindPort))
-		if err != nil {
-			logger.Errorf("cannot parse bind address for %s", iface.Name)
-			return nil, err
-		}
-		svr.Listener, err = net.ListenTCP("tcp4", la)
+		svr.Listeners, err = listen(iface.Ips, configuration.DefaultBindPort)
 		if err != nil {
 			logger.Errorf("cannot bind address for %s", iface.Name)
 			return nil, err
@@ -193,12 +227,13 @@ func New(iface configuration.InterfaceConfig, global *configuration.DefaultConfi
 				return nil, err
 			}
 			svr.WpadFile = buf.String()
+			svr.CACertificate = global.MitmCertificate()
 		}
 
 		// Setup reverse proxy service
 		svr.ReverseProxies = make(map[string]reverseProxy, len(iface.ReverseProxies))
 		for name, config := range iface.ReverseProxies {
-			targetUrl, _ := url.Parse(fmt.Sprintf("http://%s:%d/", config.PeerIp.String(), config.PeerPort))
+			targetUrl, _ := url.Parse("http://" + net.JoinHostPort(config.PeerIp.String(), strconv.Itoa(int(config.PeerPort))) + "/")
 			srcAddr := &net.TCPAddr{
 				IP: config.SourceIP,
 			}
@@ -244,6 +279,13 @@ func New(iface configuration.InterfaceConfig, global *configuration.DefaultConfi
 				return nil, err
 			}
 		}
+		if iface.Proxy.SocksPort > 0 {
+			svr.Socks, err = NewSocksProxy(iface, svr.Proxy.Proxy, logMacAddress, logger)
+			if err != nil {
+				logger.Errorf("cannot create SOCKS proxy server: %s", err)
+				return nil, err
+			}
+		}
 	}
 	return &svr, nil
 }
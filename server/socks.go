@@ -0,0 +1,375 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/COSAE-FR/riproxy/auth"
+	"github.com/COSAE-FR/riproxy/configuration"
+	"github.com/COSAE-FR/riproxy/utils"
+	"github.com/COSAE-FR/riputils/arp"
+	"github.com/elazarl/goproxy"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	socksVersion          = 5
+	socksAuthNone         = 0x00
+	socksAuthPassword     = 0x02
+	socksAuthNoAcceptable = 0xff
+	socksConnect          = 0x01
+	socksIPv4             = 0x01
+	socksDomain           = 0x03
+	socksIPv6             = 0x04
+
+	socksSucceeded           = 0x00
+	socksGeneralFailure      = 0x01
+	socksNotAllowed          = 0x02
+	socksHostUnreachable     = 0x04
+	socksCommandNotSupported = 0x07
+	socksAddressNotSupported = 0x08
+
+	socksHandshakeTimeout = 10 * time.Second
+)
+
+var errSocksAuthentication = errors.New("invalid credentials")
+
+// authenticatedUserKey holds the user authenticated by the SOCKS negotiation in the context of the CONNECT request
+type authenticatedUserKey struct{}
+
+// SocksProxy accepts SOCKS5 CONNECT requests and hands them to the CONNECT handler of the HTTP proxy,
+// the tunnels are checked and logged like the CONNECT requests
+type SocksProxy struct {
+	Proxy         *goproxy.ProxyHttpServer
+	Auth          *configuration.AuthConfig // require a user name and password if set
+	Log           *log.Entry
+	LogMacAddress bool
+	listeners     []net.Listener
+	stop          chan struct{}
+	wg            sync.WaitGroup
+}
+
+func NewSocksProxy(iface configuration.InterfaceConfig, proxy *goproxy.ProxyHttpServer, logMacAddress bool, logger *log.Entry) (*SocksProxy, error) {
+	proxyLogger := logger.WithFields(log.Fields{
+		"component": "socks",
+		"port":      iface.Proxy.SocksPort,
+	})
+	listeners, err := listen(iface.Ips, iface.Proxy.SocksPort)
+	if err != nil {
+		proxyLogger.Error("Cannot listen on interface")
+		return nil, err
+	}
+	return &SocksProxy{
+		Proxy:         proxy,
+		Auth:          iface.Proxy.Auth,
+		Log:           proxyLogger,
+		LogMacAddress: logMacAddress,
+		listeners:     listeners,
+		stop:          make(chan struct{}),
+	}, nil
+}
+
+func (d *SocksProxy) Start() error {
+	d.Log.Debug("starting SOCKS proxy")
+	for _, listener := range d.listeners {
+		d.wg.Add(1)
+		go d.run(listener)
+	}
+	return nil
+}
+
+func (d *SocksProxy) Stop() error {
+	d.Log.Debug("stopping SOCKS proxy")
+	close(d.stop)
+	for _, listener := range d.listeners {
+		if err := listener.Close(); err != nil {
+			d.Log.Errorf("Cannot close listener: %s", err)
+		}
+	}
+	d.wg.Wait()
+	return nil
+}
+
+func (d *SocksProxy) run(listener net.Listener) {
+	defer d.wg.Done()
+	for {
+		c, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-d.stop:
+				return
+			default:
+				d.Log.Errorf("Error accepting new connection: %s", err)
+				continue
+			}
+		}
+		d.wg.Add(1)
+		go func(c net.Conn) {
+			defer d.wg.Done()
+			d.serve(c)
+		}(c)
+	}
+}
+
+func (d *SocksProxy) serve(c net.Conn) {
+	ip, port := utils.GetConnection(c.RemoteAddr().String())
+	logger := d.Log.WithFields(log.Fields{
+		"src":      ip.String(),
+		"src_port": port,
+		"action":   "error",
+	})
+	if d.LogMacAddress {
+		mac := arp.Search(ip.String())
+		if len(mac.MacAddress) > 0 {
+			logger = logger.WithField("src_mac", mac.MacAddress)
+		}
+	}
+	_ = c.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	reader := bufio.NewReader(c)
+	var check func(string, string) bool
+	if d.Auth != nil {
+		check = func(user string, password string) bool {
+			result, err := d.Auth.Authenticate(context.Background(), ip.String(), user, password)
+			if result != auth.Accepted {
+				logAuthFailure(logger.WithField("action", "block"), user, result, err)
+				return false
+			}
+			return true
+		}
+	}
+	user, err := negotiateSocks(c, reader, check)
+	if err != nil {
+		if err != errSocksAuthentication {
+			logger.Errorf("SOCKS negotiation failed: %s", err)
+		}
+		_ = c.Close()
+		return
+	}
+	target, err := readSocksRequest(c, reader)
+	if err != nil {
+		logger.Errorf("Invalid SOCKS request: %s", err)
+		_ = c.Close()
+		return
+	}
+	_ = c.SetDeadline(time.Time{})
+	connectReq := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Scheme: "socks5", Host: target},
+		Host:       target,
+		Header:     make(http.Header),
+		RemoteAddr: c.RemoteAddr().String(),
+	}
+	if len(user) > 0 {
+		connectReq = connectReq.WithContext(context.WithValue(context.Background(), authenticatedUserKey{}, user))
+	}
+	var conn net.Conn = c
+	if reader.Buffered() > 0 {
+		conn = &bufferedConn{Conn: c, reader: reader}
+	}
+	trackTunnels(d.Proxy).ServeHTTP(socksResponseWriter{&socksConn{Conn: conn}}, connectReq)
+}
+
+// negotiateSocks selects the authentication method and returns the user authenticated by check.
+// Without check, no authentication is required and the credentials sent by the client are not used.
+func negotiateSocks(c net.Conn, reader *bufio.Reader, check func(user string, password string) bool) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+	offered := map[byte]bool{}
+	for _, method := range methods {
+		offered[method] = true
+	}
+	method := byte(socksAuthNoAcceptable)
+	switch {
+	case check == nil && offered[socksAuthNone]:
+		method = socksAuthNone
+	case offered[socksAuthPassword]:
+		method = socksAuthPassword
+	}
+	if _, err := c.Write([]byte{socksVersion, method}); err != nil {
+		return "", err
+	}
+	switch method {
+	case socksAuthNone:
+		return "", nil
+	case socksAuthNoAcceptable:
+		return "", errors.New("no acceptable authentication method")
+	}
+	// Username and password sub-negotiation (RFC 1929), any status but 0 is a failure closing the connection
+	version, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if version != 1 {
+		return "", fmt.Errorf("unsupported authentication version %d", version)
+	}
+	user, err := readSocksString(reader)
+	if err != nil {
+		return "", err
+	}
+	password, err := readSocksString(reader)
+	if err != nil {
+		return "", err
+	}
+	if check == nil {
+		user = ""
+	} else if !check(user, password) {
+		_, _ = c.Write([]byte{1, socksGeneralFailure})
+		return "", errSocksAuthentication
+	}
+	if _, err := c.Write([]byte{1, socksSucceeded}); err != nil {
+		return "", err
+	}
+	return user, nil
+}
+
+func readSocksString(reader *bufio.Reader) (string, error) {
+	length, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(reader, value); err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// readSocksRequest reads a CONNECT request and returns the destination host and port
+func readSocksRequest(c net.Conn, reader *bufio.Reader) (string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	if header[1] != socksConnect {
+		_ = writeSocksReply(c, socksCommandNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS command %d", header[1])
+	}
+	var host string
+	switch header[3] {
+	case socksIPv4, socksIPv6:
+		length := net.IPv4len
+		if header[3] == socksIPv6 {
+			length = net.IPv6len
+		}
+		address := make([]byte, length)
+		if _, err := io.ReadFull(reader, address); err != nil {
+			return "", err
+		}
+		host = net.IP(address).String()
+	case socksDomain:
+		name, err := readSocksString(reader)
+		if err != nil {
+			return "", err
+		}
+		host = name
+	default:
+		_ = writeSocksReply(c, socksAddressNotSupported)
+		return "", fmt.Errorf("unsupported SOCKS address type %d", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(reader, port); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
+
+// writeSocksReply answers a request, the bound address is not disclosed
+func writeSocksReply(w io.Writer, code byte) error {
+	_, err := w.Write([]byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// socksReplyCode translates the HTTP status line written by the proxy to a SOCKS reply code
+func socksReplyCode(statusLine []byte) byte {
+	switch status := responseStatus(statusLine); {
+	case status == 0:
+		return socksGeneralFailure
+	case status == http.StatusOK:
+		return socksSucceeded
+	case status == http.StatusBadGateway:
+		return socksHostUnreachable
+	}
+	return socksNotAllowed
+}
+
+// socksConn translates the response of the CONNECT handler to a SOCKS reply, the tunnel data is not modified.
+// The rest of a refusal response is discarded.
+type socksConn struct {
+	net.Conn
+	replied bool
+	refused bool
+}
+
+func (c *socksConn) Write(b []byte) (int, error) {
+	if c.refused {
+		return len(b), nil
+	}
+	if c.replied {
+		return c.Conn.Write(b)
+	}
+	c.replied = true
+	code := socksReplyCode(b)
+	c.refused = code != socksSucceeded
+	if err := writeSocksReply(c.Conn, code); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close refuses the request if the proxy rejected it without response
+func (c *socksConn) Close() error {
+	if !c.replied {
+		c.replied = true
+		_ = writeSocksReply(c.Conn, socksNotAllowed)
+	}
+	return c.Conn.Close()
+}
+
+type socksResponseWriter struct {
+	conn *socksConn
+}
+
+func (w socksResponseWriter) Header() http.Header {
+	return http.Header{}
+}
+
+func (w socksResponseWriter) Write(buf []byte) (int, error) {
+	return w.conn.Write(buf)
+}
+
+func (w socksResponseWriter) WriteHeader(int) {
+}
+
+func (w socksResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// bufferedConn reads the data buffered during the SOCKS negotiation first
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/COSAE-FR/riproxy/auth"
+	"github.com/COSAE-FR/riproxy/configuration"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// recordConn keeps the data written to the connection
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+	closed  bool
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func (c *recordConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// socksExchange sends request to serve through a pipe and returns the answer of serve
+func socksExchange(t *testing.T, request []byte, serve func(c net.Conn, reader *bufio.Reader)) []byte {
+	server, client := net.Pipe()
+	go func() {
+		serve(server, bufio.NewReader(server))
+		_ = server.Close()
+	}()
+	go func() {
+		_, _ = client.Write(request)
+	}()
+	answer, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("Cannot read answer: %s", err)
+	}
+	return answer
+}
+
+func TestSocksNegotiate(t *testing.T) {
+	check := func(user string, password string) bool {
+		return user == "alice:smith" && password == "pwd"
+	}
+	tests := []struct {
+		name    string
+		auth    bool
+		request []byte
+		answer  []byte
+		user    string
+		fails   bool
+	}{
+		{"no auth", false, []byte{5, 1, socksAuthNone}, []byte{5, socksAuthNone}, "", false},
+		{"auth required", true, []byte{5, 1, socksAuthNone}, []byte{5, socksAuthNoAcceptable}, "", true},
+		{"password", true, []byte{5, 2, socksAuthNone, socksAuthPassword, 1, 11, 'a', 'l', 'i', 'c', 'e', ':', 's', 'm', 'i', 't', 'h', 3, 'p', 'w', 'd'},
+			[]byte{5, socksAuthPassword, 1, socksSucceeded}, "alice:smith", false},
+		{"wrong password", true, []byte{5, 1, socksAuthPassword, 1, 11, 'a', 'l', 'i', 'c', 'e', ':', 's', 'm', 'i', 't', 'h', 3, 'b', 'a', 'd'},
+			[]byte{5, socksAuthPassword, 1, socksGeneralFailure}, "", true},
+		{"password offered without auth", false, []byte{5, 1, socksAuthPassword, 1, 1, 'u', 1, 'p'},
+			[]byte{5, socksAuthPassword, 1, socksSucceeded}, "", false},
+		{"wrong sub-negotiation version", true, []byte{5, 1, socksAuthPassword, 2, 1, 'u', 1, 'p'}, []byte{5, socksAuthPassword}, "", true},
+		{"wrong version", false, []byte{4, 1, socksAuthNone}, nil, "", true},
+	}
+	for _, test := range tests {
+		var testCheck func(string, string) bool
+		if test.auth {
+			testCheck = check
+		}
+		var user string
+		var err error
+		answer := socksExchange(t, test.request, func(c net.Conn, reader *bufio.Reader) {
+			user, err = negotiateSocks(c, reader, testCheck)
+		})
+		if !bytes.Equal(answer, test.answer) {
+			t.Errorf("%s: wrong answer %v, expected %v", test.name, answer, test.answer)
+		}
+		if (err != nil) != test.fails || user != test.user {
+			t.Errorf("%s: wrong result %q %v", test.name, user, err)
+		}
+	}
+}
+
+func TestSocksAuthenticatedUser(t *testing.T) {
+	// The user authenticated by the SOCKS negotiation is not checked again, the other requests are
+	config := &configuration.AuthConfig{}
+	req, _ := http.NewRequest(http.MethodConnect, "http://www.example.com:443", nil)
+	req.Header.Set("Proxy-Authorization", "Basic YWxpY2U6cHdk")
+	if user, result, _ := authenticate(config, req, net.ParseIP("192.0.2.1")); user != "alice" || result != auth.Rejected {
+		t.Errorf("Credentials not checked: %q %v", user, result)
+	}
+	req = req.WithContext(context.WithValue(context.Background(), authenticatedUserKey{}, "alice:smith"))
+	if user, result, _ := authenticate(config, req, net.ParseIP("192.0.2.1")); user != "alice:smith" || result != auth.Accepted {
+		t.Errorf("SOCKS user not accepted: %q %v", user, result)
+	}
+}
+
+func TestSocksRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+		target  string
+		reply   byte // 0 if the request is valid
+	}{
+		{"domain", []byte{5, socksConnect, 0, socksDomain, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 1, 187}, "example.com:443", 0},
+		{"IPv4", []byte{5, socksConnect, 0, socksIPv4, 192, 0, 2, 1, 0, 80}, "192.0.2.1:80", 0},
+		{"IPv6", []byte{5, socksConnect, 0, socksIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 187}, "[2001:db8::1]:443", 0},
+		{"bind", []byte{5, 2, 0, socksIPv4, 192, 0, 2, 1, 0, 80}, "", socksCommandNotSupported},
+		{"unknown address type", []byte{5, socksConnect, 0, 5, 192, 0, 2, 1, 0, 80}, "", socksAddressNotSupported},
+	}
+	for _, test := range tests {
+		var target string
+		var err error
+		answer := socksExchange(t, test.request, func(c net.Conn, reader *bufio.Reader) {
+			target, err = readSocksRequest(c, reader)
+		})
+		if test.reply == 0 {
+			if err != nil || target != test.target || len(answer) > 0 {
+				t.Errorf("%s: wrong target %q %v", test.name, target, err)
+			}
+			continue
+		}
+		if err == nil || len(answer) < 2 || answer[1] != test.reply {
+			t.Errorf("%s: wrong refusal %v %v", test.name, answer, err)
+		}
+	}
+}
+
+func TestSocksReply(t *testing.T) {
+	tests := []struct {
+		response string
+		reply    byte
+	}{
+		{"HTTP/1.0 200 Connection established\r\n\r\n", socksSucceeded},
+		{"HTTP/1.1 403 Forbidden\r\nContent-Length: 5\r\n\r\nblock", socksNotAllowed},
+		{"HTTP/1.1 407 Proxy Authentication Required\r\n\r\n", socksNotAllowed},
+		{"HTTP/1.1 429 Too Many Requests\r\n\r\n", socksNotAllowed},
+		{"HTTP/1.1 502 Bad Gateway\r\n\r\n", socksHostUnreachable},
+		{"garbage", socksGeneralFailure},
+	}
+	for _, test := range tests {
+		record := &recordConn{}
+		conn := &socksConn{Conn: record}
+		if _, err := conn.Write([]byte(test.response)); err != nil {
+			t.Fatalf("Cannot write response: %s", err)
+		}
+		// The tunnel data is not modified, the rest of a refusal is discarded
+		_, _ = conn.Write([]byte("data"))
+		expected := []byte{socksVersion, test.reply, 0, socksIPv4, 0, 0, 0, 0, 0, 0}
+		if test.reply == socksSucceeded {
+			expected = append(expected, "data"...)
+		}
+		if !bytes.Equal(record.written.Bytes(), expected) {
+			t.Errorf("%q: wrong reply %v", test.response, record.written.Bytes())
+		}
+	}
+	// A request rejected without response is refused on close
+	record := &recordConn{}
+	_ = (&socksConn{Conn: record}).Close()
+	if !bytes.Equal(record.written.Bytes(), []byte{socksVersion, socksNotAllowed, 0, socksIPv4, 0, 0, 0, 0, 0, 0}) || !record.closed {
+		t.Errorf("Wrong reply on close: %v", record.written.Bytes())
+	}
+}
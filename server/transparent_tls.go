@@ -2,8 +2,6 @@ package server
 
 import (
 	"bufio"
-	"bytes"
-	"fmt"
 	"github.com/COSAE-FR/riproxy/configuration"
 	"github.com/COSAE-FR/riproxy/utils"
 	"github.com/COSAE-FR/riputils/arp"
@@ -20,7 +18,7 @@ type TransparentTlsProxy struct {
 	Proxy         *goproxy.ProxyHttpServer
 	Log           *log.Entry
 	LogMacAddress bool
-	listener      net.Listener
+	listeners     []net.Listener
 	stop          chan struct{}
 	wg            sync.WaitGroup
 }
@@ -30,7 +28,7 @@ func NewTransparentTlsProxy(iface configuration.InterfaceConfig, proxy *goproxy.
 		"component": "https_transparent",
 		"port":      iface.Proxy.HttpsTransparentPort,
 	})
-	ln, err := net.Listen("tcp", fmt.Sprintf("%s:%d", iface.Ip.String(), iface.Proxy.HttpsTransparentPort))
+	listeners, err := listen(iface.Ips, iface.Proxy.HttpsTransparentPort)
 	if err != nil {
 		proxyLogger.Error("Cannot listen on interface")
 		return nil, err
@@ -39,7 +37,7 @@ func NewTransparentTlsProxy(iface configuration.InterfaceConfig, proxy *goproxy.
 		Proxy:         proxy,
 		Log:           proxyLogger,
 		LogMacAddress: logMacAddress,
-		listener:      ln,
+		listeners:     listeners,
 		stop:          make(chan struct{}),
 	}
 
@@ -48,25 +46,29 @@ func NewTransparentTlsProxy(iface configuration.InterfaceConfig, proxy *goproxy.
 
 func (d *TransparentTlsProxy) Start() error {
 	d.Log.Debug("starting HTTPS transparent proxy")
-	go d.run()
+	for _, listener := range d.listeners {
+		go d.run(listener)
+	}
 	return nil
 }
 
 func (d *TransparentTlsProxy) Stop() error {
 	d.Log.Debug("stopping HTTPS transparent proxy")
 	close(d.stop)
-	if err := d.listener.Close(); err != nil {
-		d.Log.Errorf("Cannot close listener: %s", err)
+	for _, listener := range d.listeners {
+		if err := listener.Close(); err != nil {
+			d.Log.Errorf("Cannot close listener: %s", err)
+		}
 	}
 	d.wg.Wait()
 	return nil
 }
 
-func (d *TransparentTlsProxy) run() {
+func (d *TransparentTlsProxy) run(listener net.Listener) {
 	d.wg.Add(1)
 	defer d.wg.Done()
 	for {
-		c, err := d.listener.Accept()
+		c, err := listener.Accept()
 		if err != nil {
 			select {
 			case <-d.stop:
@@ -111,26 +113,44 @@ func (d *TransparentTlsProxy) run() {
 				Header:     make(http.Header),
 				RemoteAddr: c.RemoteAddr().String(),
 			}
-			resp := dumbResponseWriter{tlsConn}
+			resp := dumbResponseWriter{&transparentConn{Conn: tlsConn}}
 			logger.Debug("Transferring request to proxy")
-			d.Proxy.ServeHTTP(resp, connectReq)
+			trackTunnels(d.Proxy).ServeHTTP(resp, connectReq)
 		}(c)
 	}
 }
 
+// dumbResponseWriter hides the response of the faux CONNECT request from the TLS client,
+// a refused request is answered with a TLS alert and the rest of the response is discarded
 type dumbResponseWriter struct {
-	net.Conn
+	*transparentConn
 }
 
-func (dumb dumbResponseWriter) Header() http.Header {
-	panic("Header() should not be called on this ResponseWriter")
+type transparentConn struct {
+	net.Conn
+	replied bool
+	refused bool
 }
 
-func (dumb dumbResponseWriter) Write(buf []byte) (int, error) {
-	if bytes.Equal(buf, []byte("HTTP/1.0 200 OK\r\n\r\n")) {
-		return len(buf), nil // throw away the HTTP OK response from the faux CONNECT request
+func (c *transparentConn) Write(buf []byte) (int, error) {
+	if c.refused {
+		return len(buf), nil
+	}
+	if c.replied {
+		return c.Conn.Write(buf)
 	}
-	return dumb.Conn.Write(buf)
+	c.replied = true
+	if status := responseStatus(buf); status != http.StatusOK {
+		c.refused = true
+		if err := writeTLSAlert(c.Conn, tlsAlert(status)); err != nil {
+			return 0, err
+		}
+	}
+	return len(buf), nil // throw away the HTTP response of the faux CONNECT request
+}
+
+func (dumb dumbResponseWriter) Header() http.Header {
+	panic("Header() should not be called on this ResponseWriter")
 }
 
 func (dumb dumbResponseWriter) WriteHeader(code int) {
@@ -138,5 +158,5 @@ func (dumb dumbResponseWriter) WriteHeader(code int) {
 }
 
 func (dumb dumbResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return dumb, bufio.NewReadWriter(bufio.NewReader(dumb), bufio.NewWriter(dumb)), nil
+	return dumb.transparentConn, bufio.NewReadWriter(bufio.NewReader(dumb.transparentConn), bufio.NewWriter(dumb.transparentConn)), nil
 }
@@ -6,15 +6,33 @@ import (
 	"net"
 )
 
+// IPv6 networks are matched with the Microsoft IPv6 extensions when the browser supports them.
+// The template is rendered by html/template, "<" would be escaped
 const WpadTemplate = `
+{{- if HasIPv6 .Direct.Networks }}
+function isInNet6(host, prefix) {
+	if (typeof isResolvedInNetEx === "function") {
+		return isResolvedInNetEx(host, prefix);
+	}
+	if (typeof dnsResolveEx === "function" && typeof isInNetEx === "function") {
+		var addresses = dnsResolveEx(host).split(";");
+		for (var i = 0; i !== addresses.length; i++) {
+			if (addresses[i] !== "" && isInNetEx(addresses[i], prefix)) {
+				return true;
+			}
+		}
+	}
+	return false;
+}
+{{ end }}
 function FindProxyForURL(url, host) {
 	// No proxy for internal networks.
-	if (isPlainHostName(host){{range .Direct.Networks }} || isInNet(dnsResolve(host), "{{ .IP }}",  "{{ PrintMask .Mask }}"){{end}}) {
+	if (isPlainHostName(host){{range .Direct.Networks }}{{ if IsIPv4 .IP }} || isInNet(dnsResolve(host), "{{ .IP }}",  "{{ PrintMask .Mask }}"){{ else }} || isInNet6(host, "{{ PrintPrefix . }}"){{ end }}{{end}}) {
 		return "DIRECT";
 	}
 
 	// send to proxy
-	return "PROXY {{.Proxy.Connection}}";
+	return "{{range $index, $connection := .Proxy.Connections }}{{ if $index }}; {{ end }}PROXY {{ $connection }}{{end}}";
 }
 `
 
@@ -24,10 +42,36 @@ var WpadPaths = map[string]bool{
 	"/wpad.da":   true,
 }
 
+// CACertificatePath serves the CA certificate of the TLS interception for enrolment
+const CACertificatePath = "/riproxy-ca.crt"
+
 var wpadFile template.Template
 
+var wpadFunctions = template.FuncMap{
+	"IsIPv4": func(ip net.IP) bool {
+		return ip.To4() != nil
+	},
+	"HasIPv6": func(networks []net.IPNet) bool {
+		for _, network := range networks {
+			if network.IP.To4() == nil {
+				return true
+			}
+		}
+		return false
+	},
+	"PrintMask": func(mask net.IPMask) string {
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+		return fmt.Sprintf("%d.%d.%d.%d", mask[0], mask[1], mask[2], mask[3])
+	},
+	"PrintPrefix": func(network net.IPNet) string {
+		return network.String()
+	},
+}
+
 func init() {
-	tmpl, err := template.New("wpad").Funcs(template.FuncMap{"PrintMask": func(mask net.IPMask) string { return fmt.Sprintf("%d.%d.%d.%d", mask[0], mask[1], mask[2], mask[3]) }}).Parse(WpadTemplate)
+	tmpl, err := template.New("wpad").Funcs(wpadFunctions).Parse(WpadTemplate)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"github.com/COSAE-FR/riproxy/configuration"
+	"net"
+	"strings"
+	"testing"
+)
+
+func mustNetwork(t *testing.T, cidr string) net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatalf("Invalid network %s: %s", cidr, err)
+	}
+	return *network
+}
+
+func renderWpad(t *testing.T, iface configuration.InterfaceConfig) string {
+	buf := &bytes.Buffer{}
+	if err := wpadFile.Execute(buf, iface); err != nil {
+		t.Fatalf("Cannot render PAC file: %s", err)
+	}
+	return buf.String()
+}
+
+func TestWpadTemplate(t *testing.T) {
+	iface := configuration.InterfaceConfig{}
+	iface.Direct.Networks = []net.IPNet{mustNetwork(t, "192.168.1.0/24"), mustNetwork(t, "2001:db8:1::/48")}
+	iface.Proxy.Connections = []string{"192.168.1.1:3128", "[2001:db8:1::1]:3128"}
+	pac := renderWpad(t, iface)
+	for _, expected := range []string{
+		"function isInNet6(host, prefix) {",
+		`isInNet(dnsResolve(host), "192.168.1.0",  "255.255.255.0")`,
+		`isInNet6(host, "2001:db8:1::/48")`,
+		`return "PROXY 192.168.1.1:3128; PROXY [2001:db8:1::1]:3128";`,
+	} {
+		if !strings.Contains(pac, expected) {
+			t.Errorf("Missing %q in PAC file:\n%s", expected, pac)
+		}
+	}
+
+	// Without IPv6 network, the PAC file does not define isInNet6
+	iface.Direct.Networks = iface.Direct.Networks[:1]
+	iface.Proxy.Connections = iface.Proxy.Connections[:1]
+	pac = renderWpad(t, iface)
+	if strings.Contains(pac, "isInNet6") || !strings.Contains(pac, `return "PROXY 192.168.1.1:3128";`) {
+		t.Errorf("Wrong IPv4 PAC file:\n%s", pac)
+	}
+}
+
+func TestWpadFunctions(t *testing.T) {
+	printMask := wpadFunctions["PrintMask"].(func(net.IPMask) string)
+	for mask, expected := range map[string]string{
+		string(net.CIDRMask(24, 32)):                       "255.255.255.0",
+		string(net.IPMask(net.ParseIP("255.255.0.0"))):     "255.255.0.0",
+		string(net.IPMask(net.ParseIP("255.255.255.252"))): "255.255.255.252",
+	} {
+		if printed := printMask(net.IPMask(mask)); printed != expected {
+			t.Errorf("Wrong mask %s, expected %s", printed, expected)
+		}
+	}
+	isIPv4 := wpadFunctions["IsIPv4"].(func(net.IP) bool)
+	if !isIPv4(net.ParseIP("192.0.2.1")) || !isIPv4(net.ParseIP("::ffff:192.0.2.1")) || isIPv4(net.ParseIP("2001:db8::1")) {
+		t.Errorf("Wrong IPv4 detection")
+	}
+	hasIPv6 := wpadFunctions["HasIPv6"].(func([]net.IPNet) bool)
+	if hasIPv6([]net.IPNet{mustNetwork(t, "10.0.0.0/8")}) || !hasIPv6([]net.IPNet{mustNetwork(t, "10.0.0.0/8"), mustNetwork(t, "fd00::/8")}) {
+		t.Errorf("Wrong IPv6 detection")
+	}
+	if prefix := wpadFunctions["PrintPrefix"].(func(net.IPNet) string)(mustNetwork(t, "2001:db8::/32")); prefix != "2001:db8::/32" {
+		t.Errorf("Wrong prefix %s", prefix)
+	}
+}
@@ -0,0 +1,298 @@
+package subscription
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/COSAE-FR/riproxy/configuration"
+	"github.com/COSAE-FR/riproxy/domains"
+	"github.com/COSAE-FR/riproxy/utils"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const maxListSize = 256 << 20
+const maxSignatureSize = 4096
+
+var errNotModified = errors.New("not modified")
+
+// cacheMetadata is stored next to the cached list to issue conditional requests
+type cacheMetadata struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+// entrySet collects the entries of a list before building its tree
+type entrySet map[string]bool
+
+func (s entrySet) PutEntry(entry domains.Entry) {
+	s[entry.Pattern] = true
+}
+
+type Subscription struct {
+	Name     string
+	Config   configuration.SubscriptionConfig
+	Log      *log.Entry
+	Client   *http.Client
+	entries  entrySet
+	metadata cacheMetadata
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func New(name string, config configuration.SubscriptionConfig, logger *log.Entry) *Subscription {
+	return &Subscription{
+		Name:   name,
+		Config: config,
+		Log: logger.WithFields(log.Fields{
+			"component":    "subscription",
+			"subscription": name,
+			"url":          config.Url,
+		}),
+		Client: &http.Client{Timeout: 5 * time.Minute},
+		stop:   make(chan struct{}),
+	}
+}
+
+// Start loads the cached copy and refreshes the list in the background
+func (s *Subscription) Start() error {
+	s.Log.Debug("starting block list subscription")
+	if err := s.loadCache(); err != nil && !os.IsNotExist(err) {
+		s.Log.Errorf("cannot load cached copy: %s", err)
+	}
+	s.wg.Add(1)
+	go s.run()
+	return nil
+}
+
+func (s *Subscription) Stop() error {
+	s.Log.Debug("stopping block list subscription")
+	close(s.stop)
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Subscription) run() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(s.Config.Interval)
+	defer ticker.Stop()
+	for {
+		_ = s.Refresh()
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh fetches the list and swaps it in if it changed, the current list is kept on error
+func (s *Subscription) Refresh() error {
+	body, metadata, err := s.fetch()
+	if err == errNotModified {
+		s.Log.WithField("entries", len(s.entries)).Debug("block list not modified")
+		return nil
+	}
+	if err == nil {
+		err = s.verify(body)
+	}
+	if err != nil {
+		s.Log.WithField("entries", len(s.entries)).Errorf("cannot refresh block list, keeping last good copy: %s", err)
+		return err
+	}
+	if err := s.apply(body, "refreshed block list"); err != nil {
+		s.Log.Errorf("cannot parse block list, keeping last good copy: %s", err)
+		return err
+	}
+	s.metadata = metadata
+	if err := s.writeCache(body); err != nil {
+		s.Log.Errorf("cannot write cached copy: %s", err)
+	}
+	return nil
+}
+
+func (s *Subscription) fetch() ([]byte, cacheMetadata, error) {
+	metadata := cacheMetadata{}
+	req, err := http.NewRequest(http.MethodGet, s.Config.Url, nil)
+	if err != nil {
+		return nil, metadata, err
+	}
+	req.Header.Set("User-Agent", fmt.Sprintf("%s/%s", utils.Name, utils.Version))
+	if s.entries != nil { // Only issue conditional requests when a copy is loaded
+		if len(s.metadata.ETag) > 0 {
+			req.Header.Set("If-None-Match", s.metadata.ETag)
+		}
+		if len(s.metadata.LastModified) > 0 {
+			req.Header.Set("If-Modified-Since", s.metadata.LastModified)
+		}
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, metadata, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, metadata, errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, metadata, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	body, err := readLimited(resp.Body, maxListSize)
+	if err != nil {
+		return nil, metadata, err
+	}
+	metadata.ETag = resp.Header.Get("ETag")
+	metadata.LastModified = resp.Header.Get("Last-Modified")
+	metadata.Fetched = time.Now()
+	return body, metadata, nil
+}
+
+func readLimited(reader io.Reader, limit int64) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("response larger than %d bytes", limit)
+	}
+	return body, nil
+}
+
+// verify checks the detached signature of body, raw or base64 encoded
+func (s *Subscription) verify(body []byte) error {
+	if len(s.Config.PublicKey) == 0 {
+		return nil
+	}
+	resp, err := s.Client.Get(s.Config.SignatureUrl)
+	if err != nil {
+		return fmt.Errorf("cannot fetch signature: %s", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot fetch signature: unexpected HTTP status %s", resp.Status)
+	}
+	signature, err := readLimited(resp.Body, maxSignatureSize)
+	if err != nil {
+		return fmt.Errorf("cannot fetch signature: %s", err)
+	}
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+		if err != nil {
+			return errors.New("invalid signature encoding")
+		}
+		signature = decoded
+	}
+	if len(signature) != ed25519.SignatureSize || !ed25519.Verify(s.Config.PublicKey, body, signature) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// apply parses body, builds a new tree and swaps it in
+func (s *Subscription) apply(body []byte, message string) error {
+	entries := entrySet{}
+	source := "subscription:" + s.Name
+	result, err := domains.Load(entries, bytes.NewReader(body), source, s.Config.Category, s.Config.ListFormat)
+	if err != nil {
+		return err
+	}
+	for _, lineError := range result.Errors {
+		s.Log.Debugf("invalid block list entry: %s", lineError)
+	}
+	// Subscribed lists can hold millions of entries and are never modified, use a compact tree
+	var builder *domains.CompactBuilder
+	if s.Config.BlockByIDN {
+		builder = domains.NewIDNACompactBuilder()
+	} else {
+		builder = domains.NewCompactBuilder()
+	}
+	added, removed := 0, 0
+	for entry := range entries {
+		builder.PutEntry(domains.Entry{Pattern: entry, Source: source, Category: s.Config.Category})
+		if !s.entries[entry] {
+			added++
+		}
+	}
+	for entry := range s.entries {
+		if !entries[entry] {
+			removed++
+		}
+	}
+	tree, err := builder.Build()
+	if err != nil {
+		return err
+	}
+	s.Config.Tree.Swap(tree)
+	s.entries = entries
+	s.Log.WithFields(log.Fields{
+		"entries": len(entries),
+		"added":   added,
+		"removed": removed,
+		"errors":  len(result.Errors),
+	}).Infof("%s: %d entries (+%d -%d)", message, len(entries), added, removed)
+	return nil
+}
+
+func (s *Subscription) loadCache() error {
+	body, err := ioutil.ReadFile(s.Config.Cache)
+	if err != nil {
+		return err
+	}
+	metadata := cacheMetadata{}
+	if data, err := ioutil.ReadFile(s.Config.Cache + ".meta"); err == nil {
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			s.Log.Warnf("cannot parse cache metadata: %s", err)
+		}
+	}
+	if err := s.apply(body, "loaded cached block list"); err != nil {
+		return err
+	}
+	s.metadata = metadata
+	return nil
+}
+
+// writeCache replaces the cached copy and its metadata
+func (s *Subscription) writeCache(body []byte) error {
+	if err := os.MkdirAll(filepath.Dir(s.Config.Cache), 0750); err != nil {
+		return err
+	}
+	metadata, err := json.Marshal(s.metadata)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.Config.Cache, body); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.Config.Cache+".meta", metadata)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,139 @@
+package subscription
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/COSAE-FR/riproxy/configuration"
+	"github.com/COSAE-FR/riproxy/domains"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type listServer struct {
+	sync.Mutex
+	list        string
+	etag        string
+	signature   []byte
+	fail        bool
+	notModified int
+}
+
+func (l *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.Lock()
+	defer l.Unlock()
+	if l.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Path == "/list.txt.sig" {
+		_, _ = w.Write([]byte(base64.StdEncoding.EncodeToString(l.signature)))
+		return
+	}
+	if r.Header.Get("If-None-Match") == l.etag {
+		l.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", l.etag)
+	_, _ = w.Write([]byte(l.list))
+}
+
+func newTestSubscription(t *testing.T, url string, publicKey ed25519.PublicKey) *Subscription {
+	dir, err := ioutil.TempDir("", "riproxy")
+	if err != nil {
+		t.Fatalf("Cannot create cache directory: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	config := configuration.SubscriptionConfig{
+		Url:          url + "/list.txt",
+		SignatureUrl: url + "/list.txt.sig",
+		Interval:     time.Hour,
+		ListFormat:   domains.FormatAuto,
+		PublicKey:    publicKey,
+		Cache:        filepath.Join(dir, "test.list"),
+		Tree:         domains.NewAtomic(nil),
+	}
+	logger := log.NewEntry(log.New())
+	logger.Logger.SetOutput(ioutil.Discard)
+	return New("test", config, logger)
+}
+
+func TestRefresh(t *testing.T) {
+	server := &listServer{list: "ads.example.com\n0.0.0.0 tracker.example.com\n", etag: `"1"`}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	subscription := newTestSubscription(t, httpServer.URL, nil)
+
+	if err := subscription.Refresh(); err != nil {
+		t.Fatalf("Cannot refresh: %s", err)
+	}
+	if !subscription.Config.Tree.Get("tracker.example.com") {
+		t.Fatalf("Cannot find domain %s", "tracker.example.com")
+	}
+	if err := subscription.Refresh(); err != nil || server.notModified != 1 {
+		t.Fatalf("Second refresh should be a conditional request")
+	}
+
+	server.Lock()
+	server.list, server.etag = "other.example.com\n", `"2"`
+	server.Unlock()
+	if err := subscription.Refresh(); err != nil {
+		t.Fatalf("Cannot refresh: %s", err)
+	}
+	if subscription.Config.Tree.Get("ads.example.com") || !subscription.Config.Tree.Get("other.example.com") {
+		t.Fatalf("Tree not swapped")
+	}
+
+	server.Lock()
+	server.fail = true
+	server.Unlock()
+	if err := subscription.Refresh(); err == nil {
+		t.Fatalf("Refresh should fail")
+	}
+	if !subscription.Config.Tree.Get("other.example.com") {
+		t.Fatalf("Last good copy should be kept")
+	}
+
+	// A new instance starts with the cached copy
+	cached := New("test", subscription.Config, subscription.Log)
+	cached.Config.Tree = domains.NewAtomic(nil)
+	if err := cached.loadCache(); err != nil {
+		t.Fatalf("Cannot load cache: %s", err)
+	}
+	if !cached.Config.Tree.Get("other.example.com") || cached.metadata.ETag != `"2"` {
+		t.Fatalf("Wrong cached copy")
+	}
+}
+
+func TestSignature(t *testing.T) {
+	publicKey, privateKey, _ := ed25519.GenerateKey(rand.Reader)
+	list := "ads.example.com\n"
+	server := &listServer{list: list, etag: `"1"`, signature: ed25519.Sign(privateKey, []byte(list))}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+	subscription := newTestSubscription(t, httpServer.URL, publicKey)
+
+	if err := subscription.Refresh(); err != nil {
+		t.Fatalf("Cannot refresh signed list: %s", err)
+	}
+
+	server.Lock()
+	server.list, server.etag = "evil.example.com\n", `"2"`
+	server.Unlock()
+	if err := subscription.Refresh(); err == nil {
+		t.Fatalf("List with a wrong signature accepted")
+	}
+	if subscription.Config.Tree.Get("evil.example.com") || !subscription.Config.Tree.Get("ads.example.com") {
+		t.Fatalf("Last good copy should be kept")
+	}
+}
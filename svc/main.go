@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/COSAE-FR/riproxy/configuration"
 	"github.com/COSAE-FR/riproxy/server"
+	"github.com/COSAE-FR/riproxy/subscription"
 	"github.com/COSAE-FR/riproxy/utils"
 	"github.com/COSAE-FR/riputils/arp"
 	"github.com/COSAE-FR/riputils/common/logging"
@@ -16,6 +17,7 @@ type Daemon struct {
 	Configuration *configuration.MainConfiguration
 	LogMacAddress bool
 	Servers       []server.Server
+	Subscriptions []*subscription.Subscription
 }
 
 func (d Daemon) Start() error {
@@ -23,6 +25,15 @@ func (d Daemon) Start() error {
 		d.Configuration.Log.WithField("component", "arp_cache").Debug("Starting ARP cache table auto refresh")
 		arp.AutoRefresh(time.Second * 60)
 	}
+	if resolver := d.Configuration.Defaults.LookupResolver(); resolver != nil {
+		_ = resolver.Start()
+	}
+	if router := d.Configuration.Defaults.UpstreamRouter(); router != nil {
+		_ = router.Start()
+	}
+	for _, sub := range d.Subscriptions {
+		_ = sub.Start()
+	}
 	for _, svr := range d.Servers {
 		svr := svr
 		err := svr.Start()
@@ -37,6 +48,15 @@ func (d Daemon) Stop() error {
 	for _, svr := range d.Servers {
 		_ = svr.Stop()
 	}
+	for _, sub := range d.Subscriptions {
+		_ = sub.Stop()
+	}
+	if router := d.Configuration.Defaults.UpstreamRouter(); router != nil {
+		_ = router.Stop()
+	}
+	if resolver := d.Configuration.Defaults.LookupResolver(); resolver != nil {
+		_ = resolver.Stop()
+	}
 	if d.LogMacAddress {
 		d.Configuration.Log.WithField("component", "arp_cache").Debug("Stopping ARP cache table auto refresh")
 		arp.StopAutoRefresh()
@@ -51,6 +71,13 @@ func New(cfg Config) (*Daemon, error) {
 	}
 	daemon := Daemon{Configuration: config}
 	daemon.LogMacAddress = config.Logging.LogMacAddress
+	for name, subscriptionConfig := range config.Defaults.Subscriptions {
+		logger := daemon.Configuration.Log.WithFields(log.Fields{
+			"app":     utils.Name,
+			"version": utils.Version,
+		})
+		daemon.Subscriptions = append(daemon.Subscriptions, subscription.New(name, subscriptionConfig, logger))
+	}
 	for _, iface := range daemon.Configuration.Interfaces {
 		logger := daemon.Configuration.Log.WithFields(log.Fields{
 			"app":       utils.Name,
@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/net/proxy"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type Kind int
+
+const (
+	HTTP Kind = iota
+	SOCKS5
+)
+
+func (k Kind) String() string {
+	if k == SOCKS5 {
+		return "socks5"
+	}
+	return "http"
+}
+
+// DialFunc dials the parent proxies
+type DialFunc func(ctx context.Context, network string, addr string) (net.Conn, error)
+
+func (d DialFunc) Dial(network string, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+func (d DialFunc) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// Parent is an upstream proxy, HTTP proxies are used with CONNECT for the tunnels
+type Parent struct {
+	Name    string
+	Kind    Kind
+	URL     *url.URL
+	Address string // host and port of the parent
+	down    int32
+}
+
+// ParseParent parses an http:// or socks5:// URL, the credentials of the parent can be set in the URL
+func ParseParent(name string, rawURL string) (*Parent, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	parent := &Parent{Name: name, URL: parsed}
+	defaultPort := "3128"
+	switch strings.ToLower(parsed.Scheme) {
+	case "http":
+	case "socks5", "socks5h":
+		parent.Kind = SOCKS5
+		parsed.Scheme = "socks5"
+		defaultPort = "1080"
+	default:
+		return nil, fmt.Errorf("unsupported parent proxy scheme: %s", parsed.Scheme)
+	}
+	if len(parsed.Hostname()) == 0 {
+		return nil, fmt.Errorf("missing parent proxy host: %s", rawURL)
+	}
+	port := parsed.Port()
+	if len(port) == 0 {
+		port = defaultPort
+	}
+	parent.Address = net.JoinHostPort(parsed.Hostname(), port)
+	parsed.Host = parent.Address
+	return parent, nil
+}
+
+// Healthy returns false if the last health check or connection to the parent failed
+func (p *Parent) Healthy() bool {
+	return atomic.LoadInt32(&p.down) == 0
+}
+
+// setHealthy updates the state of the parent and returns true if it changed
+func (p *Parent) setHealthy(healthy bool) bool {
+	var down int32 = 1
+	if healthy {
+		down = 0
+	}
+	return atomic.SwapInt32(&p.down, down) != down
+}
+
+// ProxyURL returns the URL given to the HTTP transport for plain HTTP requests
+func (p *Parent) ProxyURL() *url.URL {
+	return p.URL
+}
+
+// Dial opens a tunnel to address through the parent, dial connects to the parent
+func (p *Parent) Dial(ctx context.Context, dial DialFunc, address string) (net.Conn, error) {
+	if p.Kind == SOCKS5 {
+		var auth *proxy.Auth
+		if p.URL.User != nil {
+			password, _ := p.URL.User.Password()
+			auth = &proxy.Auth{User: p.URL.User.Username(), Password: password}
+		}
+		dialer, err := proxy.SOCKS5("tcp", p.Address, auth, dial)
+		if err != nil {
+			return nil, err
+		}
+		return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+	}
+	conn, err := dial(ctx, "tcp", p.Address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if p.URL.User != nil {
+		password, _ := p.URL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.URL.User.Username() + ":" + password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, request)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, &TunnelError{Parent: p.Name, Status: resp.Status}
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// TunnelError is returned when the parent refuses a tunnel, the parent is still healthy
+type TunnelError struct {
+	Parent string
+	Status string
+}
+
+func (e *TunnelError) Error() string {
+	return fmt.Sprintf("parent proxy %s refused the tunnel: %s", e.Parent, e.Status)
+}
+
+// bufferedConn returns the data read with the response of the parent before reading the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
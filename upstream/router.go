@@ -0,0 +1,202 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"github.com/COSAE-FR/riproxy/acl"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHealthInterval = 30 * time.Second
+	DefaultHealthTimeout  = 5 * time.Second
+)
+
+// Direct is the name of the direct connections in the logs
+const Direct = "DIRECT"
+
+// ErrNoParent is returned when no parent of a route without direct fallback can be used
+var ErrNoParent = errors.New("no parent proxy available")
+
+// Route sends the requests matching its rule to its parents, in order
+type Route struct {
+	Name    string
+	Rule    *acl.Rule // conditions of the route, only the match conditions are used
+	Parents []*Parent
+	Direct  bool // connect directly when no parent is available
+}
+
+// Candidates returns the healthy parents in order.
+// If none is healthy and the route cannot connect directly, every parent is returned: one of them may be back.
+func (r *Route) Candidates() []*Parent {
+	var candidates []*Parent
+	for _, parent := range r.Parents {
+		if parent.Healthy() {
+			candidates = append(candidates, parent)
+		}
+	}
+	if len(candidates) == 0 && !r.Direct {
+		return r.Parents
+	}
+	return candidates
+}
+
+// Router selects the route of the requests and checks the health of the parents
+type Router struct {
+	Routes         []*Route
+	Parents        []*Parent
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+	Dial           DialFunc // connects to the parents
+	Log            *log.Entry
+	stop           chan struct{}
+	wg             sync.WaitGroup
+}
+
+// New returns a router connecting to the parents, their names are resolved with resolver if set
+func New(parents []*Parent, routes []*Route, resolver acl.Resolver, logger *log.Entry) *Router {
+	return &Router{
+		Routes:         routes,
+		Parents:        parents,
+		HealthInterval: DefaultHealthInterval,
+		HealthTimeout:  DefaultHealthTimeout,
+		Dial:           resolvingDialer(resolver),
+		Log:            logger.WithField("component", "upstream"),
+	}
+}
+
+func resolvingDialer(resolver acl.Resolver) DialFunc {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if resolver != nil && net.ParseIP(host) == nil {
+			addresses, err := resolver.LookupIPAddr(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			if len(addresses) == 0 {
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+			addr = net.JoinHostPort(addresses[0].IP.String(), port)
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// Route returns the first route matching req, nil if the request must be sent directly
+func (r *Router) Route(req *acl.Request) *Route {
+	if r == nil {
+		return nil
+	}
+	for _, route := range r.Routes {
+		if route.Rule == nil || route.Rule.Match(req) {
+			return route
+		}
+	}
+	return nil
+}
+
+// markDown records a connection failure to parent
+func (r *Router) markDown(parent *Parent, err error) {
+	if parent.setHealthy(false) {
+		r.Log.WithField("upstream", parent.Name).Warnf("parent proxy is down: %s", err)
+	}
+}
+
+// DialRoute opens a tunnel to address through the parents of route, in order.
+// direct is used when no parent is available and the route allows it.
+// The name of the parent used, or Direct, is returned.
+func (r *Router) DialRoute(ctx context.Context, route *Route, address string, direct func() (net.Conn, error)) (net.Conn, string, error) {
+	err := ErrNoParent
+	for _, parent := range route.Candidates() {
+		parentDown := false
+		dial := func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			conn, err := r.Dial(ctx, network, addr)
+			parentDown = err != nil
+			return conn, err
+		}
+		var conn net.Conn
+		conn, err = parent.Dial(ctx, dial, address)
+		if err == nil {
+			return conn, parent.Name, nil
+		}
+		if parentDown {
+			r.markDown(parent, err)
+		} else {
+			r.Log.WithField("upstream", parent.Name).Warnf("cannot open tunnel to %s: %s", address, err)
+		}
+		if ctx.Err() != nil {
+			return nil, parent.Name, ctx.Err()
+		}
+	}
+	if route.Direct {
+		conn, err := direct()
+		return conn, Direct, err
+	}
+	return nil, "", err
+}
+
+// Start checks the health of the parents periodically
+func (r *Router) Start() error {
+	if r.stop != nil || len(r.Parents) == 0 {
+		return nil
+	}
+	r.stop = make(chan struct{})
+	r.wg.Add(1)
+	go r.run()
+	return nil
+}
+
+func (r *Router) Stop() error {
+	if r.stop == nil {
+		return nil
+	}
+	close(r.stop)
+	r.wg.Wait()
+	r.stop = nil
+	return nil
+}
+
+func (r *Router) run() {
+	defer r.wg.Done()
+	ticker := time.NewTicker(r.HealthInterval)
+	defer ticker.Stop()
+	r.CheckHealth()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.CheckHealth()
+		}
+	}
+}
+
+// CheckHealth connects to every parent and updates their state
+func (r *Router) CheckHealth() {
+	var wg sync.WaitGroup
+	for _, parent := range r.Parents {
+		wg.Add(1)
+		go func(parent *Parent) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), r.HealthTimeout)
+			defer cancel()
+			conn, err := r.Dial(ctx, "tcp", parent.Address)
+			if err != nil {
+				r.markDown(parent, err)
+				return
+			}
+			_ = conn.Close()
+			if parent.setHealthy(true) {
+				r.Log.WithField("upstream", parent.Name).Info("parent proxy is up")
+			}
+		}(parent)
+	}
+	wg.Wait()
+}
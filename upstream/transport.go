@@ -0,0 +1,117 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// DialError is returned by the transports of the parents when the parent cannot be reached
+type DialError struct {
+	Parent string
+	Err    error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("cannot connect to parent proxy %s: %s", e.Parent, e.Err)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// Transport sends the plain HTTP requests of a route through its parents, each parent has a clone of the base transport
+type Transport struct {
+	Router     *Router
+	Base       *http.Transport
+	lock       sync.Mutex
+	transports map[*Parent]*http.Transport
+}
+
+func NewTransport(router *Router, base *http.Transport) *Transport {
+	return &Transport{Router: router, Base: base, transports: map[*Parent]*http.Transport{}}
+}
+
+// parentTransport returns the transport of parent, created on first use
+func (t *Transport) parentTransport(parent *Parent) *http.Transport {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if transport, ok := t.transports[parent]; ok {
+		return transport
+	}
+	transport := t.Base.Clone()
+	transport.Proxy = http.ProxyURL(parent.ProxyURL())
+	// The transport only dials the parent, a failure means the parent cannot be reached
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := t.Router.Dial(ctx, network, addr)
+		if err != nil {
+			return nil, &DialError{Parent: parent.Name, Err: err}
+		}
+		return conn, nil
+	}
+	t.transports[parent] = transport
+	return transport
+}
+
+// rewind returns req with a new body for another try, false if the body cannot be sent again
+func rewind(req *http.Request) (*http.Request, bool) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return req, true
+	}
+	if req.GetBody == nil {
+		return nil, false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, false
+	}
+	retry := *req
+	retry.Body = body
+	return &retry, true
+}
+
+// RoundTrip sends req through the parents of route, in order, like DialRoute.
+// A parent that cannot be reached is marked down and the next one is tried, if the body of req can be sent again.
+// direct sends the request when no parent is available and the route allows it.
+// The name of the parent used, or Direct, is returned.
+func (t *Transport) RoundTrip(req *http.Request, route *Route, direct func(*http.Request) (*http.Response, error)) (*http.Response, string, error) {
+	err := ErrNoParent
+	attempt, tries := req, 0
+	for _, parent := range route.Candidates() {
+		if tries > 0 {
+			var ok bool
+			if attempt, ok = rewind(req); !ok {
+				return nil, "", err
+			}
+		}
+		tries++
+		var resp *http.Response
+		resp, err = t.parentTransport(parent).RoundTrip(attempt)
+		if err == nil {
+			return resp, parent.Name, nil
+		}
+		var dialError *DialError
+		if !errors.As(err, &dialError) {
+			// The parent received the request, it is not sent twice
+			return nil, parent.Name, err
+		}
+		t.Router.markDown(parent, err)
+		if req.Context().Err() != nil {
+			return nil, parent.Name, req.Context().Err()
+		}
+	}
+	if route.Direct {
+		if tries > 0 {
+			var ok bool
+			if attempt, ok = rewind(req); !ok {
+				return nil, "", err
+			}
+		}
+		resp, err := direct(attempt)
+		return resp, Direct, err
+	}
+	return nil, "", err
+}
@@ -0,0 +1,83 @@
+package upstream
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// plainParent answers every plain HTTP request with the name of the parent and the requested URL
+func plainParent(t *testing.T, name string) string {
+	listener := listen(t)
+	go func() {
+		_ = http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = io.WriteString(w, name+" "+req.URL.String())
+		}))
+	}()
+	return listener.Addr().String()
+}
+
+func checkBody(t *testing.T, resp *http.Response, expected string) {
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || string(body) != expected {
+		t.Fatalf("Wrong response %q %v, expected %q", body, err, expected)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	router := New(nil, nil, nil, testLogger())
+	transport := NewTransport(router, &http.Transport{})
+	noDirect := func(*http.Request) (*http.Response, error) {
+		t.Fatalf("Direct request sent")
+		return nil, nil
+	}
+	newRequest := func(body io.Reader) *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "http://www.example.com/path", body)
+		if err != nil {
+			t.Fatalf("Cannot create request: %s", err)
+		}
+		return req
+	}
+
+	dead := mustParent(t, "dead", "http://"+closedAddress(t))
+	corp := mustParent(t, "corp", "http://"+plainParent(t, "corp"))
+	resp, name, err := transport.RoundTrip(newRequest(strings.NewReader("data")), &Route{Parents: []*Parent{dead, corp}}, noDirect)
+	if err != nil || name != "corp" {
+		t.Fatalf("Expected a request through corp, got %s %v", name, err)
+	}
+	checkBody(t, resp, "corp http://www.example.com/path")
+	if dead.Healthy() || !corp.Healthy() {
+		t.Fatalf("Wrong parent states: dead %v, corp %v", dead.Healthy(), corp.Healthy())
+	}
+
+	dead = mustParent(t, "dead", "http://"+closedAddress(t))
+	direct := func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("direct"))}, nil
+	}
+	resp, name, err = transport.RoundTrip(newRequest(nil), &Route{Parents: []*Parent{dead}, Direct: true}, direct)
+	if err != nil || name != Direct {
+		t.Fatalf("Expected a direct request, got %s %v", name, err)
+	}
+	checkBody(t, resp, "direct")
+
+	// The body of a received request cannot be read again, the request is not sent to the next parent
+	dead = mustParent(t, "dead", "http://"+closedAddress(t))
+	req := newRequest(ioutil.NopCloser(strings.NewReader("data")))
+	req.GetBody = nil
+	if _, _, err = transport.RoundTrip(req, &Route{Parents: []*Parent{dead, corp}}, noDirect); err == nil {
+		t.Fatalf("Request body sent twice")
+	}
+	if dead.Healthy() {
+		t.Fatalf("Unreachable parent not marked down")
+	}
+
+	dead = mustParent(t, "dead", "http://"+closedAddress(t))
+	if _, _, err = transport.RoundTrip(newRequest(nil), &Route{Parents: []*Parent{dead}}, noDirect); err == nil {
+		t.Fatalf("Request through a dead parent succeeded")
+	}
+}
@@ -3,21 +3,29 @@ package utils
 import (
 	"net"
 	"strconv"
+	"strings"
 )
 
+// GetConnection splits an address with or without port, for both IP families.
+// IPv6 zones are removed and IPv4-mapped IPv6 addresses are returned as IPv4 addresses.
 func GetConnection(connection string) (net.IP, uint16) {
 	if len(connection) == 0 {
 		return nil, 0
 	}
-	returnIP := net.IP{}
+	host := connection
 	var returnPort uint16
-	host, portString, err := net.SplitHostPort(connection)
-	if err == nil {
-		returnIP = net.ParseIP(host)
+	if splitHost, portString, err := net.SplitHostPort(connection); err == nil {
+		host = splitHost
 		port, _ := strconv.ParseUint(portString, 10, 16)
 		returnPort = uint16(port)
-	} else {
-		returnIP = net.ParseIP(connection)
+	}
+	host = strings.Trim(host, "[]")
+	if zone := strings.IndexByte(host, '%'); zone >= 0 {
+		host = host[:zone]
+	}
+	returnIP := net.ParseIP(host)
+	if ip4 := returnIP.To4(); ip4 != nil {
+		returnIP = ip4
 	}
 	return returnIP, returnPort
 }
@@ -0,0 +1,45 @@
+package utils
+
+import (
+	"net"
+	"testing"
+)
+
+func TestGetConnection(t *testing.T) {
+	tests := []struct {
+		connection string
+		ip         string
+		port       uint16
+	}{
+		{"192.0.2.1:8080", "192.0.2.1", 8080},
+		{"192.0.2.1", "192.0.2.1", 0},
+		{"[2001:db8::1]:443", "2001:db8::1", 443},
+		{"[2001:db8::1]", "2001:db8::1", 0},
+		{"2001:db8::1", "2001:db8::1", 0},
+		{"[fe80::1%eth0]:3128", "fe80::1", 3128},
+		{"fe80::1%eth0", "fe80::1", 0},
+		{"[::ffff:192.0.2.1]:80", "192.0.2.1", 80},
+		{"::ffff:192.0.2.1", "192.0.2.1", 0},
+		{"", "", 0},
+		{"pipe", "", 0},
+	}
+	for _, test := range tests {
+		ip, port := GetConnection(test.connection)
+		if port != test.port {
+			t.Errorf("%q: wrong port %d, expected %d", test.connection, port, test.port)
+		}
+		if len(test.ip) == 0 {
+			if ip != nil {
+				t.Errorf("%q: unexpected address %s", test.connection, ip)
+			}
+			continue
+		}
+		if !ip.Equal(net.ParseIP(test.ip)) {
+			t.Errorf("%q: wrong address %s, expected %s", test.connection, ip, test.ip)
+		}
+		// IPv4 addresses, mapped or not, are returned in their 4 bytes form
+		if ip.To4() != nil && len(ip) != net.IPv4len {
+			t.Errorf("%q: IPv4 address of %d bytes", test.connection, len(ip))
+		}
+	}
+}